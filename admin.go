@@ -0,0 +1,274 @@
+package go_rate_limiter
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	rlstorage "pkg/rl-storage"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNilAuthenticate = fmt.Errorf("authenticate func is nil")
+	ErrUnauthorized    = fmt.Errorf("unauthorized")
+	ErrNoKey           = fmt.Errorf("no key specified")
+	ErrUnsupported     = fmt.Errorf("operation is not supported by the storage")
+)
+
+// AuthenticateFunc checks whether the request is allowed to use the admin API.
+// Any returned error is reported as 401 Unauthorized.
+type AuthenticateFunc func(r *http.Request) error
+
+// BearerTokenAuth returns AuthenticateFunc accepting requests with "Authorization: Bearer <token>" header.
+// An empty token denies all requests, so a missing secret does not leave the admin API open.
+func BearerTokenAuth(token string) AuthenticateFunc {
+	const prefix = "Bearer "
+	return func(r *http.Request) error {
+		header := r.Header.Get("Authorization")
+		if token == "" || !strings.HasPrefix(header, prefix) {
+			return ErrUnauthorized
+		}
+		if subtle.ConstantTimeCompare([]byte(header[len(prefix):]), []byte(token)) != 1 {
+			return ErrUnauthorized
+		}
+		return nil
+	}
+}
+
+// AdminConfig is used to NewAdminHandler. It setups the AdminHandler.
+type AdminConfig struct {
+	// Authenticate is called before every request. It is required, so the admin API
+	// is never exposed without authentication by accident.
+	Authenticate AuthenticateFunc
+}
+
+// AdminHandler is http.Handler that exposes the storage for inspecting and adjusting buckets.
+// It is supposed to be mounted on an internal port. All responses are JSON.
+//
+//	GET    /keys?prefix=<prefix>           list buckets (if the storage is rlstorage.Scanner)
+//	GET    /bucket?key=<key>               get limit and remaining tokens
+//	PUT    /bucket?key=<key>               set limit: {"tokens": 10, "interval": "1m"}
+//	DELETE /bucket?key=<key>               delete key
+//	POST   /bucket/burst?key=<key>         add tokens: {"tokens": 5}
+//	POST   /bucket/reset?key=<key>         refill bucket
+type AdminHandler struct {
+	storage      rlstorage.Storage
+	authenticate AuthenticateFunc
+	mux          *http.ServeMux
+}
+
+// Bucket is the JSON representation of a single key's state.
+type Bucket struct {
+	Key       string `json:"key"`
+	Limit     uint64 `json:"limit"`
+	Remaining uint64 `json:"remaining"`
+	// Interval is reported only by the keys listing.
+	Interval string `json:"interval,omitempty"`
+}
+
+type setRequest struct {
+	Tokens   uint64 `json:"tokens"`
+	Interval string `json:"interval"`
+}
+
+type burstRequest struct {
+	Tokens uint64 `json:"tokens"`
+}
+
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+type keysResponse struct {
+	Buckets []*Bucket `json:"buckets"`
+}
+
+func NewAdminHandler(s rlstorage.Storage, cfg *AdminConfig) (*AdminHandler, error) {
+	if s == nil {
+		return nil, ErrNilStorage
+	}
+
+	if cfg == nil || cfg.Authenticate == nil {
+		return nil, ErrNilAuthenticate
+	}
+
+	ah := &AdminHandler{
+		storage:      s,
+		authenticate: cfg.Authenticate,
+		mux:          http.NewServeMux(),
+	}
+
+	ah.mux.HandleFunc("/keys", ah.handleKeys)
+	ah.mux.HandleFunc("/bucket", ah.handleBucket)
+	ah.mux.HandleFunc("/bucket/burst", ah.handleBurst)
+	ah.mux.HandleFunc("/bucket/reset", ah.handleReset)
+	return ah, nil
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := ah.authenticate(r); err != nil {
+		writeJSON(w, http.StatusUnauthorized, &errorResponse{Error: err.Error()})
+		return
+	}
+
+	ah.mux.ServeHTTP(w, r)
+}
+
+func (ah *AdminHandler) handleKeys(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeMethodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	scanner, ok := ah.storage.(rlstorage.Scanner)
+	if !ok {
+		writeError(w, ErrUnsupported)
+		return
+	}
+
+	buckets := make([]*Bucket, 0)
+	if err := scanner.Scan(r.Context(), r.URL.Query().Get("prefix"), func(state rlstorage.KeyState) bool {
+		buckets = append(buckets, &Bucket{
+			Key:       state.Key,
+			Limit:     state.Tokens,
+			Remaining: state.Remaining,
+			Interval:  state.Interval.String(),
+		})
+		return true
+	}); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Key < buckets[j].Key })
+	writeJSON(w, http.StatusOK, &keysResponse{Buckets: buckets})
+}
+
+func (ah *AdminHandler) handleBucket(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, ErrNoKey)
+		return
+	}
+
+	ctx := r.Context()
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var request setRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			writeJSON(w, http.StatusBadRequest, &errorResponse{Error: err.Error()})
+			return
+		}
+
+		interval, err := time.ParseDuration(request.Interval)
+		if err != nil || interval <= 0 || request.Tokens == 0 {
+			writeJSON(w, http.StatusBadRequest, &errorResponse{Error: "tokens and positive interval are required"})
+			return
+		}
+
+		if err := ah.storage.Set(ctx, key, request.Tokens, interval); err != nil {
+			writeError(w, err)
+			return
+		}
+	case http.MethodDelete:
+		if err := ah.storage.Delete(ctx, key); err != nil {
+			writeError(w, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		writeMethodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		return
+	}
+
+	ah.writeBucket(w, r, key)
+}
+
+func (ah *AdminHandler) handleBurst(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, ErrNoKey)
+		return
+	}
+
+	var request burstRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSON(w, http.StatusBadRequest, &errorResponse{Error: err.Error()})
+		return
+	}
+
+	if err := ah.storage.Burst(r.Context(), key, request.Tokens); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ah.writeBucket(w, r, key)
+}
+
+func (ah *AdminHandler) handleReset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeMethodNotAllowed(w, http.MethodPost)
+		return
+	}
+
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		writeError(w, ErrNoKey)
+		return
+	}
+
+	if err := ah.storage.Reset(r.Context(), key); err != nil {
+		writeError(w, err)
+		return
+	}
+
+	ah.writeBucket(w, r, key)
+}
+
+// writeBucket writes the current state of key
+func (ah *AdminHandler) writeBucket(w http.ResponseWriter, r *http.Request, key string) {
+	limit, remaining, err := ah.storage.Get(r.Context(), key)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, &Bucket{Key: key, Limit: limit, Remaining: remaining})
+}
+
+// writeError maps known errors to status codes, others are reported as 500
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, ErrNoKey):
+		status = http.StatusBadRequest
+	case errors.Is(err, ErrUnsupported), errors.Is(err, rlstorage.ErrNotSupported):
+		status = http.StatusNotImplemented
+	case errors.Is(err, rlstorage.ErrStopped):
+		status = http.StatusServiceUnavailable
+	}
+
+	writeJSON(w, status, &errorResponse{Error: err.Error()})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeJSON(w, http.StatusMethodNotAllowed, &errorResponse{Error: http.StatusText(http.StatusMethodNotAllowed)})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,148 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"pkg/memstorage"
+)
+
+func TestBearerTokenAuth(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		token, header string
+		err           error
+	}{
+		{token: "secret", header: "Bearer secret"},
+		{token: "secret", header: "Bearer wrong", err: ErrUnauthorized},
+		{token: "secret", header: "secret", err: ErrUnauthorized},
+		{token: "secret", header: "", err: ErrUnauthorized},
+		// an empty token denies all requests
+		{token: "", header: "", err: ErrUnauthorized},
+		{token: "", header: "Bearer ", err: ErrUnauthorized},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		if c.header != "" {
+			request.Header.Set("Authorization", c.header)
+		}
+		if err := BearerTokenAuth(c.token)(request); err != c.err {
+			t.Errorf("token %q, header %q: expected %v, got %v", c.token, c.header, c.err, err)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{
+		Tokens:   5,
+		Interval: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, err := NewAdminHandler(storage, nil); err != ErrNilAuthenticate {
+		t.Errorf("expected %v, got %v", ErrNilAuthenticate, err)
+	}
+
+	handler, err := NewAdminHandler(storage, &AdminConfig{Authenticate: BearerTokenAuth("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	do := func(method, target, body, token string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(method, target, strings.NewReader(body))
+		if token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	bucket := func(recorder *httptest.ResponseRecorder) Bucket {
+		var b Bucket
+		if err := json.NewDecoder(recorder.Body).Decode(&b); err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+
+	if got, want := do(http.MethodGet, "/bucket?key=a", "", "wrong").Code, http.StatusUnauthorized; got != want {
+		t.Errorf("status: expected %d, got %d", want, got)
+	}
+	if got, want := do(http.MethodGet, "/bucket", "", "secret").Code, http.StatusBadRequest; got != want {
+		t.Errorf("status: expected %d, got %d", want, got)
+	}
+	if got, want := do(http.MethodPost, "/bucket?key=a", "", "secret").Code, http.StatusMethodNotAllowed; got != want {
+		t.Errorf("status: expected %d, got %d", want, got)
+	}
+	if got, want := do(http.MethodPut, "/bucket?key=a", `{"tokens": 10}`, "secret").Code, http.StatusBadRequest; got != want {
+		t.Errorf("status: expected %d, got %d", want, got)
+	}
+
+	// set
+	recorder := do(http.MethodPut, "/bucket?key=user:a", `{"tokens": 10, "interval": "1m"}`, "secret")
+	if got, want := recorder.Code, http.StatusOK; got != want {
+		t.Fatalf("status: expected %d, got %d", want, got)
+	}
+	if got, want := bucket(recorder), (Bucket{Key: "user:a", Limit: 10, Remaining: 10}); got != want {
+		t.Errorf("bucket: expected %+v, got %+v", want, got)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, err := storage.Take(ctx, "user:a"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, _, err := storage.Take(ctx, "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	// get
+	if got, want := bucket(do(http.MethodGet, "/bucket?key=user:a", "", "secret")), (Bucket{Key: "user:a", Limit: 10, Remaining: 7}); got != want {
+		t.Errorf("bucket: expected %+v, got %+v", want, got)
+	}
+	// burst
+	if got, want := bucket(do(http.MethodPost, "/bucket/burst?key=user:a", `{"tokens": 2}`, "secret")), (Bucket{Key: "user:a", Limit: 10, Remaining: 9}); got != want {
+		t.Errorf("bucket: expected %+v, got %+v", want, got)
+	}
+	// reset
+	if got, want := bucket(do(http.MethodPost, "/bucket/reset?key=user:a", "", "secret")), (Bucket{Key: "user:a", Limit: 10, Remaining: 10}); got != want {
+		t.Errorf("bucket: expected %+v, got %+v", want, got)
+	}
+
+	// keys
+	recorder = do(http.MethodGet, "/keys?prefix=user:", "", "secret")
+	var keys keysResponse
+	if err := json.NewDecoder(recorder.Body).Decode(&keys); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(keys.Buckets), 1; got != want {
+		t.Fatalf("keys: expected %d, got %d", want, got)
+	}
+	if got, want := *keys.Buckets[0], (Bucket{Key: "user:a", Limit: 10, Remaining: 10, Interval: "1m0s"}); got != want {
+		t.Errorf("bucket: expected %+v, got %+v", want, got)
+	}
+
+	// delete
+	if got, want := do(http.MethodDelete, "/bucket?key=user:a", "", "secret").Code, http.StatusNoContent; got != want {
+		t.Errorf("status: expected %d, got %d", want, got)
+	}
+	if got, want := bucket(do(http.MethodGet, "/bucket?key=user:a", "", "secret")), (Bucket{Key: "user:a"}); got != want {
+		t.Errorf("bucket: expected %+v, got %+v", want, got)
+	}
+}
@@ -0,0 +1,248 @@
+package go_rate_limiter
+
+import (
+	"container/heap"
+	"context"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// denialShards is the number of independently locked parts of DenialCache
+const denialShards = 32
+
+// DenialCache is rlstorage.Storage caching the denials of the wrapped storage until their
+// reset time, so takes of keys over their limit are answered without a backend call.
+// Reset times are compared with the local clock, so the backend clock should be in sync with it.
+// Set, Burst, Reset and Delete drop the cached denial of the key. TakeMany is not supported.
+type DenialCache struct {
+	// size is the number of cached denials of all shards. It is accessed atomically,
+	// so it is first to be 64-bit aligned.
+	size int64
+
+	rlstorage.Storage
+
+	maxKeys int
+	metrics *Metrics
+	name    string
+
+	// shards split the denials by key hash, so takes of different keys rarely share a lock
+	shards [denialShards]denialShard
+
+	// now returns current unix time in nanoseconds, it is replaced by tests
+	now func() uint64
+}
+
+// denialShard is the denials of a part of keys ordered by their reset time,
+// so expired ones are dropped without scanning the others
+type denialShard struct {
+	lock    sync.Mutex
+	denials map[string]*denial
+	expiry  denialHeap
+}
+
+// denial is a cached take result of a key without tokens
+type denial struct {
+	key   string
+	limit uint64
+	reset uint64
+	// index is the position of the denial in the expiry heap of its shard
+	index int
+}
+
+// denialHeap is a min-heap of denials by reset time
+type denialHeap []*denial
+
+func (h denialHeap) Len() int           { return len(h) }
+func (h denialHeap) Less(i, j int) bool { return h[i].reset < h[j].reset }
+
+func (h denialHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *denialHeap) Push(x interface{}) {
+	d := x.(*denial)
+	d.index = len(*h)
+	*h = append(*h, d)
+}
+
+func (h *denialHeap) Pop() interface{} {
+	old := *h
+	d := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return d
+}
+
+// DenialCacheConfig is used to NewDenialCache. It setups the DenialCache
+type DenialCacheConfig struct {
+	// MaxKeys is the maximum number of cached denials. When it is reached, the expired
+	// denials sharing a lock with the new one are dropped, the new one is not cached if there
+	// are none. Default is 65536.
+	MaxKeys int
+	// Metrics counts cache hits and misses with the storage label Name.
+	Metrics *Metrics
+	// Name is the storage label of the metrics. Default is "denial_cache".
+	Name string
+}
+
+func NewDenialCache(s rlstorage.Storage, cfg *DenialCacheConfig) (*DenialCache, error) {
+	if s == nil {
+		return nil, ErrNilStorage
+	}
+	if cfg == nil {
+		cfg = new(DenialCacheConfig)
+	}
+
+	maxKeys := 65536
+	if cfg.MaxKeys > 0 {
+		maxKeys = cfg.MaxKeys
+	}
+
+	name := "denial_cache"
+	if cfg.Name != "" {
+		name = cfg.Name
+	}
+
+	dc := &DenialCache{
+		Storage: s,
+		maxKeys: maxKeys,
+		metrics: cfg.Metrics,
+		name:    name,
+		now:     func() uint64 { return uint64(time.Now().UnixNano()) },
+	}
+	for i := range dc.shards {
+		dc.shards[i].denials = make(map[string]*denial)
+	}
+	return dc, nil
+}
+
+// Len returns the number of cached denials including expired ones not dropped yet
+func (dc *DenialCache) Len() int {
+	return int(atomic.LoadInt64(&dc.size))
+}
+
+// shard returns the shard of key by its fnv-1a hash
+func (dc *DenialCache) shard(key string) *denialShard {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return &dc.shards[hash%denialShards]
+}
+
+// remove drops d from shard s. s.lock should be held.
+func (dc *DenialCache) remove(s *denialShard, d *denial) {
+	heap.Remove(&s.expiry, d.index)
+	delete(s.denials, d.key)
+	atomic.AddInt64(&dc.size, -1)
+}
+
+// expire drops the expired denials of shard s and returns their number. s.lock should be held.
+func (dc *DenialCache) expire(s *denialShard, now uint64) int {
+	expired := 0
+	for len(s.expiry) > 0 && now >= s.expiry[0].reset {
+		dc.remove(s, s.expiry[0])
+		expired++
+	}
+	return expired
+}
+
+// Take answers with the cached denial of key until its reset time, otherwise it takes
+// from the wrapped storage and caches the denial.
+func (dc *DenialCache) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	now := dc.now()
+	s := dc.shard(key)
+
+	s.lock.Lock()
+	var limit, reset uint64
+	d, ok := s.denials[key]
+	if ok && now >= d.reset {
+		dc.remove(s, d)
+		ok = false
+	} else if ok {
+		limit, reset = d.limit, d.reset
+	}
+	s.lock.Unlock()
+
+	if ok {
+		dc.observe(true)
+		return limit, 0, reset, false, nil
+	}
+	dc.observe(false)
+
+	limit, remaining, reset, allowed, err := dc.Storage.Take(ctx, key)
+	if err == nil && !allowed && remaining == 0 && reset > now {
+		dc.cache(key, limit, reset, now)
+	}
+	return limit, remaining, reset, allowed, err
+}
+
+// cache stores the denial of key. Expired denials of its shard are dropped if the cache is full.
+func (dc *DenialCache) cache(key string, limit, reset, now uint64) {
+	s := dc.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if d, ok := s.denials[key]; ok {
+		d.limit, d.reset = limit, reset
+		heap.Fix(&s.expiry, d.index)
+		return
+	}
+
+	// the slot is reserved first, so concurrent shards do not exceed maxKeys together
+	if atomic.AddInt64(&dc.size, 1) > int64(dc.maxKeys) && dc.expire(s, now) == 0 {
+		atomic.AddInt64(&dc.size, -1)
+		return
+	}
+
+	d := &denial{key: key, limit: limit, reset: reset}
+	s.denials[key] = d
+	heap.Push(&s.expiry, d)
+}
+
+func (dc *DenialCache) observe(hit bool) {
+	if dc.metrics == nil {
+		return
+	}
+
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	dc.metrics.add(metricDenialCache, labels(labelStorage, dc.name, labelResult, result), 1)
+}
+
+// drop forgets the cached denial of key
+func (dc *DenialCache) drop(key string) {
+	s := dc.shard(key)
+	s.lock.Lock()
+	if d, ok := s.denials[key]; ok {
+		dc.remove(s, d)
+	}
+	s.lock.Unlock()
+}
+
+func (dc *DenialCache) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	dc.drop(key)
+	return dc.Storage.Set(ctx, key, tokens, interval)
+}
+
+func (dc *DenialCache) Burst(ctx context.Context, key string, tokens uint64) error {
+	dc.drop(key)
+	return dc.Storage.Burst(ctx, key, tokens)
+}
+
+func (dc *DenialCache) Reset(ctx context.Context, key string) error {
+	dc.drop(key)
+	return dc.Storage.Reset(ctx, key)
+}
+
+func (dc *DenialCache) Delete(ctx context.Context, key string) error {
+	dc.drop(key)
+	return dc.Storage.Delete(ctx, key)
+}
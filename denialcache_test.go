@@ -0,0 +1,182 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
+)
+
+// countingStorage counts the takes reaching the storage
+type countingStorage struct {
+	rlstorage.Storage
+	takes uint64
+}
+
+func (s *countingStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	atomic.AddUint64(&s.takes, 1)
+	return s.Storage.Take(ctx, key)
+}
+
+func TestDenialCache(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	if _, err := NewDenialCache(nil, nil); err != ErrNilStorage {
+		t.Errorf("nil storage: expected %v, got %v", ErrNilStorage, err)
+	}
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{Tokens: 2, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	counting := &countingStorage{Storage: storage}
+	metrics := NewMetrics()
+	cache, err := NewDenialCache(counting, &DenialCacheConfig{Metrics: metrics, MaxKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := cache.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	take := func(key string) (uint64, bool) {
+		t.Helper()
+
+		_, remaining, _, ok, err := cache.Take(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return remaining, ok
+	}
+
+	for i := 0; i < 5; i++ {
+		take("key")
+	}
+	if got, want := atomic.LoadUint64(&counting.takes), uint64(3); got != want {
+		t.Errorf("storage takes: expected %d, got %d", want, got)
+	}
+	if _, ok := take("key"); ok {
+		t.Errorf("cached denial is allowed")
+	}
+
+	// burst drops the cached denial
+	if err := cache.Burst(ctx, "key", 1); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := take("key"); !ok {
+		t.Errorf("take after burst is denied")
+	}
+
+	// denials expire at the reset time
+	take("key")
+	if got, want := cache.Len(), 1; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+	now := uint64(time.Now().Add(2 * time.Hour).UnixNano())
+	cache.now = func() uint64 { return now }
+	before := atomic.LoadUint64(&counting.takes)
+	take("key")
+	if got, want := atomic.LoadUint64(&counting.takes), before+1; got != want {
+		t.Errorf("expired denial: expected %d storage takes, got %d", want, got)
+	}
+	if got, want := cache.Len(), 0; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+
+	var b strings.Builder
+	if err := metrics.Expose(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`ratelimiter_denial_cache_requests_total{storage="denial_cache",result="hit"} 3`,
+		`ratelimiter_denial_cache_requests_total{storage="denial_cache",result="miss"} 6`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestDenialCache_MaxKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{Tokens: 1, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewDenialCache(storage, &DenialCacheConfig{MaxKeys: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := cache.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	for _, key := range []string{"a", "b", "c"} {
+		for i := 0; i < 2; i++ {
+			if _, _, _, _, err := cache.Take(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if got, want := cache.Len(), 2; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+}
+
+func TestDenialCache_Expired(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{Tokens: 1, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewDenialCache(storage, &DenialCacheConfig{MaxKeys: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := cache.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	// the expired denial of a key of the same shard is dropped for the new one
+	other := ""
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("key-%d", i); cache.shard(key) == cache.shard("key") && key != "key" {
+			other = key
+		}
+	}
+	for i := 0; i < 2; i++ {
+		cache.Take(ctx, "key")
+	}
+	now := uint64(time.Now().Add(2 * time.Hour).UnixNano())
+	cache.now = func() uint64 { return now }
+	if err := storage.Set(ctx, other, 1, 3*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		cache.Take(ctx, other)
+	}
+
+	if got, want := cache.Len(), 1; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+	s := cache.shard(other)
+	if _, ok := s.denials[other]; !ok {
+		t.Errorf("denial of %s is not cached", other)
+	}
+}
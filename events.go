@@ -0,0 +1,84 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Event is a record of a single LimiterMiddleware decision.
+type Event struct {
+	Time      time.Time `json:"time"`
+	Key       string    `json:"key"`
+	Policy    string    `json:"policy"`
+	Cost      uint64    `json:"cost"`
+	Limit     uint64    `json:"limit"`
+	Remaining uint64    `json:"remaining"`
+	Reset     time.Time `json:"reset"`
+	// Outcome is one of OutcomeAllowed, OutcomeLimited or OutcomeError.
+	Outcome string `json:"outcome"`
+	Path    string `json:"path"`
+	Method  string `json:"method"`
+	// Error is the reason of OutcomeError.
+	Error string `json:"error,omitempty"`
+}
+
+// EventSink receives decision events of LimiterMiddleware.
+// Record is called on each request, so it should not block for long.
+type EventSink interface {
+	Record(ctx context.Context, event *Event)
+}
+
+// JSONLinesSink writes every event as a single JSON line.
+type JSONLinesSink struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func NewJSONLinesSink(w io.Writer) *JSONLinesSink {
+	return &JSONLinesSink{encoder: json.NewEncoder(w)}
+}
+
+// Record writes the event. Write errors are ignored: losing a log line should not fail requests.
+func (s *JSONLinesSink) Record(_ context.Context, event *Event) {
+	s.lock.Lock()
+	_ = s.encoder.Encode(event)
+	s.lock.Unlock()
+}
+
+// SampledSink passes only a share of allowed events to the wrapped sink.
+// Rejections and errors are always passed.
+type SampledSink struct {
+	sink EventSink
+	rate float64
+
+	lock   sync.Mutex
+	random *rand.Rand
+}
+
+// NewSampledSink returns sink that passes allowed events with probability rate (0 to 1).
+func NewSampledSink(sink EventSink, rate float64) *SampledSink {
+	return &SampledSink{
+		sink:   sink,
+		rate:   rate,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (s *SampledSink) Record(ctx context.Context, event *Event) {
+	if event.Outcome == OutcomeAllowed {
+		// rand.Rand is not safe for concurrent use
+		s.lock.Lock()
+		skip := s.random.Float64() >= s.rate
+		s.lock.Unlock()
+
+		if skip {
+			return
+		}
+	}
+
+	s.sink.Record(ctx, event)
+}
@@ -0,0 +1,50 @@
+//go:build go1.21
+// +build go1.21
+
+package go_rate_limiter
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogSink logs every event with slog. Rejections are logged with warn level, errors with error level.
+// It is built with Go 1.21 and newer only, as log/slog is not available before.
+type SlogSink struct {
+	logger *slog.Logger
+}
+
+func NewSlogSink(logger *slog.Logger) *SlogSink {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogSink{logger: logger}
+}
+
+func (s *SlogSink) Record(ctx context.Context, event *Event) {
+	level := slog.LevelInfo
+	switch event.Outcome {
+	case OutcomeLimited:
+		level = slog.LevelWarn
+	case OutcomeError:
+		level = slog.LevelError
+	}
+
+	attrs := []slog.Attr{
+		slog.Time("time", event.Time),
+		slog.String("key", event.Key),
+		slog.String("policy", event.Policy),
+		slog.Uint64("cost", event.Cost),
+		slog.Uint64("limit", event.Limit),
+		slog.Uint64("remaining", event.Remaining),
+		slog.Time("reset", event.Reset),
+		slog.String("outcome", event.Outcome),
+		slog.String("path", event.Path),
+		slog.String("method", event.Method),
+	}
+	if event.Error != "" {
+		attrs = append(attrs, slog.String("error", event.Error))
+	}
+
+	s.logger.LogAttrs(ctx, level, "rate limit decision", attrs...)
+}
@@ -0,0 +1,27 @@
+//go:build go1.21
+// +build go1.21
+
+package go_rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlogSink(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	sink := NewSlogSink(slog.New(slog.NewJSONHandler(&buf, nil)))
+	sink.Record(context.Background(), &Event{Key: "key", Outcome: OutcomeLimited})
+
+	output := buf.String()
+	for _, part := range []string{`"level":"WARN"`, `"key":"key"`, `"outcome":"limited"`} {
+		if !strings.Contains(output, part) {
+			t.Errorf("expected %s in %s", part, output)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package go_rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"pkg/memstorage"
+)
+
+func TestLimiterMiddleware_Events(t *testing.T) {
+	t.Parallel()
+
+	type case_ struct {
+		name     string
+		rate     float64
+		outcomes []string
+	}
+
+	cases := []case_{
+		{
+			name:     "all",
+			rate:     1,
+			outcomes: []string{OutcomeAllowed, OutcomeLimited, OutcomeError},
+		},
+		{
+			name:     "rejections only",
+			rate:     0,
+			outcomes: []string{OutcomeLimited, OutcomeError},
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+
+			storage, err := memstorage.NewMemStorage(&memstorage.Config{
+				Tokens:   1,
+				Interval: 1 * time.Hour,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := storage.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			var buf bytes.Buffer
+			middleware, err := NewLimiterMiddlewareWithConfig(storage, IPKeyFunc(), &MiddlewareConfig{
+				Policy: "api",
+				Events: NewSampledSink(NewJSONLinesSink(&buf), c.rate),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			handler := middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+			for i := 0; i < 2; i++ {
+				handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/path", nil))
+			}
+			request := httptest.NewRequest(http.MethodGet, "/", nil)
+			request.RemoteAddr = ""
+			handler.ServeHTTP(httptest.NewRecorder(), request)
+
+			decoder := json.NewDecoder(&buf)
+			for _, outcome := range c.outcomes {
+				var event Event
+				if err := decoder.Decode(&event); err != nil {
+					t.Fatal(err)
+				}
+				if got, want := event.Outcome, outcome; got != want {
+					t.Errorf("outcome: expected %q, got %q", want, got)
+				}
+				if got, want := event.Policy, "api"; got != want {
+					t.Errorf("policy: expected %q, got %q", want, got)
+				}
+				if event.Time.IsZero() {
+					t.Errorf("expected time")
+				}
+
+				switch outcome {
+				case OutcomeError:
+					if event.Error == "" {
+						t.Errorf("expected error")
+					}
+				default:
+					if got, want := event.Key, "192.0.2.1"; got != want {
+						t.Errorf("key: expected %q, got %q", want, got)
+					}
+					if got, want := event.Method+" "+event.Path, "POST /path"; got != want {
+						t.Errorf("request: expected %q, got %q", want, got)
+					}
+					if got, want := event.Limit, uint64(1); got != want {
+						t.Errorf("limit: expected %d, got %d", want, got)
+					}
+					if event.Reset.IsZero() {
+						t.Errorf("expected reset")
+					}
+				}
+			}
+			if decoder.More() {
+				t.Errorf("unexpected events left: %s", buf.String())
+			}
+		})
+	}
+}
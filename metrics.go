@@ -0,0 +1,462 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	rlstorage "pkg/rl-storage"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OutcomeAllowed = "allowed"
+	OutcomeLimited = "limited"
+	OutcomeError   = "error"
+)
+
+const (
+	metricDecisions     = "ratelimiter_decisions_total"
+	metricTakeDuration  = "ratelimiter_storage_take_duration_seconds"
+	metricStorageErrors = "ratelimiter_storage_errors_total"
+	metricStorageKeys   = "ratelimiter_storage_keys"
+	metricPurgeDuration = "ratelimiter_memstorage_purge_duration_seconds"
+	metricPurgeEvicted  = "ratelimiter_memstorage_purge_evicted_total"
+	metricFailovers     = "ratelimiter_redis_failovers_total"
+	metricEvicted       = "ratelimiter_memstorage_evicted_total"
+	metricOverflow      = "ratelimiter_memstorage_overflow_total"
+	metricDenialCache   = "ratelimiter_denial_cache_requests_total"
+	metricGossipLag     = "ratelimiter_gossip_lag_seconds"
+
+	metricKindCounter   = "counter"
+	metricKindGauge     = "gauge"
+	metricKindHistogram = "histogram"
+
+	labelPolicy  = "policy"
+	labelOutcome = "outcome"
+	labelStorage = "storage"
+	labelMethod  = "method"
+	labelBucket  = "le"
+	labelMaster  = "master"
+	labelResult  = "result"
+	labelPeer    = "peer"
+
+	// exposition is the content type of Prometheus text format
+	exposition = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+// LatencyBuckets are the upper bounds (in seconds) of the latency histograms.
+var LatencyBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// Metrics collects limiter and storage metrics and exposes them in Prometheus text format.
+// It does not depend on the Prometheus client library: Handler() could be scraped directly.
+// Values are updated atomically, locks are taken for writing only to add new series.
+type Metrics struct {
+	lock     sync.RWMutex
+	families map[string]*family
+}
+
+func NewMetrics() *Metrics {
+	m := &Metrics{families: make(map[string]*family)}
+
+	m.register(metricDecisions, metricKindCounter, "Number of rate limiting decisions by policy and outcome.")
+	m.register(metricTakeDuration, metricKindHistogram, "Latency of Storage.Take calls.")
+	m.register(metricStorageErrors, metricKindCounter, "Number of failed storage calls.")
+	m.register(metricStorageKeys, metricKindGauge, "Number of keys held by the storage.")
+	m.register(metricPurgeDuration, metricKindHistogram, "Duration of MemStorage purge sweeps.")
+	m.register(metricPurgeEvicted, metricKindCounter, "Number of buckets evicted by MemStorage purge sweeps.")
+	m.register(metricFailovers, metricKindCounter, "Number of Redis master changes by the new master.")
+	m.register(metricEvicted, metricKindCounter, "Number of buckets evicted to keep MemStorage within MaxKeys.")
+	m.register(metricDenialCache, metricKindCounter, "Number of takes answered by the denial cache (hit) or by the storage (miss).")
+	m.register(metricOverflow, metricKindCounter, "Number of new keys denied or limited by the shared bucket because of MaxKeys.")
+	m.register(metricGossipLag, metricKindHistogram, "Age of the counts received from gossip peers.")
+	return m
+}
+
+// family is a named group of series sharing help and kind
+type family struct {
+	name string
+	help string
+	kind string
+
+	// lock guards series, the values of a series are accessed atomically
+	lock   sync.RWMutex
+	series map[string]*series
+}
+
+// series is a single labeled value of the family
+type series struct {
+	// value is float64 bits of counters, sum is float64 bits of histograms.
+	// They are first to be aligned for atomic access on 32-bit platforms.
+	value uint64
+	sum   uint64
+	count uint64
+	// buckets are used by histograms
+	buckets []uint64
+	// gauge is used by gauges, its called on each exposition
+	gauge func() float64
+
+	labels string
+}
+
+func (m *Metrics) register(name, kind, help string) *family {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	f, ok := m.families[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind, series: make(map[string]*series)}
+		m.families[name] = f
+	}
+	return f
+}
+
+// get returns series of the family by labels creating it if needed
+func (m *Metrics) get(name, labels string) *series {
+	m.lock.RLock()
+	f := m.families[name]
+	m.lock.RUnlock()
+
+	f.lock.RLock()
+	s, ok := f.series[labels]
+	f.lock.RUnlock()
+	if ok {
+		return s
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if s, ok := f.series[labels]; ok {
+		return s
+	}
+	s = &series{labels: labels}
+	if f.kind == metricKindHistogram {
+		s.buckets = make([]uint64, len(LatencyBuckets))
+	}
+	f.series[labels] = s
+	return s
+}
+
+// addFloat atomically adds delta to float64 bits stored at addr
+func addFloat(addr *uint64, delta float64) {
+	for {
+		old := atomic.LoadUint64(addr)
+		if atomic.CompareAndSwapUint64(addr, old, math.Float64bits(math.Float64frombits(old)+delta)) {
+			return
+		}
+	}
+}
+
+func (m *Metrics) add(name, labels string, delta float64) {
+	addFloat(&m.get(name, labels).value, delta)
+}
+
+func (m *Metrics) observe(name, labels string, value float64) {
+	s := m.get(name, labels)
+	for i, bound := range LatencyBuckets {
+		if value <= bound {
+			atomic.AddUint64(&s.buckets[i], 1)
+		}
+	}
+	addFloat(&s.sum, value)
+	atomic.AddUint64(&s.count, 1)
+}
+
+// setGauge makes series of the family by labels a gauge computed by f
+func (m *Metrics) setGauge(name, labels string, f func() float64) {
+	s := m.get(name, labels)
+
+	m.lock.RLock()
+	family := m.families[name]
+	m.lock.RUnlock()
+
+	family.lock.Lock()
+	s.gauge = f
+	family.lock.Unlock()
+}
+
+// RegisterGauge adds gauge which value is computed by f on each exposition.
+// Use it to expose custom values (like MemStorage.Len) that are not covered by InstrumentStorage.
+func (m *Metrics) RegisterGauge(name, help string, f func() float64) {
+	m.register(name, metricKindGauge, help)
+	m.setGauge(name, "", f)
+}
+
+// ObserveDecision counts a single decision of the policy.
+func (m *Metrics) ObserveDecision(policy, outcome string) {
+	m.add(metricDecisions, labels(labelPolicy, policy, labelOutcome, outcome), 1)
+}
+
+// ObservePurge records a single purge sweep. Its signature matches memstorage.Config.PurgeHook.
+func (m *Metrics) ObservePurge(elapsed time.Duration, evicted int) {
+	m.observe(metricPurgeDuration, "", elapsed.Seconds())
+	m.add(metricPurgeEvicted, "", float64(evicted))
+}
+
+// ObserveFailover counts a single Redis master change. Its signature matches
+// redisstorage.SentinelConfig.OnFailover.
+func (m *Metrics) ObserveFailover(from, to string) {
+	m.add(metricFailovers, labels(labelMaster, to), 1)
+}
+
+// ObserveEviction counts a single bucket evicted because of MaxKeys. Its signature matches
+// memstorage.Config.OnEvict.
+func (m *Metrics) ObserveEviction(key string) {
+	m.add(metricEvicted, "", 1)
+}
+
+// ObserveOverflow counts a single new key rejected because of MaxKeys. Its signature matches
+// memstorage.Config.OnOverflow.
+func (m *Metrics) ObserveOverflow(key string) {
+	m.add(metricOverflow, "", 1)
+}
+
+// ObserveGossip records the age of a single message received from a gossip peer. Its signature
+// matches gossipstorage.Config.OnReceive.
+func (m *Metrics) ObserveGossip(peer string, lag time.Duration) {
+	m.observe(metricGossipLag, labels(labelPeer, peer), lag.Seconds())
+}
+
+// InstrumentStorage wraps s so its Take latency and errors are recorded with the storage label name.
+// If s reports the number of its keys with Len() int, it is exposed as a gauge.
+// The wrapper implements rlstorage.DecisionStorage and rlstorage.Scanner over the ones of s,
+// Scan fails with rlstorage.ErrNotSupported if s is not a Scanner.
+// If s implements rlstorage.BatchStorage, so does the wrapper.
+func (m *Metrics) InstrumentStorage(name string, s rlstorage.Storage) rlstorage.Storage {
+	if lener, ok := s.(interface{ Len() int }); ok {
+		m.setGauge(metricStorageKeys, labels(labelStorage, name), func() float64 {
+			return float64(lener.Len())
+		})
+	}
+
+	instrumented := &instrumentedStorage{Storage: s, decisions: rlstorage.AsDecisionStorage(s), metrics: m, name: name}
+	instrumented.scanner, _ = s.(rlstorage.Scanner)
+	if batch, ok := s.(rlstorage.BatchStorage); ok {
+		return &instrumentedBatchStorage{instrumentedStorage: instrumented, batch: batch}
+	}
+	return instrumented
+}
+
+// Handler returns http.Handler writing all metrics in Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", exposition)
+		if err := m.Expose(w); err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}
+	})
+}
+
+// sample is a snapshot of a series taken by Expose
+type sample struct {
+	labels  string
+	value   float64
+	gauge   func() float64
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// snapshot returns the samples of the family sorted by labels
+func (f *family) snapshot() []sample {
+	f.lock.RLock()
+	samples := make([]sample, 0, len(f.series))
+	for _, s := range f.series {
+		sample := sample{
+			labels: s.labels,
+			value:  math.Float64frombits(atomic.LoadUint64(&s.value)),
+			gauge:  s.gauge,
+			sum:    math.Float64frombits(atomic.LoadUint64(&s.sum)),
+			count:  atomic.LoadUint64(&s.count),
+		}
+		if s.buckets != nil {
+			sample.buckets = make([]uint64, len(s.buckets))
+			for i := range s.buckets {
+				sample.buckets[i] = atomic.LoadUint64(&s.buckets[i])
+			}
+		}
+		samples = append(samples, sample)
+	}
+	f.lock.RUnlock()
+
+	sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+	return samples
+}
+
+// Expose writes all metrics in Prometheus text format. Series are copied first,
+// so gauges are computed without holding the locks of Metrics.
+func (m *Metrics) Expose(w io.Writer) error {
+	m.lock.RLock()
+	families := make([]*family, 0, len(m.families))
+	for _, f := range m.families {
+		families = append(families, f)
+	}
+	m.lock.RUnlock()
+	sort.Slice(families, func(i, j int) bool { return families[i].name < families[j].name })
+
+	var b strings.Builder
+	for _, f := range families {
+		samples := f.snapshot()
+		if len(samples) == 0 {
+			continue
+		}
+
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+
+		for _, s := range samples {
+			switch f.kind {
+			case metricKindHistogram:
+				for i, bound := range LatencyBuckets {
+					fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, labelBucket, formatFloat(bound)), s.buckets[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket%s %d\n", f.name, withLabel(s.labels, labelBucket, "+Inf"), s.count)
+				fmt.Fprintf(&b, "%s_sum%s %s\n", f.name, s.labels, formatFloat(s.sum))
+				fmt.Fprintf(&b, "%s_count%s %d\n", f.name, s.labels, s.count)
+			case metricKindGauge:
+				value := s.value
+				if s.gauge != nil {
+					value = s.gauge()
+				}
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, s.labels, formatFloat(value))
+			default:
+				fmt.Fprintf(&b, "%s%s %s\n", f.name, s.labels, formatFloat(s.value))
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// labels formats label pairs (name, value, name, value...) as {name="value",...}
+func labels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(pairs[i])
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(pairs[i+1]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// withLabel appends a single label to already formatted labels
+func withLabel(formatted, name, value string) string {
+	if formatted == "" {
+		return labels(name, value)
+	}
+	return formatted[:len(formatted)-1] + "," + name + `="` + escapeLabel(value) + `"}`
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// instrumentedStorage records Take latency and errors of the wrapped storage
+type instrumentedStorage struct {
+	rlstorage.Storage
+	decisions rlstorage.DecisionStorage
+	scanner   rlstorage.Scanner
+	metrics   *Metrics
+	name      string
+}
+
+func (s *instrumentedStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	start := time.Now()
+	limit, remaining, reset, ok, err := s.Storage.Take(ctx, key)
+	s.metrics.observe(metricTakeDuration, labels(labelStorage, s.name), time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "take"), 1)
+	}
+	return limit, remaining, reset, ok, err
+}
+
+func (s *instrumentedStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	limit, remaining, err := s.Storage.Get(ctx, key)
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "get"), 1)
+	}
+	return limit, remaining, err
+}
+
+func (s *instrumentedStorage) TakeDecision(ctx context.Context, key string) (*rlstorage.Decision, error) {
+	start := time.Now()
+	decision, err := s.decisions.TakeDecision(ctx, key)
+	s.metrics.observe(metricTakeDuration, labels(labelStorage, s.name), time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "take"), 1)
+	}
+	return decision, err
+}
+
+func (s *instrumentedStorage) GetDecision(ctx context.Context, key string) (*rlstorage.Decision, error) {
+	decision, err := s.decisions.GetDecision(ctx, key)
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "get"), 1)
+	}
+	return decision, err
+}
+
+func (s *instrumentedStorage) Scan(ctx context.Context, prefix string, f func(state rlstorage.KeyState) bool) error {
+	if s.scanner == nil {
+		return rlstorage.ErrNotSupported
+	}
+
+	err := s.scanner.Scan(ctx, prefix, f)
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "scan"), 1)
+	}
+	return err
+}
+
+func (s *instrumentedStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	err := s.Storage.Set(ctx, key, tokens, interval)
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "set"), 1)
+	}
+	return err
+}
+
+func (s *instrumentedStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	err := s.Storage.Burst(ctx, key, tokens)
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "burst"), 1)
+	}
+	return err
+}
+
+// instrumentedBatchStorage is instrumentedStorage of rlstorage.BatchStorage.
+// TakeMany latency is recorded as Take one.
+type instrumentedBatchStorage struct {
+	*instrumentedStorage
+	batch rlstorage.BatchStorage
+}
+
+func (s *instrumentedBatchStorage) TakeMany(ctx context.Context, reqs []rlstorage.TakeRequest) ([]*rlstorage.Decision, error) {
+	start := time.Now()
+	decisions, err := s.batch.TakeMany(ctx, reqs)
+	s.metrics.observe(metricTakeDuration, labels(labelStorage, s.name), time.Since(start).Seconds())
+	if err != nil {
+		s.metrics.add(metricStorageErrors, labels(labelStorage, s.name, labelMethod, "take_many"), 1)
+	}
+	return decisions, err
+}
@@ -0,0 +1,268 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
+)
+
+func TestMetrics_Middleware(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	metrics := NewMetrics()
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{
+		Tokens:        2,
+		Interval:      1 * time.Hour,
+		SweepInterval: 10 * time.Millisecond,
+		SweepMinTTL:   1 * time.Hour,
+		PurgeHook:     metrics.ObservePurge,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	middleware, err := NewLimiterMiddlewareWithConfig(metrics.InstrumentStorage("memory", storage), IPKeyFunc(), &MiddlewareConfig{
+		Policy:  "api",
+		Metrics: metrics,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 3; i++ {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		handler.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// no remote address -- key function fails
+	request := httptest.NewRequest(http.MethodGet, "/", nil)
+	request.RemoteAddr = ""
+	handler.ServeHTTP(httptest.NewRecorder(), request)
+
+	// let purge run at least once
+	time.Sleep(50 * time.Millisecond)
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if got, want := recorder.Header().Get("Content-Type"), exposition; got != want {
+		t.Errorf("content type: expected %q, got %q", want, got)
+	}
+
+	body := recorder.Body.String()
+	for _, line := range []string{
+		`# TYPE ratelimiter_decisions_total counter`,
+		`ratelimiter_decisions_total{policy="api",outcome="allowed"} 2`,
+		`ratelimiter_decisions_total{policy="api",outcome="limited"} 1`,
+		`ratelimiter_decisions_total{policy="api",outcome="error"} 1`,
+		`ratelimiter_storage_take_duration_seconds_count{storage="memory"} 3`,
+		`ratelimiter_storage_take_duration_seconds_bucket{storage="memory",le="+Inf"} 3`,
+		`ratelimiter_storage_keys{storage="memory"} 1`,
+		`ratelimiter_memstorage_purge_evicted_total 0`,
+		`# TYPE ratelimiter_memstorage_purge_duration_seconds histogram`,
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, body)
+		}
+	}
+}
+
+func TestMetrics_labels(t *testing.T) {
+	t.Parallel()
+
+	if got, want := labels("a", `x"y\z`), `{a="x\"y\\z"}`; got != want {
+		t.Errorf("labels: expected %s, got %s", want, got)
+	}
+	if got, want := withLabel(labels("a", "b"), "le", "1"), `{a="b",le="1"}`; got != want {
+		t.Errorf("withLabel: expected %s, got %s", want, got)
+	}
+	if got, want := withLabel("", "le", "1"), `{le="1"}`; got != want {
+		t.Errorf("withLabel: expected %s, got %s", want, got)
+	}
+}
+
+func TestMetrics_MaxKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	metrics := NewMetrics()
+	for _, overflow := range []memstorage.OverflowPolicy{memstorage.OverflowEvict, memstorage.OverflowDeny} {
+		storage, err := memstorage.NewMemStorage(&memstorage.Config{
+			Shards:     1,
+			MaxKeys:    1,
+			Overflow:   overflow,
+			OnEvict:    metrics.ObserveEviction,
+			OnOverflow: metrics.ObserveOverflow,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, key := range []string{"first", "second"} {
+			if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b strings.Builder
+	if err := metrics.Expose(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`ratelimiter_memstorage_evicted_total 1`,
+		`ratelimiter_memstorage_overflow_total 1`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetrics_ObserveGossip(t *testing.T) {
+	t.Parallel()
+
+	metrics := NewMetrics()
+	metrics.ObserveGossip("10.0.0.1:7946", 2*time.Millisecond)
+	metrics.ObserveGossip("10.0.0.1:7946", 20*time.Millisecond)
+
+	var b strings.Builder
+	if err := metrics.Expose(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`# TYPE ratelimiter_gossip_lag_seconds histogram`,
+		`ratelimiter_gossip_lag_seconds_bucket{peer="10.0.0.1:7946",le="0.005"} 1`,
+		`ratelimiter_gossip_lag_seconds_count{peer="10.0.0.1:7946"} 2`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetrics_Concurrent(t *testing.T) {
+	t.Parallel()
+
+	metrics := NewMetrics()
+	// the gauge could call the metrics as it is computed without their locks
+	metrics.RegisterGauge("test_gauge", "Test gauge.", func() float64 {
+		metrics.ObserveDecision("gauge", OutcomeAllowed)
+		return 1
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				metrics.ObserveDecision("test", OutcomeAllowed)
+				metrics.ObservePurge(time.Millisecond, 1)
+				if j%100 == 0 {
+					if err := metrics.Expose(ioutil.Discard); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var b strings.Builder
+	if err := metrics.Expose(&b); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		`ratelimiter_decisions_total{policy="test",outcome="allowed"} 8000`,
+		`ratelimiter_memstorage_purge_duration_seconds_count 8000`,
+		`ratelimiter_memstorage_purge_evicted_total 8000`,
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Errorf("expected %q in:\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetrics_InstrumentStorageInterfaces(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{Tokens: 2, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	metrics := NewMetrics()
+	instrumented := metrics.InstrumentStorage("memory", storage)
+
+	decisions, ok := instrumented.(rlstorage.DecisionStorage)
+	if !ok {
+		t.Fatal("expected rlstorage.DecisionStorage")
+	}
+	decision, err := decisions.TakeDecision(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allowed || decision.ResetAt.IsZero() {
+		t.Errorf("expected allowed decision with reset time, got %+v", decision)
+	}
+
+	scanner, ok := instrumented.(rlstorage.Scanner)
+	if !ok {
+		t.Fatal("expected rlstorage.Scanner")
+	}
+	var keys []string
+	if err := scanner.Scan(ctx, "", func(state rlstorage.KeyState) bool {
+		keys = append(keys, state.Key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0] != "key" {
+		t.Errorf("expected [key], got %v", keys)
+	}
+
+	// admin lists the keys of the instrumented storage
+	admin, err := NewAdminHandler(instrumented, &AdminConfig{Authenticate: BearerTokenAuth("secret")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodGet, "/keys", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	admin.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusOK {
+		t.Errorf("keys: expected %d, got %d", http.StatusOK, recorder.Code)
+	}
+
+	var b strings.Builder
+	if err := metrics.Expose(&b); err != nil {
+		t.Fatal(err)
+	}
+	if line := `ratelimiter_storage_take_duration_seconds_count{storage="memory"} 1`; !strings.Contains(b.String(), line+"\n") {
+		t.Errorf("expected %q in:\n%s", line, b.String())
+	}
+}
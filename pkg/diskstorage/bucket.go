@@ -0,0 +1,59 @@
+package diskstorage
+
+import (
+	"time"
+)
+
+// tick returns the total number of times the interval has occurred between start and current
+func tick(start, current uint64, interval time.Duration) uint64 {
+	return (current - start) / uint64(interval)
+}
+
+func availableTokens(lastTick, currentTick, max uint64, fillRate float64) uint64 {
+	delta := currentTick - lastTick
+
+	available := uint64(float64(delta) * fillRate)
+	if available > max {
+		return max
+	}
+	return available
+}
+
+// bucket is the state of a key. It is refilled the same way as the bucket of MemStorage,
+// so both storages limit equally.
+type bucket struct {
+	// startTime is the number of nanoseconds from epoch when the bucket was created.
+	startTime uint64
+	// lastTick is the last clock tick the tokens were refilled at.
+	lastTick uint64
+	// interval is the time at which occurs tick
+	interval time.Duration
+	// maxTokens is the maximum number of tokens available for this bucket at any time.
+	maxTokens uint64
+	// availableTokens is the number of current remaining tokens.
+	availableTokens uint64
+}
+
+func newBucket(now, tokens uint64, interval time.Duration) bucket {
+	return bucket{startTime: now, interval: interval, maxTokens: tokens, availableTokens: tokens}
+}
+
+func (b *bucket) fillRate() float64 {
+	return float64(b.interval) / float64(b.maxTokens)
+}
+
+// refill adds the tokens for the ticks passed since the last refill. Returns the reset time.
+func (b *bucket) refill(now uint64) uint64 {
+	currentTick := tick(b.startTime, now, b.interval)
+	if b.lastTick < currentTick {
+		b.availableTokens = availableTokens(b.lastTick, currentTick, b.maxTokens, b.fillRate())
+		b.lastTick = currentTick
+	}
+	return b.startTime + ((currentTick + 1) * uint64(b.interval))
+}
+
+// expired reports whether the bucket was not refilled for more than ttl nanoseconds
+func (b *bucket) expired(now, ttl uint64) bool {
+	lastTime := b.startTime + (b.lastTick * uint64(b.interval))
+	return now > lastTime && now-lastTime > ttl
+}
@@ -0,0 +1,568 @@
+package diskstorage
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoppedFlag = fmt.Errorf("setting stop flag failed")
+	ErrNoPath      = fmt.Errorf("log path is empty")
+	ErrUnknownSync = fmt.Errorf("unknown sync policy")
+)
+
+// SyncPolicy is when the log is flushed to the disk with fsync
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs the log every SyncInterval. A crash loses the changes of the last interval.
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs the log after every change. It is the slowest and the safest policy.
+	SyncAlways
+	// SyncNever leaves flushing to the operating system. The changes survive a restart
+	// of the process but not a crash of the machine.
+	SyncNever
+)
+
+// DiskStorage keeps buckets in memory and appends every change to a log file, so limits
+// survive restarts. The log is replayed on start and compacted when it has grown larger
+// than the live buckets. Buckets are refilled like the buckets of MemStorage.
+type DiskStorage struct {
+	tokens   uint64
+	interval time.Duration
+
+	path         string
+	sync         SyncPolicy
+	ttl          uint64
+	compactMin   int
+	onSyncError  func(err error)
+	gcInterval   time.Duration
+	syncInterval time.Duration
+
+	// lock guards buckets and the log file
+	lock    sync.Mutex
+	buckets map[string]*bucket
+	file    logFile
+	// records is the number of records in the log, it is compared to len(buckets) to compact
+	records int
+	// size is the length of the valid log, a failed append is truncated back to it
+	size int64
+	// dirty is whether the log has changes not synced yet
+	dirty bool
+	buf   []byte
+
+	// now returns current unix time in nanoseconds, it is replaced by tests
+	now func() uint64
+
+	stopped  uint32
+	stopChan chan struct{}
+	done     sync.WaitGroup
+}
+
+// Config is used to NewDiskStorage. It setups the DiskStorage
+type Config struct {
+	// Path is the log file. It is created if it does not exist. Required.
+	Path string
+	// Tokens is the number of tokens allowed per Interval. Default is 1.
+	Tokens uint64
+	// Interval is the time interval upon which rate limiting is enforced.
+	// Default is 1 second.
+	Interval time.Duration
+	// Sync is the fsync policy of the log. Default is SyncInterval.
+	Sync SyncPolicy
+	// SyncInterval is the rate of fsync with SyncInterval policy. Default is 1 second.
+	SyncInterval time.Duration
+	// OnSyncError is called with the errors of periodic fsync and compaction. Compaction
+	// triggered by a change is called with the storage locked, so it must not use the storage.
+	OnSyncError func(err error)
+	// TTL is the minimum amount of time a bucket must be inactive before it is collected.
+	// It should be longer than the intervals of the buckets, e.g. a day for daily quotas.
+	// Default is 48 hours.
+	TTL time.Duration
+	// GCInterval is the rate at which inactive buckets are collected. Default is 1 hour.
+	GCInterval time.Duration
+	// CompactMinRecords is the minimum number of log records before it is compacted.
+	// The log is compacted when it has twice as many records as live buckets. Default is 4096.
+	CompactMinRecords int
+}
+
+func NewDiskStorage(cfg *Config) (*DiskStorage, error) {
+	if cfg == nil || cfg.Path == "" {
+		return nil, ErrNoPath
+	}
+	if cfg.Sync < SyncInterval || cfg.Sync > SyncNever {
+		return nil, ErrUnknownSync
+	}
+
+	tokens := uint64(1)
+	if cfg.Tokens > 0 {
+		tokens = cfg.Tokens
+	}
+
+	interval := 1 * time.Second
+	if cfg.Interval > 0 {
+		interval = cfg.Interval
+	}
+
+	syncInterval := 1 * time.Second
+	if cfg.SyncInterval > 0 {
+		syncInterval = cfg.SyncInterval
+	}
+
+	ttl := 48 * time.Hour
+	if cfg.TTL > 0 {
+		ttl = cfg.TTL
+	}
+
+	gcInterval := 1 * time.Hour
+	if cfg.GCInterval > 0 {
+		gcInterval = cfg.GCInterval
+	}
+
+	compactMin := 4096
+	if cfg.CompactMinRecords > 0 {
+		compactMin = cfg.CompactMinRecords
+	}
+
+	storage := &DiskStorage{
+		tokens:       tokens,
+		interval:     interval,
+		path:         cfg.Path,
+		sync:         cfg.Sync,
+		ttl:          uint64(ttl),
+		compactMin:   compactMin,
+		onSyncError:  cfg.OnSyncError,
+		gcInterval:   gcInterval,
+		syncInterval: syncInterval,
+		buckets:      make(map[string]*bucket),
+		now:          nanoNow,
+		stopChan:     make(chan struct{}),
+	}
+	if err := storage.open(); err != nil {
+		return nil, err
+	}
+
+	storage.done.Add(1)
+	go storage.background()
+	return storage, nil
+}
+
+func nanoNow() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// open replays the log into buckets and opens it for appending. A torn record at the end
+// of the log, left by a crash during append, is truncated.
+func (storage *DiskStorage) open() error {
+	file, err := os.OpenFile(storage.path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+
+	offset, err := storage.replay(file)
+	if err == nil {
+		err = file.Truncate(offset)
+	}
+	if err == nil {
+		_, err = file.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("opening log %s: %w", storage.path, err)
+	}
+
+	storage.file = file
+	storage.size = offset
+	return nil
+}
+
+// logFile is the log file opened by the storage, *os.File
+type logFile interface {
+	io.WriteCloser
+	io.Seeker
+	Sync() error
+	Truncate(size int64) error
+}
+
+// replay reads the log from file and returns the offset of its valid end
+func (storage *DiskStorage) replay(file *os.File) (int64, error) {
+	r := bufio.NewReader(file)
+
+	h := make([]byte, headerSize)
+	if n, err := io.ReadFull(r, h); err != nil {
+		if n > 0 || err != io.EOF {
+			return 0, ErrLogMagic
+		}
+		// new log
+		if _, err := file.Write(header()); err != nil {
+			return 0, err
+		}
+		return int64(headerSize), nil
+	}
+	if err := checkHeader(h); err != nil {
+		return 0, err
+	}
+
+	offset := int64(headerSize)
+	now := storage.now()
+	for {
+		rec, size, err := readRecord(r)
+		if err != nil {
+			// io.EOF or a torn record, the log is valid up to offset
+			break
+		}
+		offset += int64(size)
+		storage.records++
+
+		if rec.op == opDelete || rec.expired(now, storage.ttl) {
+			delete(storage.buckets, rec.key)
+			continue
+		}
+		b := rec.bucket
+		storage.buckets[rec.key] = &b
+	}
+	return offset, nil
+}
+
+// append writes the record to the log. A record that could not be written (or synced with
+// SyncAlways) is truncated, so the following records are not appended after torn bytes
+// which replay would stop at. storage.lock should be held.
+func (storage *DiskStorage) append(rec *record) error {
+	storage.buf = appendRecord(storage.buf[:0], rec)
+	_, err := storage.file.Write(storage.buf)
+	if err == nil && storage.sync == SyncAlways {
+		err = storage.file.Sync()
+	}
+	if err != nil {
+		if truncErr := storage.truncate(); truncErr != nil {
+			return fmt.Errorf("%v, truncating log: %w", err, truncErr)
+		}
+		return err
+	}
+
+	storage.records++
+	storage.size += int64(len(storage.buf))
+	if storage.sync == SyncInterval {
+		storage.dirty = true
+	}
+	return nil
+}
+
+// truncate cuts the log back to its valid size. storage.lock should be held.
+func (storage *DiskStorage) truncate() error {
+	if err := storage.file.Truncate(storage.size); err != nil {
+		return err
+	}
+	_, err := storage.file.Seek(storage.size, io.SeekStart)
+	return err
+}
+
+// changed compacts the log after a change if it has grown larger than the live buckets.
+// The change is already written, so a failed compaction keeps the current log and is
+// reported to OnSyncError. storage.lock should be held.
+func (storage *DiskStorage) changed() {
+	if storage.records >= storage.compactMin && storage.records > 2*len(storage.buckets) {
+		if err := storage.compact(); err != nil && storage.onSyncError != nil {
+			storage.onSyncError(err)
+		}
+	}
+}
+
+// put appends the bucket of key to the log and stores it once it is written.
+// storage.lock should be held.
+func (storage *DiskStorage) put(key string, b bucket) error {
+	if err := storage.append(&record{op: opPut, key: key, bucket: b}); err != nil {
+		return err
+	}
+	storage.buckets[key] = &b
+	storage.changed()
+	return nil
+}
+
+// Compact rewrites the log with the live buckets only
+func (storage *DiskStorage) Compact() error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+	return storage.compact()
+}
+
+// compact writes the live buckets to a temporary file which replaces the log.
+// storage.lock should be held.
+func (storage *DiskStorage) compact() error {
+	tmpPath := storage.path + ".compact"
+	file, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	buf := header()
+	size := int64(0)
+	for key, b := range storage.buckets {
+		buf = appendRecord(buf, &record{op: opPut, key: key, bucket: *b})
+		if len(buf) >= 64*1024 {
+			if _, err = w.Write(buf); err != nil {
+				break
+			}
+			size += int64(len(buf))
+			buf = buf[:0]
+		}
+	}
+	if err == nil {
+		_, err = w.Write(buf)
+		size += int64(len(buf))
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, storage.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// the directory is synced so the rename survives a crash, its error is not fatal on
+	// systems that could not sync directories
+	if dir, err := os.Open(filepath.Dir(storage.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	storage.file.Close()
+	storage.file = file
+	storage.records = len(storage.buckets)
+	storage.size = size
+	storage.dirty = false
+	return nil
+}
+
+// background syncs the log and collects inactive buckets until the storage is closed
+func (storage *DiskStorage) background() {
+	defer storage.done.Done()
+
+	syncTicker := time.NewTicker(storage.syncInterval)
+	defer syncTicker.Stop()
+	gcTicker := time.NewTicker(storage.gcInterval)
+	defer gcTicker.Stop()
+
+	for {
+		var err error
+		select {
+		case <-storage.stopChan:
+			return
+		case <-syncTicker.C:
+			err = storage.flush()
+		case <-gcTicker.C:
+			err = storage.collect()
+		}
+
+		if err != nil && storage.onSyncError != nil {
+			storage.onSyncError(err)
+		}
+	}
+}
+
+// flush fsyncs the changes appended since the last flush
+func (storage *DiskStorage) flush() error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if !storage.dirty {
+		return nil
+	}
+	storage.dirty = false
+	return storage.file.Sync()
+}
+
+// collect removes the buckets inactive for more than TTL and compacts the log if needed.
+// Removed buckets are not logged: replay skips inactive records as well.
+func (storage *DiskStorage) collect() error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	now := storage.now()
+	for key, b := range storage.buckets {
+		if b.expired(now, storage.ttl) {
+			delete(storage.buckets, key)
+		}
+	}
+
+	if storage.records >= storage.compactMin && storage.records > 2*len(storage.buckets) {
+		return storage.compact()
+	}
+	return nil
+}
+
+// Len returns the number of buckets currently held by the storage
+func (storage *DiskStorage) Len() int {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	return len(storage.buckets)
+}
+
+// Close syncs and closes the log
+func (storage *DiskStorage) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
+		return ErrStoppedFlag
+	}
+
+	close(storage.stopChan)
+	storage.done.Wait()
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	err := storage.file.Sync()
+	if closeErr := storage.file.Close(); err == nil {
+		err = closeErr
+	}
+	storage.buckets = make(map[string]*bucket)
+	return err
+}
+
+// Take attempts to remove a token from key. If take is successful, it returns true.
+// Returns tokens limit, remaining tokens count, reset time, success flag and error.
+// The new state is appended to the log before Take returns. Takes of exhausted buckets
+// do not change them, so they are not logged.
+func (storage *DiskStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, 0, false, rlstorage.ErrStopped
+	}
+
+	now := storage.now()
+	// the bucket is changed on a copy, so it is kept as is if the change could not be logged
+	var b bucket
+	stored, exists := storage.buckets[key]
+	if exists {
+		b = *stored
+	} else {
+		b = newBucket(now, storage.tokens, storage.interval)
+	}
+
+	reset := b.refill(now)
+	ok := false
+	var remaining uint64
+	if b.availableTokens > 0 {
+		b.availableTokens--
+		ok = true
+		remaining = b.availableTokens
+	}
+
+	if !exists || b != *stored {
+		if err := storage.put(key, b); err != nil {
+			return 0, 0, 0, false, err
+		}
+	}
+	return b.maxTokens, remaining, reset, ok, nil
+}
+
+// Get retrieves the info by key if it exists. Remaining tokens are reported as if the bucket
+// was refilled now, but the bucket itself is not changed.
+func (storage *DiskStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, rlstorage.ErrStopped
+	}
+
+	b, ok := storage.buckets[key]
+	if !ok {
+		return 0, 0, nil
+	}
+
+	refilled := *b
+	refilled.refill(storage.now())
+	return refilled.maxTokens, refilled.availableTokens, nil
+}
+
+// Set setups bucket by key and tokens and interval. Recreates bucket if needed.
+func (storage *DiskStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	return storage.put(key, newBucket(storage.now(), tokens, interval))
+}
+
+// Burst add tokens to the available tokens of the bucket labeled by key.
+// Creates a bucket with key if not found one.
+func (storage *DiskStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	if stored, ok := storage.buckets[key]; ok {
+		b := *stored
+		b.availableTokens += tokens
+		return storage.put(key, b)
+	}
+
+	// record not found
+	return storage.put(key, newBucket(storage.now(), storage.tokens+tokens, storage.interval))
+}
+
+// Reset refills the bucket labeled by key keeping its limit and interval.
+// Does nothing if the bucket does not exist.
+func (storage *DiskStorage) Reset(ctx context.Context, key string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	old, ok := storage.buckets[key]
+	if !ok {
+		return nil
+	}
+
+	return storage.put(key, newBucket(storage.now(), old.maxTokens, old.interval))
+}
+
+// Delete removes the bucket labeled by key. The next Take would create it with defaults.
+func (storage *DiskStorage) Delete(ctx context.Context, key string) error {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	if _, ok := storage.buckets[key]; !ok {
+		return nil
+	}
+	if err := storage.append(&record{op: opDelete, key: key}); err != nil {
+		return err
+	}
+	delete(storage.buckets, key)
+	storage.changed()
+	return nil
+}
@@ -0,0 +1,352 @@
+package diskstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	rlstorage "pkg/rl-storage"
+	"testing"
+	"time"
+)
+
+func testPath(tb testing.TB) string {
+	tb.Helper()
+
+	dir, err := ioutil.TempDir("", "diskstorage")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return filepath.Join(dir, "limits.log")
+}
+
+func testStorage(tb testing.TB, cfg *Config) *DiskStorage {
+	tb.Helper()
+
+	storage, err := NewDiskStorage(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil && err != ErrStoppedFlag {
+			tb.Fatal(err)
+		}
+	})
+	return storage
+}
+
+func TestNewDiskStorage_Config(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		name string
+		cfg  *Config
+		err  error
+	}{
+		{name: "nil", cfg: nil, err: ErrNoPath},
+		{name: "no path", cfg: &Config{}, err: ErrNoPath},
+		{name: "sync", cfg: &Config{Path: "limits.log", Sync: SyncNever + 1}, err: ErrUnknownSync},
+	} {
+		if _, err := NewDiskStorage(c.cfg); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	path := testPath(t)
+	if err := ioutil.WriteFile(path, []byte("not a log file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewDiskStorage(&Config{Path: path}); !errors.Is(err, ErrLogMagic) {
+		t.Errorf("magic: expected %v, got %v", ErrLogMagic, err)
+	}
+}
+
+func TestDiskStorage_Take(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for _, policy := range []SyncPolicy{SyncInterval, SyncAlways, SyncNever} {
+		policy := policy
+		t.Run(fmt.Sprint(policy), func(t *testing.T) {
+			t.Parallel()
+
+			interval := 250 * time.Millisecond
+			storage := testStorage(t, &Config{Path: testPath(t), Tokens: 3, Interval: interval, Sync: policy})
+
+			for i, want := range []struct {
+				remaining uint64
+				ok        bool
+			}{{2, true}, {1, true}, {0, true}, {0, false}} {
+				limit, remaining, reset, ok, err := storage.Take(ctx, "key")
+				if err != nil {
+					t.Fatal(err)
+				}
+				if limit != 3 || remaining != want.remaining || ok != want.ok {
+					t.Errorf("take %d: expected 3/%d/%v, got %d/%d/%v", i, want.remaining, want.ok, limit, remaining, ok)
+				}
+				if until := time.Until(time.Unix(0, int64(reset))); until > interval {
+					t.Errorf("reset: expected in %v, got %v", interval, until)
+				}
+			}
+
+			time.Sleep(interval)
+			if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || !ok {
+				t.Errorf("failed to take once more: %v", err)
+			}
+		})
+	}
+}
+
+func TestDiskStorage_Restart(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	cfg := &Config{Path: testPath(t), Tokens: 5, Interval: time.Hour}
+	storage := testStorage(t, cfg)
+
+	for _, key := range []string{"a", "a", "b", "deleted"} {
+		if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := storage.Set(ctx, "custom", 10, 24*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Burst(ctx, "b", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Delete(ctx, "deleted"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a crash during append leaves a torn record at the end
+	file, err := os.OpenFile(cfg.Path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.Write([]byte{42, 0, 0, 0, 1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+
+	restarted := testStorage(t, cfg)
+	if got, want := restarted.Len(), 3; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+	for _, c := range []struct {
+		key              string
+		limit, remaining uint64
+	}{
+		{key: "a", limit: 5, remaining: 3},
+		{key: "b", limit: 5, remaining: 6},
+		{key: "custom", limit: 10, remaining: 10},
+		{key: "deleted", limit: 0, remaining: 0},
+	} {
+		limit, remaining, err := restarted.Get(ctx, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit != c.limit || remaining != c.remaining {
+			t.Errorf("%s: expected %d/%d, got %d/%d", c.key, c.remaining, c.limit, remaining, limit)
+		}
+	}
+
+	// the torn record is truncated, so new records are readable after the next restart
+	if _, _, _, _, err := restarted.Take(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := restarted.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	again := testStorage(t, cfg)
+	if _, remaining, err := again.Get(ctx, "a"); err != nil || remaining != 2 {
+		t.Errorf("after truncation: expected 2 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestDiskStorage_CompactCollect(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	cfg := &Config{Path: testPath(t), Tokens: 1000, Interval: time.Hour, TTL: 2 * time.Hour, CompactMinRecords: 16}
+	storage := testStorage(t, cfg)
+
+	for i := 0; i < 500; i++ {
+		if _, _, _, _, err := storage.Take(ctx, fmt.Sprintf("key-%d", i%4)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// exhausted takes are not logged
+	if err := storage.Set(ctx, "exhausted", 1, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, _, _, err := storage.Take(ctx, "exhausted"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	info, err := os.Stat(cfg.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 1024 {
+		t.Errorf("log is not compacted: %d bytes", info.Size())
+	}
+	if storage.records > 2*cfg.CompactMinRecords {
+		t.Errorf("records: expected at most %d, got %d", 2*cfg.CompactMinRecords, storage.records)
+	}
+
+	// all buckets but the refreshed one are inactive for longer than TTL
+	now := nanoNow() + uint64(3*time.Hour)
+	storage.now = func() uint64 { return now }
+	if _, _, _, _, err := storage.Take(ctx, "key-0"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.collect(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storage.Len(), 1; got != want {
+		t.Errorf("len after collect: expected %d, got %d", want, got)
+	}
+
+	if err := storage.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Compact(); err != rlstorage.ErrStopped {
+		t.Errorf("compact after close: expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+
+	restarted := testStorage(t, cfg)
+	// key-0 was refilled by the take three intervals later
+	if _, remaining, err := restarted.Get(ctx, "key-0"); err != nil || remaining != 999 {
+		t.Errorf("key-0: expected 999 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestDiskStorage_CompactError(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var compactErr error
+	cfg := &Config{
+		Path:              testPath(t),
+		Tokens:            1000,
+		Interval:          time.Hour,
+		CompactMinRecords: 16,
+		OnSyncError:       func(err error) { compactErr = err },
+	}
+	storage := testStorage(t, cfg)
+
+	// the temporary log could not be created
+	if err := os.Mkdir(cfg.Path+".compact", 0o700); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || !ok {
+			t.Fatalf("take %d: %v, %v", i, ok, err)
+		}
+	}
+	if compactErr == nil {
+		t.Errorf("compaction error is not reported")
+	}
+
+	// the takes are kept in the log
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	restarted := testStorage(t, cfg)
+	if _, remaining, err := restarted.Get(ctx, "key"); err != nil || remaining != 900 {
+		t.Errorf("restart: expected 900 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestDiskStorage_Stopped(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := testStorage(t, &Config{Path: testPath(t)})
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != ErrStoppedFlag {
+		t.Errorf("close: expected %v, got %v", ErrStoppedFlag, err)
+	}
+	if _, _, _, _, err := storage.Take(ctx, "a"); err != rlstorage.ErrStopped {
+		t.Errorf("take: expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+	if err := storage.Set(ctx, "a", 1, time.Second); err != rlstorage.ErrStopped {
+		t.Errorf("set: expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+}
+
+func BenchmarkDiskStorage_Take(b *testing.B) {
+	ctx := context.Background()
+	storage := testStorage(b, &Config{Path: testPath(b), Tokens: 1 << 30, Interval: time.Hour, Sync: SyncNever})
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tornFile writes the first half of a record and fails
+type tornFile struct {
+	logFile
+}
+
+func (f tornFile) Write(p []byte) (int, error) {
+	n, _ := f.logFile.Write(p[:len(p)/2])
+	return n, errors.New("no space left on device")
+}
+
+func TestDiskStorage_TornWrite(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	cfg := &Config{Path: testPath(t), Tokens: 10, Interval: time.Hour}
+	storage := testStorage(t, cfg)
+	if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	file := storage.file
+	storage.file = tornFile{logFile: file}
+	if _, _, _, _, err := storage.Take(ctx, "key"); err == nil {
+		t.Fatalf("take: expected write error")
+	}
+	if err := storage.Delete(ctx, "key"); err == nil {
+		t.Fatalf("delete: expected write error")
+	}
+	// the failed changes are not applied
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 9 {
+		t.Errorf("failed take: expected 9 remaining, got %d/%v", remaining, err)
+	}
+
+	storage.file = file
+	if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the take after the failed ones is not lost behind torn records
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	restarted := testStorage(t, cfg)
+	if _, remaining, err := restarted.Get(ctx, "key"); err != nil || remaining != 8 {
+		t.Errorf("restart: expected 8 remaining, got %d/%v", remaining, err)
+	}
+}
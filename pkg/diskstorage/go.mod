@@ -0,0 +1,6 @@
+module disk-storage
+
+require pkg/rl-storage v1.0.0
+replace pkg/rl-storage => ./../storage
+
+go 1.14
@@ -0,0 +1,155 @@
+package diskstorage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// logMagic starts the log file followed by logVersion. Increment logVersion when
+// the record layout changes incompatibly.
+const (
+	logMagic   = "RLDLOG"
+	logVersion = 1
+	headerSize = len(logMagic) + 2
+	// frameSize is the size of the record length and checksum preceding every record
+	frameSize = 8
+	// maxRecordSize protects replay from allocating garbage lengths of a corrupted log
+	maxRecordSize = 1 << 20
+)
+
+const (
+	opPut    byte = 1
+	opDelete byte = 2
+)
+
+var (
+	ErrLogMagic   = fmt.Errorf("file is not a storage log")
+	ErrLogVersion = fmt.Errorf("unsupported storage log version")
+)
+
+// record is a single change of the log: the whole new state of a bucket or its deletion
+type record struct {
+	op  byte
+	key string
+	bucket
+}
+
+func header() []byte {
+	h := make([]byte, headerSize)
+	copy(h, logMagic)
+	binary.LittleEndian.PutUint16(h[len(logMagic):], logVersion)
+	return h
+}
+
+func checkHeader(h []byte) error {
+	if string(h[:len(logMagic)]) != logMagic {
+		return ErrLogMagic
+	}
+	if version := binary.LittleEndian.Uint16(h[len(logMagic):]); version != logVersion {
+		return fmt.Errorf("%w: %d", ErrLogVersion, version)
+	}
+	return nil
+}
+
+// appendRecord appends the framed record to buf: its length, crc32 of the payload and the payload.
+// The payload is the op, the key and the bucket fields as uvarints.
+func appendRecord(buf []byte, r *record) []byte {
+	start := len(buf)
+	buf = append(buf, make([]byte, frameSize)...)
+
+	var varint [binary.MaxVarintLen64]byte
+	putUvarint := func(v uint64) {
+		n := binary.PutUvarint(varint[:], v)
+		buf = append(buf, varint[:n]...)
+	}
+
+	buf = append(buf, r.op)
+	putUvarint(uint64(len(r.key)))
+	buf = append(buf, r.key...)
+	if r.op == opPut {
+		putUvarint(r.startTime)
+		putUvarint(r.lastTick)
+		putUvarint(uint64(r.interval))
+		putUvarint(r.maxTokens)
+		putUvarint(r.availableTokens)
+	}
+
+	payload := buf[start+frameSize:]
+	binary.LittleEndian.PutUint32(buf[start:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(buf[start+4:], crc32.ChecksumIEEE(payload))
+	return buf
+}
+
+var errTornRecord = errors.New("torn record")
+
+// readRecord reads a single record. It returns io.EOF at the clean end of the log and
+// errTornRecord if the record is partial or corrupted, e.g. by a crash during append.
+// The returned size is the number of bytes of the framed record.
+func readRecord(r *bufio.Reader) (*record, int, error) {
+	var frame [frameSize]byte
+	if _, err := io.ReadFull(r, frame[:]); err != nil {
+		if err == io.EOF {
+			return nil, 0, io.EOF
+		}
+		return nil, 0, errTornRecord
+	}
+
+	size := binary.LittleEndian.Uint32(frame[:4])
+	if size == 0 || size > maxRecordSize {
+		return nil, 0, errTornRecord
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, 0, errTornRecord
+	}
+	if crc32.ChecksumIEEE(payload) != binary.LittleEndian.Uint32(frame[4:]) {
+		return nil, 0, errTornRecord
+	}
+
+	rec, err := decodeRecord(payload)
+	if err != nil {
+		return nil, 0, errTornRecord
+	}
+	return rec, frameSize + int(size), nil
+}
+
+func decodeRecord(payload []byte) (*record, error) {
+	var err error
+	uvarint := func() uint64 {
+		v, n := binary.Uvarint(payload)
+		if n <= 0 {
+			err = errTornRecord
+			return 0
+		}
+		payload = payload[n:]
+		return v
+	}
+
+	rec := &record{op: payload[0]}
+	payload = payload[1:]
+
+	keyLen := uvarint()
+	if err != nil || keyLen > uint64(len(payload)) {
+		return nil, errTornRecord
+	}
+	rec.key = string(payload[:keyLen])
+	payload = payload[keyLen:]
+
+	switch rec.op {
+	case opPut:
+		rec.startTime = uvarint()
+		rec.lastTick = uvarint()
+		rec.interval = time.Duration(uvarint())
+		rec.maxTokens = uvarint()
+		rec.availableTokens = uvarint()
+	case opDelete:
+	default:
+		return nil, errTornRecord
+	}
+	return rec, err
+}
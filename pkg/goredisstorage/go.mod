@@ -0,0 +1,22 @@
+module goredis-storage
+
+require (
+	github.com/alicebob/miniredis/v2 v2.30.0
+	github.com/redis/go-redis/v9 v9.7.3
+	pkg/redisstorage v1.0.0
+	pkg/rl-storage v1.0.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/gomodule/redigo v1.8.4 // indirect
+	github.com/yuin/gopher-lua v0.0.0-20220504180219-658193537a64 // indirect
+)
+
+replace pkg/redisstorage => ./../redisstorage
+
+replace pkg/rl-storage => ./../storage
+
+go 1.18
@@ -0,0 +1,88 @@
+package goredisstorage
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+	"pkg/redisstorage"
+)
+
+// scanCount is the COUNT hint of a single SCAN call
+const scanCount = 100
+
+// NewRS returns RedisStorage working through client. It could be *redis.Client,
+// *redis.ClusterClient or the failover client of Sentinel. Closing the storage does not close client.
+func NewRS(cfg *redisstorage.Config, client redis.UniversalClient) (*redisstorage.RedisStorage, error) {
+	return redisstorage.NewRSWithScripter(cfg, NewScripter(client))
+}
+
+// NewScripter returns redisstorage.Scripter of go-redis client. Keys are routed and redirects
+// are followed by the client itself, scans of *redis.ClusterClient run on every master.
+func NewScripter(client redis.UniversalClient) redisstorage.Scripter {
+	return &scripter{client: client}
+}
+
+type scripter struct {
+	client redis.UniversalClient
+}
+
+func (s *scripter) EvalSha(ctx context.Context, sha string, keys []string, args ...interface{}) (interface{}, error) {
+	return s.client.EvalSha(ctx, sha, keys, args...).Result()
+}
+
+func (s *scripter) Eval(ctx context.Context, src string, keys []string, args ...interface{}) (interface{}, error) {
+	return s.client.Eval(ctx, src, keys, args...).Result()
+}
+
+func (s *scripter) Del(ctx context.Context, key string) error {
+	return s.client.Del(ctx, key).Err()
+}
+
+func (s *scripter) Scan(ctx context.Context, pattern string, f func(keys []string) bool) error {
+	cluster, ok := s.client.(*redis.ClusterClient)
+	if !ok {
+		_, err := scanNode(ctx, s.client, pattern, f)
+		return err
+	}
+
+	// masters are scanned concurrently, f is not
+	var lock sync.Mutex
+	stopped := false
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, node *redis.Client) error {
+		_, err := scanNode(ctx, node, pattern, func(keys []string) bool {
+			lock.Lock()
+			defer lock.Unlock()
+			if stopped {
+				return false
+			}
+			stopped = !f(keys)
+			return !stopped
+		})
+		return err
+	})
+}
+
+// scanNode scans keys of a single node. Returns true if f asked to stop.
+func scanNode(ctx context.Context, node redis.Cmdable, pattern string, f func(keys []string) bool) (bool, error) {
+	cursor := uint64(0)
+	for {
+		keys, next, err := node.Scan(ctx, cursor, pattern, scanCount).Result()
+		if err != nil {
+			return false, err
+		}
+
+		if len(keys) > 0 && !f(keys) {
+			return true, nil
+		}
+
+		if cursor = next; cursor == 0 {
+			return false, nil
+		}
+	}
+}
+
+// Close does nothing: the client is owned by the caller.
+func (s *scripter) Close() error {
+	return nil
+}
@@ -0,0 +1,90 @@
+package goredisstorage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"pkg/redisstorage"
+	rlstorage "pkg/rl-storage"
+)
+
+func testStorage(tb testing.TB, client redis.UniversalClient) *redisstorage.RedisStorage {
+	tb.Helper()
+
+	storage, err := NewRS(&redisstorage.Config{Tokens: 10, Interval: time.Minute, Prefix: "rl:"}, client)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return storage
+}
+
+func testStorageOps(t *testing.T, client redis.UniversalClient) {
+	ctx := context.Background()
+	storage := testStorage(t, client)
+
+	limit, remaining, _, ok, err := storage.Take(ctx, "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || limit != 10 || remaining != 9 {
+		t.Errorf("take: got %d/%d, %v", remaining, limit, ok)
+	}
+
+	// scripts are loaded again after flush
+	if err := client.ScriptFlush(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Burst(ctx, "user", 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err = storage.Get(ctx, "user"); err != nil || remaining != 14 {
+		t.Errorf("get: got %d, %v", remaining, err)
+	}
+
+	var scanned []rlstorage.KeyState
+	if err := storage.Scan(ctx, "", func(state rlstorage.KeyState) bool {
+		scanned = append(scanned, state)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(scanned) != 1 || scanned[0].Key != "user" || scanned[0].Interval != time.Minute {
+		t.Errorf("scan: got %+v", scanned)
+	}
+
+	if err := storage.Delete(ctx, "user"); err != nil {
+		t.Fatal(err)
+	}
+	if limit, _, err = storage.Get(ctx, "user"); err != nil || limit != 0 {
+		t.Errorf("get after delete: got %d, %v", limit, err)
+	}
+}
+
+func TestScripter_Client(t *testing.T) {
+	t.Parallel()
+
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	testStorageOps(t, client)
+}
+
+func TestScripter_ClusterClient(t *testing.T) {
+	t.Parallel()
+
+	// miniredis reports itself as a cluster of a single node
+	server := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{server.Addr()}})
+	t.Cleanup(func() { client.Close() })
+
+	testStorageOps(t, client)
+}
@@ -0,0 +1,502 @@
+package gossipstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoppedFlag = fmt.Errorf("setting stop flag failed")
+	ErrNoAddr      = fmt.Errorf("listen address is empty")
+)
+
+const (
+	// antiEntropyEvery is the number of syncs after which all keys of the window are sent,
+	// not only the changed ones, so counts lost with UDP packets are corrected
+	antiEntropyEvery = 10
+	// entryOverhead is the estimated size of a count in a message besides its key
+	entryOverhead = 24
+)
+
+// GossipStorage enforces soft global limits: every instance counts its takes of a key locally
+// and periodically sends the counts to its peers over UDP, so a take is allowed while the local
+// count plus the counts reported by peers is below the limit.
+//
+// Counts are kept per window of Interval aligned to the unix epoch, so clocks of the instances
+// should be in sync. Peers are identified by the source address of their packets, packets of
+// other addresses are dropped. Counts are cumulative for the window, so a lost packet is
+// corrected by the next one. Instances could exceed the limit together by the takes made
+// between syncs.
+// Per-key limits are not supported: Set, Burst, Reset and Delete return rlstorage.ErrNotSupported.
+type GossipStorage struct {
+	tokens       uint64
+	interval     uint64
+	syncInterval time.Duration
+	maxPacket    int
+	onReceive    func(peer string, lag time.Duration)
+
+	conn net.PacketConn
+	addr string
+
+	lock   sync.Mutex
+	keys   map[string]*counter
+	dirty  map[string]struct{}
+	window uint64
+	syncs  int
+
+	peersLock sync.RWMutex
+	peers     []*net.UDPAddr
+	// known is the set of the addresses of peers, the packets of others are dropped
+	known    map[string]bool
+	lastSeen map[string]uint64
+
+	stats struct {
+		sent, received, dropped uint64
+	}
+
+	// now returns current unix time in nanoseconds, it is replaced by tests
+	now func() uint64
+
+	stopped  uint32
+	stopChan chan struct{}
+	done     sync.WaitGroup
+}
+
+// counter is the usage of a key in the current window
+type counter struct {
+	window uint64
+	local  uint64
+	// remote is the count of the key reported by every peer
+	remote map[string]uint64
+}
+
+// used returns the count of the key across instances. It saturates, so peers reporting
+// huge counts could not wrap it around.
+func (c *counter) used() uint64 {
+	used := c.local
+	for _, count := range c.remote {
+		if used += count; used < count {
+			return math.MaxUint64
+		}
+	}
+	return used
+}
+
+// message is a single UDP packet with the counts of the sender
+type message struct {
+	Interval uint64            `json:"interval"`
+	Window   uint64            `json:"window"`
+	SentAt   uint64            `json:"sent_at"`
+	Counts   map[string]uint64 `json:"counts"`
+}
+
+// Config is used to NewGossipStorage. It setups the GossipStorage
+type Config struct {
+	// Addr is the UDP address to listen on, e.g. ":7946". Required.
+	Addr string
+	// Peers are the UDP addresses of the other instances. They could be changed with SetPeers.
+	Peers []string
+	// Tokens is the number of tokens allowed per Interval across all instances. Default is 1.
+	Tokens uint64
+	// Interval is the time interval upon which rate limiting is enforced. All instances
+	// should use the same value. Default is 1 second.
+	Interval time.Duration
+	// SyncInterval is the rate at which counts are sent to peers. The lower, the closer
+	// the instances are to the limit, but the more packets are sent. Default is 100 milliseconds.
+	SyncInterval time.Duration
+	// MaxPacketSize is the approximate maximum size of a packet. Counts of many keys are split
+	// into several packets. Default is 1400 bytes to avoid fragmentation.
+	MaxPacketSize int
+	// OnReceive is called with the source address and the age of every applied message. The age is
+	// how stale the counts of the peer are, so it could be used to observe convergence.
+	OnReceive func(peer string, lag time.Duration)
+}
+
+// Stats are the counters of the gossip of the storage
+type Stats struct {
+	// Sent and Received are the numbers of messages
+	Sent, Received uint64
+	// Dropped is the number of received messages which were not sent by peers, could not be
+	// decoded, were sent with another Interval or for a window later than the next one
+	Dropped uint64
+	// PeerLag is the time since the last message of every peer that sent one
+	PeerLag map[string]time.Duration
+}
+
+func NewGossipStorage(cfg *Config) (*GossipStorage, error) {
+	if cfg == nil || cfg.Addr == "" {
+		return nil, ErrNoAddr
+	}
+
+	tokens := uint64(1)
+	if cfg.Tokens > 0 {
+		tokens = cfg.Tokens
+	}
+
+	interval := 1 * time.Second
+	if cfg.Interval > 0 {
+		interval = cfg.Interval
+	}
+
+	syncInterval := 100 * time.Millisecond
+	if cfg.SyncInterval > 0 {
+		syncInterval = cfg.SyncInterval
+	}
+
+	maxPacket := 1400
+	if cfg.MaxPacketSize > 0 {
+		maxPacket = cfg.MaxPacketSize
+	}
+
+	conn, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &GossipStorage{
+		tokens:       tokens,
+		interval:     uint64(interval),
+		syncInterval: syncInterval,
+		maxPacket:    maxPacket,
+		onReceive:    cfg.OnReceive,
+		conn:         conn,
+		addr:         conn.LocalAddr().String(),
+		keys:         make(map[string]*counter),
+		dirty:        make(map[string]struct{}),
+		lastSeen:     make(map[string]uint64),
+		now:          nanoNow,
+		stopChan:     make(chan struct{}),
+	}
+	if err := storage.SetPeers(cfg.Peers); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	storage.done.Add(2)
+	go storage.receive()
+	go storage.gossip()
+	return storage, nil
+}
+
+func nanoNow() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// Addr returns the address the storage listens on
+func (storage *GossipStorage) Addr() string {
+	return storage.addr
+}
+
+// SetPeers replaces the addresses of the other instances. Addresses are resolved once,
+// packets are accepted from the resolved addresses only.
+func (storage *GossipStorage) SetPeers(addrs []string) error {
+	peers := make([]*net.UDPAddr, 0, len(addrs))
+	known := make(map[string]bool, len(addrs))
+	for _, addr := range addrs {
+		peer, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return err
+		}
+		peers = append(peers, peer)
+		known[peer.String()] = true
+	}
+
+	storage.peersLock.Lock()
+	storage.peers = peers
+	storage.known = known
+	for peer := range storage.lastSeen {
+		if !known[peer] {
+			delete(storage.lastSeen, peer)
+		}
+	}
+	storage.peersLock.Unlock()
+	return nil
+}
+
+// isPeer returns whether addr is the address of a peer
+func (storage *GossipStorage) isPeer(addr string) bool {
+	storage.peersLock.RLock()
+	defer storage.peersLock.RUnlock()
+	return storage.known[addr]
+}
+
+// Len returns the number of keys counted in the current window
+func (storage *GossipStorage) Len() int {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+	return len(storage.keys)
+}
+
+// Stats returns the counters of the gossip
+func (storage *GossipStorage) Stats() Stats {
+	stats := Stats{
+		Sent:     atomic.LoadUint64(&storage.stats.sent),
+		Received: atomic.LoadUint64(&storage.stats.received),
+		Dropped:  atomic.LoadUint64(&storage.stats.dropped),
+		PeerLag:  make(map[string]time.Duration),
+	}
+
+	now := storage.now()
+	storage.peersLock.RLock()
+	for peer, seen := range storage.lastSeen {
+		stats.PeerLag[peer] = time.Duration(now - seen)
+	}
+	storage.peersLock.RUnlock()
+	return stats
+}
+
+// rotate moves the storage to the window of now dropping the counters of the previous ones.
+// storage.lock should be held.
+func (storage *GossipStorage) rotate(now uint64) uint64 {
+	window := now - now%storage.interval
+	if window > storage.window {
+		storage.window = window
+		storage.keys = make(map[string]*counter)
+		storage.dirty = make(map[string]struct{})
+	}
+	return storage.window
+}
+
+// counter returns the counter of key in window creating it if needed. storage.lock should be held.
+func (storage *GossipStorage) counter(key string, window uint64) *counter {
+	c, ok := storage.keys[key]
+	if !ok || c.window < window {
+		c = &counter{window: window, remote: make(map[string]uint64)}
+		storage.keys[key] = c
+	}
+	return c
+}
+
+// Take attempts to remove a token from key. If take is successful, it returns true.
+// Returns tokens limit, remaining tokens count, reset time, success flag and error.
+func (storage *GossipStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, 0, false, rlstorage.ErrStopped
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	window := storage.rotate(storage.now())
+	reset := window + storage.interval
+
+	c := storage.counter(key, window)
+	used := c.used()
+	if used >= storage.tokens {
+		return storage.tokens, 0, reset, false, nil
+	}
+
+	c.local++
+	storage.dirty[key] = struct{}{}
+	return storage.tokens, storage.tokens - used - 1, reset, true, nil
+}
+
+// Get returns the limit and the remaining tokens of key as known by this instance
+func (storage *GossipStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, rlstorage.ErrStopped
+	}
+
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	window := storage.rotate(storage.now())
+	c, ok := storage.keys[key]
+	if !ok || c.window < window {
+		return storage.tokens, storage.tokens, nil
+	}
+
+	used := c.used()
+	if used >= storage.tokens {
+		return storage.tokens, 0, nil
+	}
+	return storage.tokens, storage.tokens - used, nil
+}
+
+// Set is not supported: all instances should agree on the limit
+func (storage *GossipStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Burst is not supported: all instances should agree on the limit
+func (storage *GossipStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Reset is not supported: the counts of peers would be received again
+func (storage *GossipStorage) Reset(ctx context.Context, key string) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Delete is not supported for the same reason as Reset
+func (storage *GossipStorage) Delete(ctx context.Context, key string) error {
+	return rlstorage.ErrNotSupported
+}
+
+// gossip sends the counts to peers every sync interval until the storage is closed
+func (storage *GossipStorage) gossip() {
+	defer storage.done.Done()
+
+	ticker := time.NewTicker(storage.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stopChan:
+			return
+		case <-ticker.C:
+		}
+		storage.sync()
+	}
+}
+
+// sync sends the local counts of the keys changed since the last sync, or of all keys
+// every antiEntropyEvery syncs, to every peer
+func (storage *GossipStorage) sync() {
+	now := storage.now()
+
+	storage.lock.Lock()
+	window := storage.rotate(now)
+	storage.syncs++
+	keys := storage.dirty
+	if storage.syncs%antiEntropyEvery == 0 {
+		keys = make(map[string]struct{}, len(storage.keys))
+		for key := range storage.keys {
+			keys[key] = struct{}{}
+		}
+	}
+
+	var messages []*message
+	msg := &message{Interval: storage.interval, Window: window, SentAt: now, Counts: make(map[string]uint64)}
+	size := 0
+	for key := range keys {
+		c, ok := storage.keys[key]
+		if !ok || c.local == 0 {
+			continue
+		}
+
+		if size+len(key)+entryOverhead > storage.maxPacket && len(msg.Counts) > 0 {
+			messages = append(messages, msg)
+			msg = &message{Interval: storage.interval, Window: window, SentAt: now, Counts: make(map[string]uint64)}
+			size = 0
+		}
+		msg.Counts[key] = c.local
+		size += len(key) + entryOverhead
+	}
+	if len(msg.Counts) > 0 {
+		messages = append(messages, msg)
+	}
+	storage.dirty = make(map[string]struct{})
+	storage.lock.Unlock()
+
+	storage.peersLock.RLock()
+	peers := storage.peers
+	storage.peersLock.RUnlock()
+
+	for _, msg := range messages {
+		data, err := json.Marshal(msg)
+		if err != nil {
+			continue
+		}
+		for _, peer := range peers {
+			// packets are lost silently like UDP does, anti-entropy corrects the counts
+			if _, err := storage.conn.WriteTo(data, peer); err == nil {
+				atomic.AddUint64(&storage.stats.sent, 1)
+			}
+		}
+	}
+}
+
+// receive applies the counts received from peers until the connection is closed
+func (storage *GossipStorage) receive() {
+	defer storage.done.Done()
+
+	buf := make([]byte, 64*1024)
+	for {
+		n, addr, err := storage.conn.ReadFrom(buf)
+		if err != nil {
+			if atomic.LoadUint32(&storage.stopped) == 1 {
+				return
+			}
+			continue
+		}
+
+		peer := addr.String()
+		if !storage.isPeer(peer) {
+			atomic.AddUint64(&storage.stats.dropped, 1)
+			continue
+		}
+
+		var msg message
+		if err := json.Unmarshal(buf[:n], &msg); err != nil || msg.Interval != storage.interval {
+			atomic.AddUint64(&storage.stats.dropped, 1)
+			continue
+		}
+		if !storage.apply(peer, &msg) {
+			atomic.AddUint64(&storage.stats.dropped, 1)
+			continue
+		}
+		atomic.AddUint64(&storage.stats.received, 1)
+	}
+}
+
+// apply stores the counts of the message sent by peer. Counts of past windows are ignored,
+// counts are never decreased as packets could be reordered. It returns false if the message
+// is for a window later than the next one, such counts would reset the current window.
+func (storage *GossipStorage) apply(peer string, msg *message) bool {
+	now := storage.now()
+
+	storage.lock.Lock()
+	window := storage.rotate(now)
+	if msg.Window > window+storage.interval {
+		storage.lock.Unlock()
+		return false
+	}
+	if msg.Window > window {
+		// the clock of the sender is ahead, the window is rotated by the next take
+		window = msg.Window
+		storage.window = window
+		storage.keys = make(map[string]*counter)
+		storage.dirty = make(map[string]struct{})
+	}
+	if msg.Window == window {
+		for key, count := range msg.Counts {
+			c := storage.counter(key, window)
+			if count > c.remote[peer] {
+				c.remote[peer] = count
+			}
+		}
+	}
+	storage.lock.Unlock()
+
+	storage.peersLock.Lock()
+	// the peer could be removed since its packet was received
+	if storage.known[peer] {
+		storage.lastSeen[peer] = now
+	}
+	storage.peersLock.Unlock()
+
+	if storage.onReceive != nil && now > msg.SentAt {
+		storage.onReceive(peer, time.Duration(now-msg.SentAt))
+	}
+	return true
+}
+
+// Close stops the gossip and closes the connection
+func (storage *GossipStorage) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
+		return ErrStoppedFlag
+	}
+
+	close(storage.stopChan)
+	err := storage.conn.Close()
+	storage.done.Wait()
+	return err
+}
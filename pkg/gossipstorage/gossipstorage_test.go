@@ -0,0 +1,502 @@
+package gossipstorage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCluster starts n storages of cfg knowing each other by their loopback addresses.
+// Addr, Tokens, Interval and SyncInterval default to loopback, 30, an hour and 5 milliseconds.
+func testCluster(t *testing.T, n int, cfg Config) []*GossipStorage {
+	t.Helper()
+	ctx := context.Background()
+
+	if cfg.Addr == "" {
+		cfg.Addr = "127.0.0.1:0"
+	}
+	if cfg.Tokens == 0 {
+		cfg.Tokens = 30
+	}
+	if cfg.Interval == 0 {
+		cfg.Interval = time.Hour
+	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = 5 * time.Millisecond
+	}
+
+	storages := make([]*GossipStorage, n)
+	addrs := make([]string, n)
+	for i := range storages {
+		storage, err := NewGossipStorage(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		storages[i] = storage
+		_, port, err := net.SplitHostPort(storage.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs[i] = net.JoinHostPort("127.0.0.1", port)
+	}
+
+	for i, storage := range storages {
+		peers := make([]string, 0, n-1)
+		for j, addr := range addrs {
+			if i != j {
+				peers = append(peers, addr)
+			}
+		}
+		if err := storage.SetPeers(peers); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Cleanup(func() {
+		for _, storage := range storages {
+			if err := storage.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	return storages
+}
+
+// waitRemaining waits until every storage reports remaining tokens of key
+func waitRemaining(t *testing.T, storages []*GossipStorage, key string, remaining uint64) {
+	t.Helper()
+	ctx := context.Background()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for i, storage := range storages {
+		for {
+			_, got, err := storage.Get(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got == remaining {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("storage %d: expected %d remaining, got %d", i, remaining, got)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestGossipStorage_New(t *testing.T) {
+	t.Parallel()
+
+	for _, cfg := range []*Config{nil, {}} {
+		if _, err := NewGossipStorage(cfg); !errors.Is(err, ErrNoAddr) {
+			t.Errorf("expected %v, got %v", ErrNoAddr, err)
+		}
+	}
+
+	if _, err := NewGossipStorage(&Config{Addr: "127.0.0.1:0", Peers: []string{"no port"}}); err == nil {
+		t.Error("expected error for invalid peer")
+	}
+}
+
+func TestGossipStorage_Converge(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var lags uint64
+	storages := testCluster(t, 3, Config{
+		OnReceive: func(peer string, lag time.Duration) {
+			atomic.AddUint64(&lags, 1)
+		},
+	})
+
+	for i, storage := range storages {
+		for j := 0; j < 5*(i+1); j++ {
+			if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || !ok {
+				t.Fatalf("storage %d: take %d: expected success, got %v, %v", i, j, ok, err)
+			}
+		}
+	}
+
+	// 5 + 10 + 15 tokens are taken across the cluster
+	waitRemaining(t, storages, "key", 0)
+	for i, storage := range storages {
+		limit, remaining, reset, ok, err := storage.Take(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok || limit != 30 || remaining != 0 {
+			t.Errorf("storage %d: expected denial of 30, got %v with %d of %d", i, ok, remaining, limit)
+		}
+		if now := uint64(time.Now().UnixNano()); reset <= now || reset > now+uint64(time.Hour) {
+			t.Errorf("storage %d: unexpected reset %d", i, reset)
+		}
+	}
+
+	// other keys are not affected
+	if _, remaining, err := storages[0].Get(ctx, "other"); err != nil || remaining != 30 {
+		t.Errorf("expected 30 remaining for other key, got %d, %v", remaining, err)
+	}
+
+	if atomic.LoadUint64(&lags) == 0 {
+		t.Error("expected OnReceive calls")
+	}
+	for i, storage := range storages {
+		stats := storage.Stats()
+		if stats.Sent == 0 || stats.Received == 0 || stats.Dropped != 0 {
+			t.Errorf("storage %d: unexpected stats %+v", i, stats)
+		}
+		if len(stats.PeerLag) != 2 {
+			t.Errorf("storage %d: expected lag of 2 peers, got %v", i, stats.PeerLag)
+		}
+		if storage.Len() != 1 {
+			t.Errorf("storage %d: expected 1 key, got %d", i, storage.Len())
+		}
+	}
+}
+
+func TestGossipStorage_Concurrent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const tokens = 200
+	storages := testCluster(t, 3, Config{Tokens: tokens, SyncInterval: time.Millisecond})
+
+	var allowed uint64
+	var wg sync.WaitGroup
+	for _, storage := range storages {
+		wg.Add(1)
+		go func(storage *GossipStorage) {
+			defer wg.Done()
+			for i := 0; i < tokens; i++ {
+				if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil {
+					t.Error(err)
+					return
+				} else if ok {
+					atomic.AddUint64(&allowed, 1)
+				}
+				time.Sleep(100 * time.Microsecond)
+			}
+		}(storage)
+	}
+	wg.Wait()
+
+	// instances could exceed the limit together by the takes between syncs only
+	if got := atomic.LoadUint64(&allowed); got < tokens || got > 2*tokens {
+		t.Errorf("expected about %d allowed takes, got %d", tokens, got)
+	}
+	waitRemaining(t, storages, "key", 0)
+}
+
+func TestGossipStorage_ManyKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storages := testCluster(t, 2, Config{Tokens: 2, MaxPacketSize: 100})
+
+	const keys = 50
+	for i := 0; i < keys; i++ {
+		if _, _, _, ok, err := storages[0].Take(ctx, fmt.Sprint("key-", i)); err != nil || !ok {
+			t.Fatalf("expected success, got %v, %v", ok, err)
+		}
+	}
+	for i := 0; i < keys; i++ {
+		waitRemaining(t, storages[1:], fmt.Sprint("key-", i), 1)
+	}
+
+	// counts of many keys are split into several packets
+	if got := storages[1].Stats().Received; got < 2 {
+		t.Errorf("expected several messages, got %d", got)
+	}
+}
+
+func TestGossipStorage_Window(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewGossipStorage(&Config{Addr: "127.0.0.1:0", Tokens: 2, Interval: time.Second, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	now := uint64(10 * time.Second)
+	storage.now = func() uint64 { return now }
+	window := now
+
+	storage.apply("peer", &message{Interval: storage.interval, Window: window, SentAt: now, Counts: map[string]uint64{"key": 1}})
+	// counts are never decreased as messages could be reordered
+	storage.apply("peer", &message{Interval: storage.interval, Window: window, SentAt: now, Counts: map[string]uint64{"key": 0}})
+	// counts of past windows are ignored
+	storage.apply("other", &message{Interval: storage.interval, Window: window - uint64(time.Second), SentAt: now, Counts: map[string]uint64{"key": 5}})
+	// the sum of huge counts does not wrap around
+	storage.apply("huge", &message{Interval: storage.interval, Window: window, SentAt: now, Counts: map[string]uint64{"huge": math.MaxUint64}})
+	storage.apply("peer", &message{Interval: storage.interval, Window: window, SentAt: now, Counts: map[string]uint64{"huge": 1}})
+	if _, remaining, err := storage.Get(ctx, "huge"); err != nil || remaining != 0 {
+		t.Errorf("expected 0 remaining of huge counts, got %d, %v", remaining, err)
+	}
+
+	limit, remaining, reset, ok, err := storage.Take(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok || limit != 2 || remaining != 0 || reset != window+uint64(time.Second) {
+		t.Errorf("unexpected take: %v, %d of %d, reset %d", ok, remaining, limit, reset)
+	}
+	if _, _, _, ok, _ := storage.Take(ctx, "key"); ok {
+		t.Error("expected denial")
+	}
+
+	// the next window starts from zero
+	now += uint64(time.Second)
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 2 {
+		t.Errorf("expected 2 remaining in the next window, got %d, %v", remaining, err)
+	}
+
+	// a message of a window later than the next one is dropped
+	if storage.apply("peer", &message{Interval: storage.interval, Window: now + 2*uint64(time.Second), SentAt: now, Counts: map[string]uint64{"key": 2}}) {
+		t.Error("expected message of a far window to be dropped")
+	}
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 2 {
+		t.Errorf("expected 2 remaining after a far window, got %d, %v", remaining, err)
+	}
+
+	// a message of the next window rotates the storage
+	if !storage.apply("peer", &message{Interval: storage.interval, Window: now + uint64(time.Second), SentAt: now, Counts: map[string]uint64{"key": 2}}) {
+		t.Error("expected message of the next window to be applied")
+	}
+	now += uint64(time.Second)
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 0 {
+		t.Errorf("expected 0 remaining, got %d, %v", remaining, err)
+	}
+}
+
+func TestGossipStorage_Dropped(t *testing.T) {
+	t.Parallel()
+
+	storages := testCluster(t, 2, Config{})
+	other := testCluster(t, 1, Config{Interval: time.Minute})[0]
+	if err := other.SetPeers([]string{storages[0].Addr()}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storages[0].SetPeers([]string{storages[1].Addr(), other.Addr()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, _, _, err := other.Take(context.Background(), "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for storages[0].Stats().Dropped == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected message with another interval to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, remaining, _ := storages[0].Get(context.Background(), "key"); remaining != 30 {
+		t.Errorf("expected 30 remaining, got %d", remaining)
+	}
+}
+
+func TestGossipStorage_Wildcard(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storages := testCluster(t, 3, Config{Addr: ":0"})
+	for i, storage := range storages {
+		for j := 0; j < 5; j++ {
+			if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || !ok {
+				t.Fatalf("storage %d: take %d: %v, %v", i, j, ok, err)
+			}
+		}
+	}
+	waitRemaining(t, storages, "key", 15)
+
+	// senders reporting the same listen address are told apart by their source addresses
+	storage := storages[0]
+	now := storage.now()
+	conns := make([]net.PacketConn, 2)
+	var peers []string
+	for _, peer := range storage.peers {
+		peers = append(peers, peer.String())
+	}
+	for i := range conns {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns[i] = conn
+		peers = append(peers, conn.LocalAddr().String())
+	}
+	if err := storage.SetPeers(peers); err != nil {
+		t.Fatal(err)
+	}
+	for _, conn := range conns {
+		data, err := json.Marshal(map[string]interface{}{
+			"from":     ":7946",
+			"interval": storage.interval,
+			"window":   now - now%storage.interval,
+			"counts":   map[string]uint64{"other": 5},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		to := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: storage.conn.LocalAddr().(*net.UDPAddr).Port}
+		if _, err := conn.WriteTo(data, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitRemaining(t, storages[:1], "other", 20)
+}
+
+func TestGossipStorage_FutureWindow(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storages := testCluster(t, 1, Config{})
+	storage := storages[0]
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := storage.SetPeers([]string{conn.LocalAddr().String()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a message of a far window must not reset the counts
+	if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	now := storage.now()
+	window := now - now%storage.interval
+	data, err := json.Marshal(&message{Interval: storage.interval, Window: window + 5*storage.interval, Counts: map[string]uint64{"key": 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := net.ResolveUDPAddr("udp", storage.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(data, to); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for storage.Stats().Dropped == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected message of a far window to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, remaining, _ := storage.Get(ctx, "key"); remaining != 29 {
+		t.Errorf("expected 29 remaining, got %d", remaining)
+	}
+}
+
+func TestGossipStorage_Peers(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storages := testCluster(t, 2, Config{})
+	storage := storages[0]
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// packets of addresses other than peers are dropped
+	now := storage.now()
+	data, err := json.Marshal(&message{Interval: storage.interval, Window: now - now%storage.interval, Counts: map[string]uint64{"key": 30}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, err := net.ResolveUDPAddr("udp", storage.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.WriteTo(data, to); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for storage.Stats().Dropped == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected message of another address to be dropped")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, remaining, _ := storage.Get(ctx, "key"); remaining != 30 {
+		t.Errorf("expected 30 remaining, got %d", remaining)
+	}
+
+	// removed peers are not reported
+	if _, _, _, _, err := storages[1].Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	waitRemaining(t, storages[:1], "key", 29)
+	if got, want := len(storage.Stats().PeerLag), 1; got != want {
+		t.Errorf("peers: expected %d, got %d", want, got)
+	}
+	if err := storage.SetPeers(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(storage.Stats().PeerLag), 0; got != want {
+		t.Errorf("peers after removal: expected %d, got %d", want, got)
+	}
+}
+
+func TestGossipStorage_NotSupported(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage := testCluster(t, 1, Config{})[0]
+	for name, err := range map[string]error{
+		"set":    storage.Set(ctx, "key", 1, time.Second),
+		"burst":  storage.Burst(ctx, "key", 1),
+		"reset":  storage.Reset(ctx, "key"),
+		"delete": storage.Delete(ctx, "key"),
+	} {
+		if !errors.Is(err, rlstorage.ErrNotSupported) {
+			t.Errorf("%s: expected %v, got %v", name, rlstorage.ErrNotSupported, err)
+		}
+	}
+}
+
+func TestGossipStorage_Close(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewGossipStorage(&Config{Addr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); !errors.Is(err, ErrStoppedFlag) {
+		t.Errorf("expected %v, got %v", ErrStoppedFlag, err)
+	}
+	if _, _, _, _, err := storage.Take(ctx, "key"); !errors.Is(err, rlstorage.ErrStopped) {
+		t.Errorf("expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+	if _, _, err := storage.Get(ctx, "key"); !errors.Is(err, rlstorage.ErrStopped) {
+		t.Errorf("expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+}
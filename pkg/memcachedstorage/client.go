@@ -0,0 +1,285 @@
+package memcachedstorage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrServer wraps ERROR, CLIENT_ERROR and SERVER_ERROR replies of memcached
+	ErrServer = fmt.Errorf("memcached error")
+	// ErrProtocol is returned when a reply could not be parsed
+	ErrProtocol = fmt.Errorf("unexpected memcached reply")
+
+	// errNotStored, errExists and errNotFound are the replies of the storage commands
+	// whose conditions were not met. The connection stays usable after them.
+	errNotStored = fmt.Errorf("not stored")
+	errExists    = fmt.Errorf("exists")
+	errNotFound  = fmt.Errorf("not found")
+)
+
+var crlf = []byte("\r\n")
+
+// item is a value returned by gets
+type item struct {
+	value []byte
+	cas   uint64
+}
+
+// conn is a single connection to memcached speaking the text protocol
+type conn struct {
+	nc net.Conn
+	rw *bufio.ReadWriter
+}
+
+// pool keeps idle connections to a single memcached server
+type pool struct {
+	addr        string
+	dialTimeout time.Duration
+	timeout     time.Duration
+
+	lock   sync.Mutex
+	idle   []*conn
+	max    int
+	closed bool
+}
+
+func newPool(addr string, maxIdle int, dialTimeout, timeout time.Duration) *pool {
+	return &pool{addr: addr, max: maxIdle, dialTimeout: dialTimeout, timeout: timeout}
+}
+
+// get returns an idle connection or dials a new one. Deadline of the connection is set
+// to the deadline of ctx or to the pool timeout.
+func (p *pool) get(ctx context.Context) (*conn, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(p.timeout)
+	}
+
+	p.lock.Lock()
+	var c *conn
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+	}
+	p.lock.Unlock()
+
+	if c == nil {
+		dialer := net.Dialer{Timeout: p.dialTimeout}
+		nc, err := dialer.DialContext(ctx, "tcp", p.addr)
+		if err != nil {
+			return nil, err
+		}
+		c = &conn{nc: nc, rw: bufio.NewReadWriter(bufio.NewReader(nc), bufio.NewWriter(nc))}
+	}
+
+	if err := c.nc.SetDeadline(deadline); err != nil {
+		c.nc.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// put returns c to the pool unless err left it in unknown state
+func (p *pool) put(c *conn, err error) {
+	if err != nil && !resumable(err) {
+		c.nc.Close()
+		return
+	}
+
+	p.lock.Lock()
+	if p.closed || len(p.idle) >= p.max {
+		p.lock.Unlock()
+		c.nc.Close()
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.lock.Unlock()
+}
+
+// close closes idle connections. Connections in use are closed when they are put back.
+func (p *pool) close() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	p.closed = true
+	var err error
+	for _, c := range p.idle {
+		if closeErr := c.nc.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	p.idle = nil
+	return err
+}
+
+// resumable reports whether the connection could be reused after err, i.e. the whole reply was read
+func resumable(err error) bool {
+	return errors.Is(err, errNotStored) || errors.Is(err, errExists) ||
+		errors.Is(err, errNotFound) || errors.Is(err, ErrServer)
+}
+
+// do runs f with a pooled connection
+func (p *pool) do(ctx context.Context, f func(c *conn) error) error {
+	c, err := p.get(ctx)
+	if err != nil {
+		return err
+	}
+	err = f(c)
+	p.put(c, err)
+	return err
+}
+
+// readLine reads a single reply line without CRLF. Error replies are returned as ErrServer.
+func (c *conn) readLine() ([]byte, error) {
+	line, err := c.rw.ReadSlice('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(line, crlf) {
+		return nil, fmt.Errorf("%w: %q", ErrProtocol, line)
+	}
+	line = line[:len(line)-2]
+
+	if bytes.Equal(line, []byte("ERROR")) || bytes.HasPrefix(line, []byte("CLIENT_ERROR ")) ||
+		bytes.HasPrefix(line, []byte("SERVER_ERROR ")) {
+		return nil, fmt.Errorf("%w: %s", ErrServer, line)
+	}
+	return line, nil
+}
+
+// gets returns the items found by keys
+func (c *conn) gets(keys ...string) (map[string]item, error) {
+	if _, err := fmt.Fprintf(c.rw, "gets %s\r\n", strings.Join(keys, " ")); err != nil {
+		return nil, err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return nil, err
+	}
+
+	items := make(map[string]item, len(keys))
+	for {
+		line, err := c.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(line, []byte("END")) {
+			return items, nil
+		}
+
+		// VALUE <key> <flags> <bytes> <cas unique>
+		fields := strings.Fields(string(line))
+		if len(fields) != 5 || fields[0] != "VALUE" {
+			return nil, fmt.Errorf("%w: %q", ErrProtocol, line)
+		}
+		size, err := strconv.Atoi(fields[3])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("%w: %q", ErrProtocol, line)
+		}
+		cas, err := strconv.ParseUint(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %q", ErrProtocol, line)
+		}
+
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(c.rw, value); err != nil {
+			return nil, err
+		}
+		if !bytes.HasSuffix(value, crlf) {
+			return nil, fmt.Errorf("%w: value of %s is not terminated", ErrProtocol, fields[1])
+		}
+		items[fields[1]] = item{value: value[:size], cas: cas}
+	}
+}
+
+// store runs one of set, add or cas commands. cas is used by the cas command only.
+func (c *conn) store(cmd, key string, value []byte, ttl int64, cas uint64) error {
+	var err error
+	if cmd == "cas" {
+		_, err = fmt.Fprintf(c.rw, "cas %s 0 %d %d %d\r\n", key, ttl, len(value), cas)
+	} else {
+		_, err = fmt.Fprintf(c.rw, "%s %s 0 %d %d\r\n", cmd, key, ttl, len(value))
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(value); err != nil {
+		return err
+	}
+	if _, err := c.rw.Write(crlf); err != nil {
+		return err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return err
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	switch string(line) {
+	case "STORED":
+		return nil
+	case "NOT_STORED":
+		return errNotStored
+	case "EXISTS":
+		return errExists
+	case "NOT_FOUND":
+		return errNotFound
+	}
+	return fmt.Errorf("%w: %q", ErrProtocol, line)
+}
+
+// incrDecr runs incr or decr command returning the new value. Memcached does not decrement below zero.
+func (c *conn) incrDecr(cmd, key string, delta uint64) (uint64, error) {
+	if _, err := fmt.Fprintf(c.rw, "%s %s %d\r\n", cmd, key, delta); err != nil {
+		return 0, err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return 0, err
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return 0, err
+	}
+	if string(line) == "NOT_FOUND" {
+		return 0, errNotFound
+	}
+	value, err := strconv.ParseUint(string(line), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrProtocol, line)
+	}
+	return value, nil
+}
+
+// delete removes key
+func (c *conn) delete(key string) error {
+	if _, err := fmt.Fprintf(c.rw, "delete %s\r\n", key); err != nil {
+		return err
+	}
+	if err := c.rw.Flush(); err != nil {
+		return err
+	}
+
+	line, err := c.readLine()
+	if err != nil {
+		return err
+	}
+	switch string(line) {
+	case "DELETED":
+		return nil
+	case "NOT_FOUND":
+		return errNotFound
+	}
+	return fmt.Errorf("%w: %q", ErrProtocol, line)
+}
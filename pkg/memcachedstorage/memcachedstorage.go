@@ -0,0 +1,497 @@
+package memcachedstorage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	rlstorage "pkg/rl-storage"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoppedFlag   = fmt.Errorf("setting stop flag failed")
+	ErrNoAddr        = fmt.Errorf("memcached address is empty")
+	ErrUnknownWindow = fmt.Errorf("unknown window")
+	// ErrContention is returned by Take with WindowSliding when the counter was changed
+	// by other clients on every attempt
+	ErrContention = fmt.Errorf("counter is changed concurrently")
+	ErrBadLimit   = fmt.Errorf("malformed limit item")
+	ErrBadPrefix  = fmt.Errorf("prefix is longer than %d bytes or contains whitespace", maxPrefixLength)
+)
+
+const (
+	// maxKeyLength is the limit of memcached keys
+	maxKeyLength = 250
+	// windowSuffixLength is the maximum length of ":<window start>" appended to counter keys
+	windowSuffixLength = 21
+	// maxPrefixLength keeps the sha1 keys of counters, prefix + kind + "sha1:" + 40 hex digits
+	// + window suffix, within maxKeyLength
+	maxPrefixLength = maxKeyLength - windowSuffixLength - len(kindCounter) - len(sha1Marker) - 2*sha1.Size
+	// maxRelativeTTL is the longest expiration memcached treats as relative, longer ones are unix times
+	maxRelativeTTL = 30 * 24 * 60 * 60
+
+	kindCounter = "c:"
+	kindLimit   = "l:"
+	sha1Marker  = "sha1:"
+)
+
+// Window is the way takes are counted
+type Window int
+
+const (
+	// WindowFixed counts takes per interval aligned to the unix epoch with incr. A take costs
+	// two round trips, three if it is denied. Up to twice the limit could be taken around the
+	// border of two windows.
+	WindowFixed Window = iota
+	// WindowSliding weights the count of the previous window by its part overlapping the last
+	// interval and changes the current count with cas. A take costs two round trips and is
+	// retried when the counter is changed concurrently.
+	WindowSliding
+)
+
+// MemcachedStorage counts takes in memcached with the text protocol.
+//
+// Consistency limits:
+//   - memcached could evict counters under memory pressure or lose them on restart,
+//     the limit is refilled then;
+//   - custom limits set with Set are kept without expiration, but could be evicted too,
+//     the defaults are used then;
+//   - windows are computed with the clock of the client, so clocks of the instances should be in sync;
+//   - the storage talks to a single server. Memcached does not replicate, so if a fleet shards
+//     keys across servers on its own, every key should always go to the same server.
+type MemcachedStorage struct {
+	pool *pool
+
+	tokens     uint64
+	interval   uint64
+	window     Window
+	prefix     string
+	maxRetries int
+
+	// now returns current unix time in nanoseconds, it is replaced by tests
+	now func() uint64
+
+	stopped uint32
+}
+
+// Config is used to NewMemcachedStorage. It setups the MemcachedStorage
+type Config struct {
+	// Addr is the address of memcached, e.g. "localhost:11211". Required.
+	Addr string
+	// Tokens is the default number of tokens per Interval. Default is 1.
+	Tokens uint64
+	// Interval is the default window size. Default is 1 second.
+	Interval time.Duration
+	// Window is the way takes are counted. Default is WindowFixed.
+	Window Window
+	// Prefix is prepended to every memcached key. It should be at most 182 bytes without
+	// whitespace and control characters. Default is "rl:".
+	Prefix string
+	// MaxIdle is the maximum number of idle connections kept in the pool. Default is 8.
+	MaxIdle int
+	// DialTimeout is the timeout of connecting to memcached. Default is 1 second.
+	DialTimeout time.Duration
+	// Timeout is the deadline of every call if its context has none. Default is 1 second.
+	Timeout time.Duration
+	// MaxRetries is the number of cas attempts of a take with WindowSliding. Default is 10.
+	MaxRetries int
+}
+
+func NewMemcachedStorage(cfg *Config) (*MemcachedStorage, error) {
+	if cfg == nil || cfg.Addr == "" {
+		return nil, ErrNoAddr
+	}
+
+	if cfg.Window < WindowFixed || cfg.Window > WindowSliding {
+		return nil, ErrUnknownWindow
+	}
+
+	tokens := uint64(1)
+	if cfg.Tokens > 0 {
+		tokens = cfg.Tokens
+	}
+
+	interval := 1 * time.Second
+	if cfg.Interval > 0 {
+		interval = cfg.Interval
+	}
+
+	prefix := "rl:"
+	if cfg.Prefix != "" {
+		prefix = cfg.Prefix
+	}
+	if len(prefix) > maxPrefixLength || !validKey(prefix) {
+		return nil, ErrBadPrefix
+	}
+
+	maxIdle := 8
+	if cfg.MaxIdle > 0 {
+		maxIdle = cfg.MaxIdle
+	}
+
+	dialTimeout := 1 * time.Second
+	if cfg.DialTimeout > 0 {
+		dialTimeout = cfg.DialTimeout
+	}
+
+	timeout := 1 * time.Second
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout
+	}
+
+	maxRetries := 10
+	if cfg.MaxRetries > 0 {
+		maxRetries = cfg.MaxRetries
+	}
+
+	return &MemcachedStorage{
+		pool:       newPool(cfg.Addr, maxIdle, dialTimeout, timeout),
+		tokens:     tokens,
+		interval:   uint64(interval),
+		window:     cfg.Window,
+		prefix:     prefix,
+		maxRetries: maxRetries,
+		now:        nanoNow,
+	}, nil
+}
+
+func nanoNow() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// key returns memcached key of kind for key. Keys which are too long or contain
+// whitespace or control characters are replaced by their sha1.
+func (storage *MemcachedStorage) key(kind, key string) string {
+	full := storage.prefix + kind + key
+	if len(full) <= maxKeyLength-windowSuffixLength && validKey(full) {
+		return full
+	}
+
+	sum := sha1.Sum([]byte(key))
+	return storage.prefix + kind + sha1Marker + hex.EncodeToString(sum[:])
+}
+
+// validKey returns whether key has no whitespace and control characters
+func validKey(key string) bool {
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// counterKey returns memcached key of the counter of key for the window starting at start
+func (storage *MemcachedStorage) counterKey(key string, start uint64) string {
+	return storage.key(kindCounter, key) + ":" + strconv.FormatUint(start, 10)
+}
+
+// ttl returns the expiration of counters of interval. The counter of a window is kept
+// during the next one, as it is used by WindowSliding.
+func (storage *MemcachedStorage) ttl(interval uint64) int64 {
+	seconds := int64(math.Ceil(float64(2*interval)/float64(time.Second))) + 1
+	if seconds > maxRelativeTTL {
+		return int64(storage.now()/uint64(time.Second)) + seconds
+	}
+	return seconds
+}
+
+// window is the state of a key loaded from memcached
+type window struct {
+	tokens   uint64
+	interval uint64
+	start    uint64
+	// prev and curr are the counts of the previous and current windows
+	prev, curr uint64
+	// currFound is false if the current counter does not exist yet, cas is its cas unique otherwise
+	currFound bool
+	cas       uint64
+}
+
+// used returns the number of tokens taken in the last interval
+func (storage *MemcachedStorage) used(w *window, now uint64) float64 {
+	if storage.window == WindowFixed {
+		return float64(w.curr)
+	}
+
+	overlap := float64(w.interval-(now-w.start)) / float64(w.interval)
+	return float64(w.curr) + float64(w.prev)*overlap
+}
+
+// load reads the limit of key and its counters in a single round trip.
+// If the interval of the key differs from the default one, counters are read once more.
+func (storage *MemcachedStorage) load(c *conn, key string, now uint64) (*window, error) {
+	w := &window{tokens: storage.tokens, interval: storage.interval}
+	w.start = now - now%w.interval
+
+	limitKey := storage.key(kindLimit, key)
+	prevKey, currKey := storage.counterKey(key, w.start-w.interval), storage.counterKey(key, w.start)
+	items, err := c.gets(limitKey, prevKey, currKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit, ok := items[limitKey]; ok {
+		if _, err := fmt.Sscanf(string(limit.value), "%d %d", &w.tokens, &w.interval); err != nil || w.interval == 0 {
+			return nil, fmt.Errorf("%w %s: %q", ErrBadLimit, limitKey, limit.value)
+		}
+
+		if w.interval != storage.interval {
+			w.start = now - now%w.interval
+			prevKey, currKey = storage.counterKey(key, w.start-w.interval), storage.counterKey(key, w.start)
+			if items, err = c.gets(prevKey, currKey); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if w.prev, err = counter(items, prevKey); err != nil {
+		return nil, err
+	}
+	if w.curr, err = counter(items, currKey); err != nil {
+		return nil, err
+	}
+	if curr, ok := items[currKey]; ok {
+		w.currFound, w.cas = true, curr.cas
+	}
+	return w, nil
+}
+
+// counter parses the counter of key in items. Missing counter is zero.
+func counter(items map[string]item, key string) (uint64, error) {
+	it, ok := items[key]
+	if !ok {
+		return 0, nil
+	}
+
+	// incr and decr could leave trailing spaces
+	value := it.value
+	for len(value) > 0 && value[len(value)-1] == ' ' {
+		value = value[:len(value)-1]
+	}
+	count, err := strconv.ParseUint(string(value), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: counter %s is %q", ErrProtocol, key, it.value)
+	}
+	return count, nil
+}
+
+// Take attempts to remove a token from key. If take is successful, it returns true.
+// Returns tokens limit, remaining tokens count, reset time, success flag and error.
+func (storage *MemcachedStorage) Take(ctx context.Context, key string) (limit, remaining, reset uint64, ok bool, err error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, 0, false, rlstorage.ErrStopped
+	}
+
+	err = storage.pool.do(ctx, func(c *conn) error {
+		if storage.window == WindowFixed {
+			limit, remaining, reset, ok, err = storage.takeFixed(c, key)
+		} else {
+			limit, remaining, reset, ok, err = storage.takeSliding(c, key)
+		}
+		return err
+	})
+	if err != nil && !errors.Is(err, ErrContention) {
+		err = fmt.Errorf("failed to take: %w", err)
+	}
+	return limit, remaining, reset, ok, err
+}
+
+// takeFixed increments the counter of the current window creating it with add if needed.
+// Denied takes are given back, so Burst adds exactly the given tokens.
+func (storage *MemcachedStorage) takeFixed(c *conn, key string) (uint64, uint64, uint64, bool, error) {
+	now := storage.now()
+	w, err := storage.load(c, key, now)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	reset := w.start + w.interval
+	currKey := storage.counterKey(key, w.start)
+
+	count, err := c.incrDecr("incr", currKey, 1)
+	if errors.Is(err, errNotFound) {
+		count, err = 1, c.store("add", currKey, []byte("1"), storage.ttl(w.interval), 0)
+		if errors.Is(err, errNotStored) {
+			// added concurrently
+			count, err = c.incrDecr("incr", currKey, 1)
+		}
+	}
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+
+	if count > w.tokens {
+		if _, err := c.incrDecr("decr", currKey, 1); err != nil && !errors.Is(err, errNotFound) {
+			return 0, 0, 0, false, err
+		}
+		return w.tokens, 0, reset, false, nil
+	}
+	return w.tokens, w.tokens - count, reset, true, nil
+}
+
+// takeSliding increments the counter of the current window with cas if the weighted
+// count of the last interval allows it
+func (storage *MemcachedStorage) takeSliding(c *conn, key string) (uint64, uint64, uint64, bool, error) {
+	for attempt := 0; attempt < storage.maxRetries; attempt++ {
+		now := storage.now()
+		w, err := storage.load(c, key, now)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		reset := w.start + w.interval
+
+		used := storage.used(w, now)
+		if used+1 > float64(w.tokens) {
+			return w.tokens, 0, reset, false, nil
+		}
+
+		currKey := storage.counterKey(key, w.start)
+		if w.currFound {
+			err = c.store("cas", currKey, []byte(strconv.FormatUint(w.curr+1, 10)), storage.ttl(w.interval), w.cas)
+		} else {
+			err = c.store("add", currKey, []byte("1"), storage.ttl(w.interval), 0)
+		}
+		switch {
+		case err == nil:
+			return w.tokens, uint64(float64(w.tokens) - used - 1), reset, true, nil
+		case errors.Is(err, errExists), errors.Is(err, errNotFound), errors.Is(err, errNotStored):
+			continue
+		default:
+			return 0, 0, 0, false, err
+		}
+	}
+	return 0, 0, 0, false, ErrContention
+}
+
+// Get returns the limit and the remaining tokens of key
+func (storage *MemcachedStorage) Get(ctx context.Context, key string) (limit, remaining uint64, err error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, rlstorage.ErrStopped
+	}
+
+	err = storage.pool.do(ctx, func(c *conn) error {
+		now := storage.now()
+		w, err := storage.load(c, key, now)
+		if err != nil {
+			return err
+		}
+
+		limit = w.tokens
+		if used := storage.used(w, now); used < float64(w.tokens) {
+			remaining = uint64(float64(w.tokens) - used)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to get: %w", err)
+	}
+	return limit, remaining, nil
+}
+
+// Set stores the limit of key without expiration. Counting starts over if the interval changes.
+func (storage *MemcachedStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+	if interval <= 0 {
+		interval = time.Duration(storage.interval)
+	}
+
+	value := []byte(fmt.Sprintf("%d %d", tokens, uint64(interval)))
+	err := storage.pool.do(ctx, func(c *conn) error {
+		return c.store("set", storage.key(kindLimit, key), value, 0, 0)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set: %w", err)
+	}
+	return nil
+}
+
+// Burst gives back up to tokens taken in the current window. With WindowSliding the count
+// of the previous window is kept.
+func (storage *MemcachedStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	err := storage.pool.do(ctx, func(c *conn) error {
+		w, err := storage.load(c, key, storage.now())
+		if err != nil {
+			return err
+		}
+		if !w.currFound {
+			return nil
+		}
+
+		if _, err := c.incrDecr("decr", storage.counterKey(key, w.start), tokens); err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to burst: %w", err)
+	}
+	return nil
+}
+
+// Reset removes the counters of key. The limit set with Set is kept.
+func (storage *MemcachedStorage) Reset(ctx context.Context, key string) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	if err := storage.pool.do(ctx, func(c *conn) error {
+		return storage.reset(c, key)
+	}); err != nil {
+		return fmt.Errorf("failed to reset: %w", err)
+	}
+	return nil
+}
+
+func (storage *MemcachedStorage) reset(c *conn, key string) error {
+	w, err := storage.load(c, key, storage.now())
+	if err != nil {
+		return err
+	}
+
+	for _, start := range []uint64{w.start - w.interval, w.start} {
+		if err := c.delete(storage.counterKey(key, start)); err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Delete removes the counters and the limit of key
+func (storage *MemcachedStorage) Delete(ctx context.Context, key string) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	err := storage.pool.do(ctx, func(c *conn) error {
+		if err := storage.reset(c, key); err != nil {
+			return err
+		}
+		if err := c.delete(storage.key(kindLimit, key)); err != nil && !errors.Is(err, errNotFound) {
+			return err
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete key: %w", err)
+	}
+	return nil
+}
+
+// Close closes the pooled connections
+func (storage *MemcachedStorage) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
+		return ErrStoppedFlag
+	}
+	return storage.pool.close()
+}
@@ -0,0 +1,419 @@
+package memcachedstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	rlstorage "pkg/rl-storage"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClock is the time shared by the storage and the test server
+type testClock struct {
+	now uint64
+}
+
+func (clock *testClock) nanos() uint64 {
+	return atomic.LoadUint64(&clock.now)
+}
+
+func (clock *testClock) seconds() int64 {
+	return int64(clock.nanos() / uint64(time.Second))
+}
+
+func (clock *testClock) add(d time.Duration) {
+	atomic.AddUint64(&clock.now, uint64(d))
+}
+
+// testStorage returns the storage connected to a new test server. If clock is not nil,
+// both of them use it.
+func testStorage(tb testing.TB, cfg *Config, clock *testClock) (*MemcachedStorage, *testServer) {
+	tb.Helper()
+
+	server := newTestServer(tb)
+	cfg.Addr = server.Addr()
+	storage, err := NewMemcachedStorage(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if clock != nil {
+		storage.now = clock.nanos
+		server.now = clock.seconds
+	}
+
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return storage, server
+}
+
+func TestMemcachedStorage_New(t *testing.T) {
+	t.Parallel()
+
+	for _, cfg := range []*Config{nil, {}} {
+		if _, err := NewMemcachedStorage(cfg); !errors.Is(err, ErrNoAddr) {
+			t.Errorf("expected %v, got %v", ErrNoAddr, err)
+		}
+	}
+	if _, err := NewMemcachedStorage(&Config{Addr: "localhost:11211", Window: 5}); !errors.Is(err, ErrUnknownWindow) {
+		t.Errorf("expected %v, got %v", ErrUnknownWindow, err)
+	}
+	for _, prefix := range []string{strings.Repeat("p", maxPrefixLength+1), "rate limit:"} {
+		if _, err := NewMemcachedStorage(&Config{Addr: "localhost:11211", Prefix: prefix}); !errors.Is(err, ErrBadPrefix) {
+			t.Errorf("prefix %q: expected %v, got %v", prefix, ErrBadPrefix, err)
+		}
+	}
+
+	// sha1 keys of the longest prefix fit memcached with the window suffix
+	storage, err := NewMemcachedStorage(&Config{Addr: "localhost:11211", Prefix: strings.Repeat("p", maxPrefixLength)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := storage.counterKey("with space", math.MaxUint64); len(got) > maxKeyLength {
+		t.Errorf("expected key of at most %d bytes, got %d", maxKeyLength, len(got))
+	}
+}
+
+func TestMemcachedStorage_Fixed(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	// in the middle of a window
+	clock := &testClock{now: uint64(1000*time.Second + 500*time.Millisecond)}
+	storage, _ := testStorage(t, &Config{Tokens: 3, Interval: time.Second}, clock)
+	reset := uint64(1001 * time.Second)
+
+	for i := uint64(0); i < 3; i++ {
+		limit, remaining, next, ok, err := storage.Take(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || limit != 3 || remaining != 2-i || next != reset {
+			t.Errorf("take %d: unexpected %v, %d of %d, reset %d", i, ok, remaining, limit, next)
+		}
+	}
+	if _, remaining, next, ok, err := storage.Take(ctx, "key"); err != nil || ok || remaining != 0 || next != reset {
+		t.Errorf("expected denial, got %v, %d, reset %d, %v", ok, remaining, next, err)
+	}
+
+	// denied takes are given back
+	if err := storage.Burst(ctx, "key", 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 2 {
+		t.Errorf("expected 2 remaining after burst, got %d, %v", remaining, err)
+	}
+
+	if err := storage.Reset(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 3 {
+		t.Errorf("expected 3 remaining after reset, got %d, %v", remaining, err)
+	}
+
+	// the next window starts from zero
+	for i := 0; i < 3; i++ {
+		if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.add(time.Second)
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 3 {
+		t.Errorf("expected 3 remaining in the next window, got %d, %v", remaining, err)
+	}
+
+	// missing keys do not fail
+	if err := storage.Burst(ctx, "missing", 1); err != nil {
+		t.Error(err)
+	}
+	if err := storage.Reset(ctx, "missing"); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMemcachedStorage_Sliding(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := &testClock{now: uint64(1000 * time.Second)}
+	storage, _ := testStorage(t, &Config{Tokens: 10, Interval: 10 * time.Second, Window: WindowSliding}, clock)
+
+	for i := 0; i < 10; i++ {
+		if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || !ok {
+			t.Fatalf("take %d: expected success, got %v, %v", i, ok, err)
+		}
+	}
+	if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || ok {
+		t.Errorf("expected denial, got %v, %v", ok, err)
+	}
+
+	// half of the previous window overlaps the last interval
+	clock.add(15 * time.Second)
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 5 {
+		t.Errorf("expected 5 remaining, got %d, %v", remaining, err)
+	}
+	for i := uint64(0); i < 5; i++ {
+		_, remaining, reset, ok, err := storage.Take(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !ok || remaining != 4-i || reset != uint64(1020*time.Second) {
+			t.Errorf("take %d: unexpected %v, %d, reset %d", i, ok, remaining, reset)
+		}
+	}
+	if _, _, _, ok, err := storage.Take(ctx, "key"); err != nil || ok {
+		t.Errorf("expected denial, got %v, %v", ok, err)
+	}
+
+	// burst gives back the tokens of the current window only
+	if err := storage.Burst(ctx, "key", 100); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 5 {
+		t.Errorf("expected 5 remaining after burst, got %d, %v", remaining, err)
+	}
+
+	// both windows are reset
+	if err := storage.Reset(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := storage.Get(ctx, "key"); err != nil || remaining != 10 {
+		t.Errorf("expected 10 remaining after reset, got %d, %v", remaining, err)
+	}
+}
+
+func TestMemcachedStorage_Concurrent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for name, window := range map[string]Window{"fixed": WindowFixed, "sliding": WindowSliding} {
+		window := window
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			const tokens = 50
+			storage, server := testStorage(t, &Config{Tokens: tokens, Interval: time.Hour, Window: window, MaxRetries: 1000}, nil)
+
+			var allowed uint64
+			var wg sync.WaitGroup
+			for i := 0; i < 20; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 10; j++ {
+						_, _, _, ok, err := storage.Take(ctx, "key")
+						if err != nil {
+							t.Error(err)
+							return
+						}
+						if ok {
+							atomic.AddUint64(&allowed, 1)
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			if got := atomic.LoadUint64(&allowed); got != tokens {
+				t.Errorf("expected %d allowed takes, got %d", tokens, got)
+			}
+			// connections are reused
+			if conns := atomic.LoadUint64(&server.conns); conns > 20 {
+				t.Errorf("expected 20 connections at most, got %d", conns)
+			}
+		})
+	}
+}
+
+func TestMemcachedStorage_Pool(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, server := testStorage(t, &Config{Tokens: 100, MaxIdle: 1}, nil)
+	for i := 0; i < 10; i++ {
+		if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if conns := atomic.LoadUint64(&server.conns); conns != 1 {
+		t.Errorf("expected 1 connection, got %d", conns)
+	}
+
+	// misses and server errors keep the connection
+	server.set("rl:c:broken:0", "x")
+	c, err := storage.pool.get(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.incrDecr("incr", "missing", 1); !errors.Is(err, errNotFound) {
+		t.Errorf("expected %v, got %v", errNotFound, err)
+	}
+	_, err = c.incrDecr("incr", "rl:c:broken:0", 1)
+	if !errors.Is(err, ErrServer) {
+		t.Errorf("expected %v, got %v", ErrServer, err)
+	}
+	storage.pool.put(c, err)
+	if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if conns := atomic.LoadUint64(&server.conns); conns != 1 {
+		t.Errorf("expected 1 connection, got %d", conns)
+	}
+}
+
+func TestMemcachedStorage_SetDelete(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for name, window := range map[string]Window{"fixed": WindowFixed, "sliding": WindowSliding} {
+		window := window
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+
+			clock := &testClock{now: uint64(1000 * time.Second)}
+			storage, _ := testStorage(t, &Config{Tokens: 1, Interval: time.Second, Window: window}, clock)
+
+			if err := storage.Set(ctx, "key", 2, time.Minute); err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 2; i++ {
+				if _, _, reset, ok, err := storage.Take(ctx, "key"); err != nil || !ok || reset != uint64(1020*time.Second) {
+					t.Fatalf("take %d: expected success until 1020s, got %v, %d, %v", i, ok, reset, err)
+				}
+			}
+			if limit, _, _, ok, err := storage.Take(ctx, "key"); err != nil || ok || limit != 2 {
+				t.Errorf("expected denial of 2, got %v of %d, %v", ok, limit, err)
+			}
+
+			// reset keeps the limit
+			if err := storage.Reset(ctx, "key"); err != nil {
+				t.Fatal(err)
+			}
+			if limit, remaining, err := storage.Get(ctx, "key"); err != nil || limit != 2 || remaining != 2 {
+				t.Errorf("expected 2 of 2 after reset, got %d of %d, %v", remaining, limit, err)
+			}
+
+			if err := storage.Delete(ctx, "key"); err != nil {
+				t.Fatal(err)
+			}
+			if limit, remaining, err := storage.Get(ctx, "key"); err != nil || limit != 1 || remaining != 1 {
+				t.Errorf("expected defaults after delete, got %d of %d, %v", remaining, limit, err)
+			}
+			if err := storage.Delete(ctx, "key"); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func TestMemcachedStorage_Expiration(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	clock := &testClock{now: uint64(1000 * time.Second)}
+	storage, server := testStorage(t, &Config{Tokens: 1, Interval: 10 * time.Second}, clock)
+	if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	server.lock.Lock()
+	it, ok := server.items["rl:c:key:"+fmt.Sprint(uint64(1000*time.Second))]
+	server.lock.Unlock()
+	if !ok {
+		t.Fatal("expected counter")
+	}
+	if want := int64(1000 + 21); it.expires != want {
+		t.Errorf("expected expiration at %d, got %d", want, it.expires)
+	}
+
+	// expirations longer than 30 days are unix times
+	if got, want := storage.ttl(uint64(30*24*time.Hour)), int64(1000+60*24*60*60+1); got != want {
+		t.Errorf("expected ttl %d, got %d", want, got)
+	}
+}
+
+func TestMemcachedStorage_Keys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, _ := testStorage(t, &Config{Tokens: 1, Interval: time.Hour, Prefix: "test:"}, nil)
+	keys := []string{"with space", "with\nnewline", strings.Repeat("a", 300), strings.Repeat("a", 301)}
+	for _, key := range keys {
+		if _, _, _, ok, err := storage.Take(ctx, key); err != nil || !ok {
+			t.Errorf("%q: expected success, got %v, %v", key, ok, err)
+		}
+	}
+	for _, key := range keys {
+		if _, remaining, err := storage.Get(ctx, key); err != nil || remaining != 0 {
+			t.Errorf("%q: expected 0 remaining, got %d, %v", key, remaining, err)
+		}
+	}
+
+	if got := storage.key(kindCounter, "plain"); got != "test:c:plain" {
+		t.Errorf("expected plain key, got %q", got)
+	}
+	if got := storage.key(kindCounter, "with space"); !strings.HasPrefix(got, "test:c:sha1:") {
+		t.Errorf("expected hashed key, got %q", got)
+	}
+}
+
+func TestMemcachedStorage_Errors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, server := testStorage(t, &Config{}, nil)
+	server.set("rl:l:key", "garbage")
+	if _, _, _, _, err := storage.Take(ctx, "key"); !errors.Is(err, ErrBadLimit) {
+		t.Errorf("expected %v, got %v", ErrBadLimit, err)
+	}
+
+	server.listener.Close()
+	storage.pool.close()
+	if _, _, _, _, err := storage.Take(ctx, "other"); err == nil {
+		t.Error("expected error with server down")
+	}
+}
+
+func TestMemcachedStorage_Close(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	server := newTestServer(t)
+	storage, err := NewMemcachedStorage(&Config{Addr: server.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := storage.Take(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); !errors.Is(err, ErrStoppedFlag) {
+		t.Errorf("expected %v, got %v", ErrStoppedFlag, err)
+	}
+
+	if _, _, _, _, err := storage.Take(ctx, "key"); !errors.Is(err, rlstorage.ErrStopped) {
+		t.Errorf("expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+	if _, _, err := storage.Get(ctx, "key"); !errors.Is(err, rlstorage.ErrStopped) {
+		t.Errorf("expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+	for name, err := range map[string]error{
+		"set":    storage.Set(ctx, "key", 1, time.Second),
+		"burst":  storage.Burst(ctx, "key", 1),
+		"reset":  storage.Reset(ctx, "key"),
+		"delete": storage.Delete(ctx, "key"),
+	} {
+		if !errors.Is(err, rlstorage.ErrStopped) {
+			t.Errorf("%s: expected %v, got %v", name, rlstorage.ErrStopped, err)
+		}
+	}
+}
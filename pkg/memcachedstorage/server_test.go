@@ -0,0 +1,206 @@
+package memcachedstorage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testServer is an in-process stand-in of memcached implementing the commands used by the storage
+type testServer struct {
+	listener net.Listener
+
+	lock  sync.Mutex
+	items map[string]*testItem
+	cas   uint64
+	// now returns the unix time in seconds used for expiration
+	now func() int64
+
+	// conns is the number of accepted connections
+	conns uint64
+}
+
+type testItem struct {
+	value   []byte
+	cas     uint64
+	expires int64
+}
+
+func newTestServer(tb testing.TB) *testServer {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	server := &testServer{
+		listener: l,
+		items:    make(map[string]*testItem),
+		now:      func() int64 { return time.Now().Unix() },
+	}
+	go server.serve()
+	tb.Cleanup(func() { l.Close() })
+	return server
+}
+
+func (server *testServer) Addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *testServer) serve() {
+	for {
+		c, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddUint64(&server.conns, 1)
+		go server.handle(c)
+	}
+}
+
+// item returns the unexpired item of key. server.lock should be held.
+func (server *testServer) item(key string) (*testItem, bool) {
+	it, ok := server.items[key]
+	if ok && it.expires != 0 && it.expires <= server.now() {
+		delete(server.items, key)
+		return nil, false
+	}
+	return it, ok
+}
+
+// expires converts memcached expiration to unix time
+func (server *testServer) expires(ttl int64) int64 {
+	if ttl == 0 || ttl > maxRelativeTTL {
+		return ttl
+	}
+	return server.now() + ttl
+}
+
+func (server *testServer) handle(c net.Conn) {
+	defer c.Close()
+	r, w := bufio.NewReader(c), bufio.NewWriter(c)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			fmt.Fprint(w, "ERROR\r\n")
+			w.Flush()
+			continue
+		}
+
+		switch cmd := fields[0]; cmd {
+		case "get", "gets":
+			server.lock.Lock()
+			for _, key := range fields[1:] {
+				if it, ok := server.item(key); ok {
+					fmt.Fprintf(w, "VALUE %s 0 %d %d\r\n%s\r\n", key, len(it.value), it.cas, it.value)
+				}
+			}
+			server.lock.Unlock()
+			fmt.Fprint(w, "END\r\n")
+
+		case "set", "add", "cas":
+			if len(fields) < 5 {
+				fmt.Fprint(w, "ERROR\r\n")
+				break
+			}
+			ttl, _ := strconv.ParseInt(fields[3], 10, 64)
+			size, _ := strconv.Atoi(fields[4])
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			value = value[:size]
+			var cas uint64
+			if cmd == "cas" && len(fields) > 5 {
+				cas, _ = strconv.ParseUint(fields[5], 10, 64)
+			}
+			fmt.Fprintf(w, "%s\r\n", server.store(cmd, fields[1], value, ttl, cas))
+
+		case "incr", "decr":
+			delta, _ := strconv.ParseUint(fields[2], 10, 64)
+			fmt.Fprintf(w, "%s\r\n", server.incrDecr(cmd, fields[1], delta))
+
+		case "delete":
+			server.lock.Lock()
+			if _, ok := server.item(fields[1]); ok {
+				delete(server.items, fields[1])
+				fmt.Fprint(w, "DELETED\r\n")
+			} else {
+				fmt.Fprint(w, "NOT_FOUND\r\n")
+			}
+			server.lock.Unlock()
+
+		default:
+			fmt.Fprint(w, "ERROR\r\n")
+		}
+		if err := w.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func (server *testServer) store(cmd, key string, value []byte, ttl int64, cas uint64) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	it, ok := server.item(key)
+	switch {
+	case cmd == "add" && ok:
+		return "NOT_STORED"
+	case cmd == "cas" && !ok:
+		return "NOT_FOUND"
+	case cmd == "cas" && it.cas != cas:
+		return "EXISTS"
+	}
+
+	server.cas++
+	server.items[key] = &testItem{value: value, cas: server.cas, expires: server.expires(ttl)}
+	return "STORED"
+}
+
+func (server *testServer) incrDecr(cmd, key string, delta uint64) string {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+
+	it, ok := server.item(key)
+	if !ok {
+		return "NOT_FOUND"
+	}
+	value, err := strconv.ParseUint(string(it.value), 10, 64)
+	if err != nil {
+		return "CLIENT_ERROR cannot increment or decrement non-numeric value"
+	}
+
+	if cmd == "incr" {
+		value += delta
+	} else if delta > value {
+		value = 0
+	} else {
+		value -= delta
+	}
+
+	server.cas++
+	it.value, it.cas = []byte(strconv.FormatUint(value, 10)), server.cas
+	return string(it.value)
+}
+
+// set stores value of key directly
+func (server *testServer) set(key, value string) {
+	server.lock.Lock()
+	server.cas++
+	server.items[key] = &testItem{value: []byte(value), cas: server.cas}
+	server.lock.Unlock()
+}
@@ -2,6 +2,7 @@ package memstorage
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -27,6 +28,10 @@ func availableTokens(lastTick, currentTick, max uint64, fillRate float64) uint64
 
 // bucket is supposed to be internal usage only implementation of leaky bucket
 type bucket struct {
+	// accessed is the time of the last take in nanoseconds from epoch. It is used to find
+	// the least recently used bucket, so it is accessed atomically without lock.
+	// It is the first field to be 64-bit aligned for atomic operations.
+	accessed uint64
 	// startTime is the number of nanoseconds from epoch when the bucket was  created.
 	startTime uint64
 	// maxTokens is the maximum number of tokens available for this bucket at any time.
@@ -47,9 +52,10 @@ type bucket struct {
 }
 
 func newBucket(tokens uint64, interval time.Duration) *bucket {
+	now := nanoNow()
 	b := &bucket{
-
-		startTime:       nanoNow(),
+		accessed:        now,
+		startTime:       now,
 		maxTokens:       tokens,
 		interval:        interval,
 		fillRate:        float64(interval) / float64(tokens),
@@ -59,28 +65,34 @@ func newBucket(tokens uint64, interval time.Duration) *bucket {
 	return b
 }
 
-// get returns info about the bucket
-func (b *bucket) get() (tokens uint64, remaining uint64, err error) {
-	b.lock.Lock()
-	defer b.lock.Unlock()
+// get returns info about the bucket. Remaining tokens are reported as if the bucket
+// was refilled at the current tick, but the bucket itself is not changed.
+func (b *bucket) get() (tokens uint64, remaining uint64, reset uint64) {
+	now := nanoNow()
+	currentTick := tick(b.startTime, now, b.interval)
 
 	tokens = b.maxTokens
+	reset = b.startTime + ((currentTick + 1) * uint64(b.interval))
+
+	b.lock.Lock()
 	remaining = b.availableTokens
+	if b.lastTick < currentTick {
+		remaining = availableTokens(b.lastTick, currentTick, b.maxTokens, b.fillRate)
+	}
+	b.lock.Unlock()
 	return
 }
 
 func (b *bucket) take() (tokens uint64, remaining uint64, reset uint64, ok bool, err error) {
 	now := nanoNow()
+	atomic.StoreUint64(&b.accessed, now)
 	currentTick := tick(b.startTime, now, b.interval)
 
 	tokens = b.maxTokens
 	reset = b.startTime + ((currentTick + 1) * uint64(b.interval))
 
 	b.lock.Lock()
-	if b.lastTick < currentTick {
-		b.availableTokens = availableTokens(b.lastTick, currentTick, b.maxTokens, b.fillRate)
-		b.lastTick = currentTick
-	}
+	b.refill(currentTick)
 
 	if b.availableTokens > 0 {
 		b.availableTokens--
@@ -91,3 +103,11 @@ func (b *bucket) take() (tokens uint64, remaining uint64, reset uint64, ok bool,
 	b.lock.Unlock()
 	return
 }
+
+// refill adds the tokens for the ticks passed since the last refill. b.lock should be held.
+func (b *bucket) refill(currentTick uint64) {
+	if b.lastTick < currentTick {
+		b.availableTokens = availableTokens(b.lastTick, currentTick, b.maxTokens, b.fillRate)
+		b.lastTick = currentTick
+	}
+}
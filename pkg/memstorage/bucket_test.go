@@ -62,6 +62,7 @@ func TestBucket_tick(t *testing.T) {
 	}
 
 	for _, c := range cases {
+		c := c
 		t.Run(c.name, func(t *testing.T) {
 			t.Parallel()
 			if got, want := tick(c.start, c.current, c.interval), c.expected; got != want {
@@ -110,6 +111,7 @@ func TestBucket_availableTokens(t *testing.T) {
 	}
 
 	for _, c := range cases {
+		c := c
 		t.Run(c.name, func(t *testing.T) {
 			t.Parallel()
 			if got, want := availableTokens(c.last, c.current, c.max, c.fillRate), c.expected; got != want {
@@ -4,13 +4,27 @@ import (
 	"context"
 	"fmt"
 	rlstorage "pkg/rl-storage"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
 var (
-	ErrStoppedFlag = fmt.Errorf("setting stop flag failed")
+	ErrStoppedFlag     = fmt.Errorf("setting stop flag failed")
+	ErrUnknownOverflow = fmt.Errorf("unknown overflow policy")
+)
+
+// OverflowPolicy is what MemStorage does with a key seen first time when it holds MaxKeys buckets
+type OverflowPolicy int
+
+const (
+	// OverflowEvict evicts the least recently used bucket to make room for the new one
+	OverflowEvict OverflowPolicy = iota
+	// OverflowDeny denies new keys until purge or eviction makes room. Known keys are not affected.
+	OverflowDeny
+	// OverflowShared limits all new keys with a single shared bucket of the default limit
+	OverflowShared
 )
 
 type MemStorage struct {
@@ -19,9 +33,20 @@ type MemStorage struct {
 
 	sweepInterval time.Duration
 	sweepMinTTL   uint64
+	purgeHook     func(elapsed time.Duration, evicted int)
+
+	shards []*shard
+	mask   uint32
 
-	buckets    map[string]*bucket
-	bucketLock sync.RWMutex
+	shardMaxKeys int
+	overflow     OverflowPolicy
+	shared       *bucket
+	onEvict      func(key string)
+	onOverflow   func(key string)
+
+	snapshotPath    string
+	snapshotLock    sync.Mutex
+	onSnapshotError func(err error)
 
 	stopped  uint32
 	stopChan chan struct{}
@@ -43,8 +68,34 @@ type Config struct {
 	SweepMinTTL time.Duration
 	// InitAlloc is the size to use for mem map. The buffer would be expanded
 	// by compiler, but bigger values could trade memory for performance.
-	// Default is 4096.
+	// Default is 4096. It is split evenly between shards.
 	InitAlloc int
+	// Shards is the number of lock-striped segments of the buckets map. It is rounded
+	// up to a power of two. More shards reduce lock contention of first-seen keys and
+	// purge under high key cardinality. Default is 32.
+	Shards int
+	// PurgeHook is called after each purge sweep with its duration and the number
+	// of evicted buckets. It could be used to collect metrics.
+	PurgeHook func(elapsed time.Duration, evicted int)
+	// MaxKeys bounds the number of buckets, so random keys could not exhaust memory.
+	// It is split evenly between shards, so a shard could be full while the total is lower.
+	// Zero means unbounded. Default is 0.
+	MaxKeys int
+	// Overflow is the policy for new keys when MaxKeys is reached. Set and Burst always evict.
+	// Default is OverflowEvict.
+	Overflow OverflowPolicy
+	// OnEvict is called with the key evicted to keep MaxKeys. Purged keys are reported by PurgeHook.
+	OnEvict func(key string)
+	// OnOverflow is called with the key denied or limited by the shared bucket because of MaxKeys.
+	OnOverflow func(key string)
+	// SnapshotPath is the file the buckets are restored from by NewMemStorage and written to
+	// by Close, so limits survive restarts. Empty disables snapshots. Default is "".
+	SnapshotPath string
+	// SnapshotInterval is the rate at which the snapshot is written to SnapshotPath
+	// while the storage runs. Zero writes it only on Close. Default is 0.
+	SnapshotInterval time.Duration
+	// OnSnapshotError is called with the errors of periodic snapshots.
+	OnSnapshotError func(err error)
 }
 
 func NewMemStorage(cfg *Config) (*MemStorage, error) {
@@ -77,20 +128,59 @@ func NewMemStorage(cfg *Config) (*MemStorage, error) {
 		initAlloc = cfg.InitAlloc
 	}
 
+	shards := 32
+	if cfg.Shards > 0 {
+		shards = shardCount(cfg.Shards)
+	}
+
+	if cfg.Overflow < OverflowEvict || cfg.Overflow > OverflowShared {
+		return nil, ErrUnknownOverflow
+	}
+
+	shardMaxKeys := 0
+	if cfg.MaxKeys > 0 {
+		shardMaxKeys = (cfg.MaxKeys + shards - 1) / shards
+	}
+
 	storage := &MemStorage{
 		tokens:        tokens,
 		interval:      interval,
 		sweepInterval: sweepInterval,
 		sweepMinTTL:   uint64(sweepMinTTL),
-		buckets:       make(map[string]*bucket, initAlloc),
+		purgeHook:     cfg.PurgeHook,
+		shards:        make([]*shard, shards),
+		mask:          uint32(shards - 1),
+		shardMaxKeys:  shardMaxKeys,
+		overflow:      cfg.Overflow,
+		onEvict:       cfg.OnEvict,
+		onOverflow:    cfg.OnOverflow,
+		snapshotPath:  cfg.SnapshotPath,
 		stopChan:      make(chan struct{}),
+
+		onSnapshotError: cfg.OnSnapshotError,
+	}
+	if cfg.Overflow == OverflowShared {
+		storage.shared = newBucket(tokens, interval)
+	}
+	for i := range storage.shards {
+		storage.shards[i] = newShard(initAlloc / shards)
+	}
+
+	if storage.snapshotPath != "" {
+		if err := storage.RestoreFile(storage.snapshotPath); err != nil {
+			return nil, fmt.Errorf("restoring snapshot %s: %w", storage.snapshotPath, err)
+		}
+		if cfg.SnapshotInterval > 0 {
+			go storage.snapshots(cfg.SnapshotInterval)
+		}
 	}
 
 	go storage.purge()
 	return storage, nil
 }
 
-// Close releases consumed memory and tickers
+// Close releases consumed memory and tickers. If SnapshotPath is set, the snapshot
+// is written before the buckets are released.
 func (storage *MemStorage) Close(ctx context.Context) error {
 	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
 		return ErrStoppedFlag
@@ -98,16 +188,24 @@ func (storage *MemStorage) Close(ctx context.Context) error {
 
 	close(storage.stopChan)
 
-	storage.bucketLock.Lock()
-	for key := range storage.buckets {
-		delete(storage.buckets, key)
+	var err error
+	if storage.snapshotPath != "" {
+		err = storage.SnapshotFile(storage.snapshotPath)
 	}
-	storage.bucketLock.Unlock()
-	return nil
+
+	for _, shard := range storage.shards {
+		shard.lock.Lock()
+		for key := range shard.buckets {
+			delete(shard.buckets, key)
+		}
+		shard.lock.Unlock()
+	}
+	return err
 }
 
 // purge is used to continually iterate over the buckets map and purge old values
-// on the sweepInterval
+// on the sweepInterval. Shards are swept one at a time, so Take is blocked only
+// for the keys of the shard being swept.
 func (storage *MemStorage) purge() {
 	ticker := time.NewTicker(storage.sweepInterval)
 	defer ticker.Stop()
@@ -119,21 +217,42 @@ func (storage *MemStorage) purge() {
 		case <-ticker.C:
 		}
 
-		storage.bucketLock.Lock()
-		now := nanoNow()
-		for key, bucket := range storage.buckets {
-			bucket.lock.Lock()
-			lastTime := bucket.startTime + (bucket.lastTick * uint64(bucket.interval))
-			bucket.lock.Unlock()
+		start := time.Now()
+		evicted := 0
 
-			if now-lastTime > storage.sweepMinTTL {
-				delete(storage.buckets, key)
+		for _, shard := range storage.shards {
+			select {
+			case <-storage.stopChan:
+				return
+			default:
 			}
+
+			evicted += shard.purge(nanoNow(), storage.sweepMinTTL)
+		}
+
+		// hook is called without lock so it could safely call Len
+		if storage.purgeHook != nil {
+			storage.purgeHook(time.Since(start), evicted)
 		}
-		storage.bucketLock.Unlock()
 	}
 }
 
+// Len returns the number of buckets currently held by the storage
+func (storage *MemStorage) Len() int {
+	n := 0
+	for _, shard := range storage.shards {
+		shard.lock.RLock()
+		n += len(shard.buckets)
+		shard.lock.RUnlock()
+	}
+	return n
+}
+
+// shard returns the shard holding key
+func (storage *MemStorage) shard(key string) *shard {
+	return storage.shards[hashKey(key)&storage.mask]
+}
+
 // Take attempts to remove a token from key. If take is successful, it returns true.
 // Returns tokens limit, remaining tokens count, reset time, success flag and error.
 func (storage *MemStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
@@ -141,66 +260,220 @@ func (storage *MemStorage) Take(ctx context.Context, key string) (uint64, uint64
 		return 0, 0, 0, false, rlstorage.ErrStopped
 	}
 
+	bucket := storage.bucket(key)
+	if bucket == nil {
+		limit, remaining, reset := storage.denied()
+		return limit, remaining, reset, false, nil
+	}
+	return bucket.take()
+}
+
+// denied reports the default limit without tokens for a key denied by OverflowDeny
+func (storage *MemStorage) denied() (limit, remaining, reset uint64) {
+	return storage.tokens, 0, nanoNow() + uint64(storage.interval)
+}
+
+// full reports whether shard holds MaxKeys buckets. shard.lock should be held.
+func (storage *MemStorage) full(shard *shard) bool {
+	return storage.shardMaxKeys > 0 && len(shard.buckets) >= storage.shardMaxKeys
+}
+
+// add puts bucket into shard evicting the least recently used bucket if it is full.
+// Returns the evicted key. shard.lock should be held.
+func (storage *MemStorage) add(shard *shard, key string, bucket *bucket) (string, bool) {
+	var evicted string
+	var ok bool
+	if _, exists := shard.buckets[key]; !exists && storage.full(shard) {
+		evicted, ok = shard.evict()
+	}
+
+	shard.buckets[key] = bucket
+	return evicted, ok
+}
+
+// evicted calls OnEvict hook. It is called without lock so the hook could safely call the storage.
+func (storage *MemStorage) evicted(key string, ok bool) {
+	if ok && storage.onEvict != nil {
+		storage.onEvict(key)
+	}
+}
+
+// bucket returns the bucket of key creating it if it does not exist. If MaxKeys is reached,
+// it returns the shared bucket with OverflowShared and nil with OverflowDeny.
+func (storage *MemStorage) bucket(key string) *bucket {
+	shard := storage.shard(key)
+
 	// read lock first for good scenario
-	storage.bucketLock.RLock()
-	if bucket, ok := storage.buckets[key]; ok {
+	if bucket, ok := shard.lookup(key); ok {
 		// lucky variant: bucket already exists
-		storage.bucketLock.RUnlock()
-		return bucket.take()
+		return bucket
 	}
-	storage.bucketLock.RUnlock()
 
-	// bucket was not found so the full lock should be taken
-	storage.bucketLock.Lock()
-	if bucket, ok := storage.buckets[key]; ok {
+	// bucket was not found so the full lock of the shard should be taken
+	shard.lock.Lock()
+	if bucket, ok := shard.buckets[key]; ok {
 		// bucket was created by another goroutine during full lock
-		storage.bucketLock.Unlock()
-		return bucket.take()
+		shard.lock.Unlock()
+		return bucket
+	}
+
+	if storage.overflow != OverflowEvict && storage.full(shard) {
+		shard.lock.Unlock()
+		if storage.onOverflow != nil {
+			storage.onOverflow(key)
+		}
+		return storage.shared
 	}
 
 	// bucket does not exist (it was purged or key has been seen first time)
 	bucket := newBucket(storage.tokens, storage.interval)
-	storage.buckets[key] = bucket
+	evicted, ok := storage.add(shard, key, bucket)
+	shard.lock.Unlock()
 
-	storage.bucketLock.Unlock()
+	storage.evicted(evicted, ok)
+	return bucket
+}
 
-	return bucket.take()
+// TakeMany takes tokens from all keys of reqs or from none of them. Buckets are locked
+// in the order of keys and the shared overflow bucket is locked last, so concurrent batches
+// could not deadlock. A key denied by OverflowDeny denies the whole batch.
+func (storage *MemStorage) TakeMany(ctx context.Context, reqs []rlstorage.TakeRequest) ([]*rlstorage.Decision, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return nil, rlstorage.ErrStopped
+	}
+
+	keys, costs := rlstorage.MergeTakeRequests(reqs)
+	buckets := make([]*bucket, 0, len(keys))
+	// bucketCosts sums the costs of keys sharing the overflow bucket
+	bucketCosts := make(map[*bucket]uint64, len(keys))
+	bucketKeys := make(map[*bucket][]string, len(keys))
+	allowed := true
+	for _, key := range keys {
+		bucket := storage.bucket(key)
+		if bucket == nil {
+			allowed = false
+			continue
+		}
+
+		if _, ok := bucketCosts[bucket]; !ok && bucket != storage.shared {
+			buckets = append(buckets, bucket)
+		}
+		bucketCosts[bucket] += costs[key]
+		bucketKeys[bucket] = append(bucketKeys[bucket], key)
+	}
+	if storage.shared != nil {
+		if _, ok := bucketCosts[storage.shared]; ok {
+			buckets = append(buckets, storage.shared)
+		}
+	}
+
+	now := nanoNow()
+	for _, bucket := range buckets {
+		bucket.lock.Lock()
+		atomic.StoreUint64(&bucket.accessed, now)
+		bucket.refill(tick(bucket.startTime, now, bucket.interval))
+		if bucket.availableTokens < bucketCosts[bucket] {
+			allowed = false
+		}
+	}
+
+	decisions := make(map[string]*rlstorage.Decision, len(keys))
+	for _, bucket := range buckets {
+		if allowed {
+			bucket.availableTokens -= bucketCosts[bucket]
+		}
 
+		reset := bucket.startTime + ((tick(bucket.startTime, now, bucket.interval) + 1) * uint64(bucket.interval))
+		for _, key := range bucketKeys[bucket] {
+			decisions[key] = rlstorage.NewDecision(bucket.maxTokens, bucket.availableTokens, reset, allowed)
+		}
+		bucket.lock.Unlock()
+	}
+	for _, key := range keys {
+		if _, ok := decisions[key]; !ok {
+			limit, remaining, reset := storage.denied()
+			decisions[key] = rlstorage.NewDecision(limit, remaining, reset, false)
+		}
+	}
+
+	result := make([]*rlstorage.Decision, len(reqs))
+	for i, req := range reqs {
+		d := *decisions[req.Key]
+		d.Cost = req.Cost
+		if d.Cost == 0 {
+			d.Cost = 1
+		}
+		result[i] = &d
+	}
+	return result, nil
 }
 
-// Get retrieves the info by key if it exists
+// Get retrieves the info by key if it exists. Remaining includes the tokens refilled since
+// the last take, so it is what the next Take would see rather than what the last one left.
 func (storage *MemStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
 	if atomic.LoadUint32(&storage.stopped) == 1 {
 		return 0, 0, rlstorage.ErrStopped
 	}
 
-	storage.bucketLock.RLock()
-	if bucket, ok := storage.buckets[key]; ok {
-		storage.bucketLock.RUnlock()
-		return bucket.get()
+	if bucket, ok := storage.shard(key).lookup(key); ok {
+		tokens, remaining, _ := bucket.get()
+		return tokens, remaining, nil
 	}
-
-	storage.bucketLock.RUnlock()
 	return 0, 0, nil
 }
 
+// TakeDecision is Take that reports rlstorage.Decision
+func (storage *MemStorage) TakeDecision(ctx context.Context, key string) (*rlstorage.Decision, error) {
+	limit, remaining, reset, ok, err := storage.Take(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return rlstorage.NewDecision(limit, remaining, reset, ok), nil
+}
+
+// GetDecision is Get that also reports the reset time. Missing key is reported as
+// a fresh bucket with the default limit.
+func (storage *MemStorage) GetDecision(ctx context.Context, key string) (*rlstorage.Decision, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return nil, rlstorage.ErrStopped
+	}
+
+	bucket, ok := storage.shard(key).lookup(key)
+
+	var limit, remaining, reset uint64
+	if ok {
+		limit, remaining, reset = bucket.get()
+	} else {
+		limit, remaining, reset = storage.tokens, storage.tokens, nanoNow()+uint64(storage.interval)
+	}
+
+	d := rlstorage.NewDecision(limit, remaining, reset, remaining > 0)
+	d.Cost = 0
+	return d, nil
+}
+
 // Set setups bucket by key and tokens and interval. Recreates bucket if needed.
 func (storage *MemStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
-	storage.bucketLock.Lock()
 	bucket := newBucket(tokens, interval)
-	storage.buckets[key] = bucket
-	storage.bucketLock.Unlock()
+
+	shard := storage.shard(key)
+	shard.lock.Lock()
+	evicted, ok := storage.add(shard, key, bucket)
+	shard.lock.Unlock()
+
+	storage.evicted(evicted, ok)
 	return nil
 }
 
 // Burst add tokens to the available tokens of the bucket labeled by key.
 // Creates a bucket with key if not found one.
 func (storage *MemStorage) Burst(ctx context.Context, key string, tokens uint64) error {
-	storage.bucketLock.Lock()
+	shard := storage.shard(key)
+	shard.lock.Lock()
 
-	if bucket, ok := storage.buckets[key]; ok {
+	if bucket, ok := shard.buckets[key]; ok {
 		bucket.lock.Lock()
-		storage.bucketLock.Unlock()
+		shard.lock.Unlock()
 
 		bucket.availableTokens = bucket.availableTokens + tokens
 		bucket.lock.Unlock()
@@ -209,7 +482,72 @@ func (storage *MemStorage) Burst(ctx context.Context, key string, tokens uint64)
 
 	// record not found
 	bucket := newBucket(storage.tokens+tokens, storage.interval)
-	storage.buckets[key] = bucket
-	storage.bucketLock.Unlock()
+	evicted, ok := storage.add(shard, key, bucket)
+	shard.lock.Unlock()
+
+	storage.evicted(evicted, ok)
+	return nil
+}
+
+// Reset refills the bucket labeled by key keeping its limit and interval.
+// Does nothing if the bucket does not exist.
+func (storage *MemStorage) Reset(ctx context.Context, key string) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	shard := storage.shard(key)
+	shard.lock.Lock()
+	if bucket, ok := shard.buckets[key]; ok {
+		shard.buckets[key] = newBucket(bucket.maxTokens, bucket.interval)
+	}
+	shard.lock.Unlock()
+	return nil
+}
+
+// Delete removes the bucket labeled by key. The next Take would create it with defaults.
+func (storage *MemStorage) Delete(ctx context.Context, key string) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	shard := storage.shard(key)
+	shard.lock.Lock()
+	delete(shard.buckets, key)
+	shard.lock.Unlock()
+	return nil
+}
+
+// Scan calls f for every bucket which key starts with prefix.
+// Buckets are collected first, so f could safely call the storage.
+func (storage *MemStorage) Scan(ctx context.Context, prefix string, f func(state rlstorage.KeyState) bool) error {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return rlstorage.ErrStopped
+	}
+
+	var keys []string
+	var buckets []*bucket
+	for _, shard := range storage.shards {
+		shard.lock.RLock()
+		for key, bucket := range shard.buckets {
+			if strings.HasPrefix(key, prefix) {
+				keys = append(keys, key)
+				buckets = append(buckets, bucket)
+			}
+		}
+		shard.lock.RUnlock()
+	}
+
+	for i, bucket := range buckets {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		tokens, remaining, _ := bucket.get()
+		state := rlstorage.KeyState{Key: keys[i], Tokens: tokens, Remaining: remaining, Interval: bucket.interval}
+		if !f(state) {
+			return nil
+		}
+	}
 	return nil
 }
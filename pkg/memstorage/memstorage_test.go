@@ -5,7 +5,11 @@ import (
 	"crypto/rand"
 	"crypto/sha256"
 	"fmt"
+	rlstorage "pkg/rl-storage"
+	"reflect"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -73,8 +77,8 @@ func TestMemStorage_Take(t *testing.T) {
 				}
 			})
 
-			take := make(chan *result, 2*c.tokens)
-			for i := uint64(1); i <= 2*c.tokens; i++ {
+			take := make(chan *result, 2*case_.tokens)
+			for i := uint64(1); i <= 2*case_.tokens; i++ {
 				go func() {
 					limit, remaining, reset, ok, err := storage.Take(ctx, key)
 					take <- &result{limit: limit, remaining: remaining, reset: time.Duration(nanoNow() - reset), ok: ok, err: err}
@@ -82,7 +86,7 @@ func TestMemStorage_Take(t *testing.T) {
 			}
 
 			var result_s []*result
-			for i := uint64(1); i <= 2*c.tokens; i++ {
+			for i := uint64(1); i <= 2*case_.tokens; i++ {
 				select {
 				case result := <-take:
 					result_s = append(result_s, result)
@@ -104,15 +108,15 @@ func TestMemStorage_Take(t *testing.T) {
 					t.Fatal(result.err)
 				}
 
-				if got, want := result.limit, c.tokens; got != want {
+				if got, want := result.limit, case_.tokens; got != want {
 					t.Errorf("limit: expected %d got %d", want, got)
 				}
-				if got, want := result.reset, c.interval; got > want {
+				if got, want := result.reset, case_.interval; got > want {
 					t.Errorf("reset: expected %d, got %d", want, got)
 				}
 
-				if uint64(i) < c.tokens {
-					if got, want := result.remaining, c.tokens-uint64(i)-1; got != want {
+				if uint64(i) < case_.tokens {
+					if got, want := result.remaining, case_.tokens-uint64(i)-1; got != want {
 						t.Errorf("remaining: expected %d, got %d", want, got)
 					}
 					if got, want := result.ok, true; got != want {
@@ -127,7 +131,7 @@ func TestMemStorage_Take(t *testing.T) {
 					}
 				}
 			}
-			time.Sleep(c.interval)
+			time.Sleep(case_.interval)
 			_, _, _, ok, err := storage.Take(ctx, key)
 			if err != nil {
 				t.Fatal(err)
@@ -224,3 +228,503 @@ func TestMemStorage_Basic(t *testing.T) {
 		t.Errorf("reset: expected %v, got %v", want, got)
 	}
 }
+
+func TestMemStorage_PurgeHook(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	purged := make(chan int, 1)
+	storage, err := NewMemStorage(&Config{
+		Tokens:        1,
+		Interval:      1 * time.Millisecond,
+		SweepInterval: 20 * time.Millisecond,
+		SweepMinTTL:   1 * time.Millisecond,
+		PurgeHook: func(_ time.Duration, evicted int) {
+			select {
+			case purged <- evicted:
+			default:
+			}
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	if _, _, _, _, err := storage.Take(ctx, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := storage.Len(), 1; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+
+	select {
+	case evicted := <-purged:
+		if got, want := evicted, 1; got != want {
+			t.Errorf("evicted: expected %d, got %d", want, got)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timeout")
+	}
+	if got, want := storage.Len(), 0; got != want {
+		t.Errorf("len: expected %d, got %d", want, got)
+	}
+}
+
+func TestMemStorage_ResetDeleteScan(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewMemStorage(&Config{
+		Tokens:   3,
+		Interval: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key := "prefix:" + testKey(t)
+	if err := storage.Set(ctx, key, 5, 1*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, _, _, err := storage.Take(ctx, testKey(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reset keeps custom limit
+	if err := storage.Reset(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	limit, remaining, err := storage.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := limit, uint64(5); got != want {
+		t.Errorf("limit: expected %d, got %d", want, got)
+	}
+	if got, want := remaining, uint64(5); got != want {
+		t.Errorf("remaining: expected %d, got %d", want, got)
+	}
+
+	var states []rlstorage.KeyState
+	if err := storage.Scan(ctx, "prefix:", func(state rlstorage.KeyState) bool {
+		states = append(states, state)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := states, []rlstorage.KeyState{{Key: key, Tokens: 5, Remaining: 5, Interval: 1 * time.Hour}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scan: expected %v, got %v", want, got)
+	}
+
+	// Delete drops custom limit
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	limit, _, _, _, err = storage.Take(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := limit, uint64(3); got != want {
+		t.Errorf("limit: expected %d, got %d", want, got)
+	}
+}
+
+func TestMemStorage_Decision(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewMemStorage(&Config{
+		Tokens:   1,
+		Interval: 1 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+	key := testKey(t)
+
+	// missing key is reported as a fresh bucket
+	decision, err := storage.GetDecision(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *decision, (rlstorage.Decision{Limit: 1, Remaining: 1, ResetAt: decision.ResetAt, Allowed: true}); got != want {
+		t.Errorf("decision: expected %+v, got %+v", want, got)
+	}
+
+	decision, err = storage.TakeDecision(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decision.Allowed || decision.Remaining != 0 || decision.Cost != 1 || decision.RetryAfter != 0 {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+
+	decision, err = storage.TakeDecision(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed {
+		t.Errorf("expected not allowed")
+	}
+	if got, want := decision.RetryAfter, 1*time.Second; got <= 0 || got > want {
+		t.Errorf("retry after: expected (0, %v], got %v", want, got)
+	}
+	if got, want := time.Until(decision.ResetAt), 1*time.Second; got > want {
+		t.Errorf("reset: expected less than %v, got %v", want, got)
+	}
+
+	decision, err = storage.GetDecision(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed || decision.Remaining != 0 || decision.ResetAt.IsZero() {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+}
+
+func TestMemStorage_TakeMany(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewMemStorage(&Config{
+		Tokens:   5,
+		Interval: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	user, org := testKey(t), testKey(t)
+	if err := storage.Set(ctx, org, 3, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []rlstorage.TakeRequest{{Key: user}, {Key: org, Cost: 2}}
+	decisions, err := storage.TakeMany(ctx, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(decisions), 2; got != want {
+		t.Fatalf("decisions: expected %d, got %d", want, got)
+	}
+	if !decisions[0].Allowed || decisions[0].Remaining != 4 || decisions[0].Cost != 1 {
+		t.Errorf("unexpected user decision %+v", decisions[0])
+	}
+	if !decisions[1].Allowed || decisions[1].Remaining != 1 || decisions[1].Cost != 2 {
+		t.Errorf("unexpected org decision %+v", decisions[1])
+	}
+
+	// org has not enough tokens -- nothing is taken from user either
+	decisions, err = storage.TakeMany(ctx, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, decision := range decisions {
+		if decision.Allowed {
+			t.Errorf("expected not allowed %+v", decision)
+		}
+	}
+	_, remaining, err := storage.Get(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining, uint64(4); got != want {
+		t.Errorf("user remaining: expected %d, got %d", want, got)
+	}
+
+	// the same keys in different order from many goroutines do not deadlock
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			reqs := []rlstorage.TakeRequest{{Key: user}, {Key: org}}
+			if i%2 == 0 {
+				reqs[0], reqs[1] = reqs[1], reqs[0]
+			}
+			if _, err := storage.TakeMany(ctx, reqs); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestMemStorage_Shards(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	for _, c := range []struct {
+		shards, want int
+	}{
+		{shards: 0, want: 32},
+		{shards: 1, want: 1},
+		{shards: 5, want: 8},
+		{shards: 64, want: 64},
+	} {
+		storage, err := NewMemStorage(&Config{Shards: c.shards})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := len(storage.shards); got != c.want {
+			t.Errorf("shards %d: expected %d, got %d", c.shards, c.want, got)
+		}
+
+		keys := 1000
+		for i := 0; i < keys; i++ {
+			if _, _, _, _, err := storage.Take(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if got := storage.Len(); got != keys {
+			t.Errorf("shards %d: len expected %d, got %d", c.shards, keys, got)
+		}
+		for i, shard := range storage.shards {
+			if c.want > 1 && len(shard.buckets) == keys {
+				t.Errorf("shards %d: all keys are in shard %d", c.shards, i)
+			}
+		}
+
+		var scanned int
+		if err := storage.Scan(ctx, "key-", func(rlstorage.KeyState) bool {
+			scanned++
+			return true
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if scanned != keys {
+			t.Errorf("shards %d: scanned expected %d, got %d", c.shards, keys, scanned)
+		}
+
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// benchmarkKeys is the cardinality of keys taken by benchmarks
+const benchmarkKeys = 1 << 16
+
+func benchmarkTake(b *testing.B, cfg *Config) {
+	ctx := context.Background()
+	storage, err := NewMemStorage(cfg)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	keys := make([]string, benchmarkKeys)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	var seed uint32
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		// every goroutine walks keys from its own offset, so most takes hit different buckets
+		i := int(atomic.AddUint32(&seed, 7919))
+		for pb.Next() {
+			if _, _, _, _, err := storage.Take(ctx, keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkMemStorage_Take(b *testing.B) {
+	for _, shards := range []int{1, 8, 32, 128} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkTake(b, &Config{Tokens: 100, Interval: time.Second, Shards: shards})
+		})
+	}
+}
+
+// BenchmarkMemStorage_TakePurge takes keys while purge sweeps the storage every millisecond
+func BenchmarkMemStorage_TakePurge(b *testing.B) {
+	for _, shards := range []int{1, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			benchmarkTake(b, &Config{
+				Tokens:        100,
+				Interval:      time.Millisecond,
+				SweepInterval: time.Millisecond,
+				SweepMinTTL:   time.Millisecond,
+				Shards:        shards,
+			})
+		})
+	}
+}
+
+func TestMemStorage_MaxKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	newStorage := func(t *testing.T, overflow OverflowPolicy, evicted, overflowed *[]string) *MemStorage {
+		t.Helper()
+
+		storage, err := NewMemStorage(&Config{
+			Tokens:     2,
+			Interval:   time.Hour,
+			Shards:     1,
+			MaxKeys:    2,
+			Overflow:   overflow,
+			OnEvict:    func(key string) { *evicted = append(*evicted, key) },
+			OnOverflow: func(key string) { *overflowed = append(*overflowed, key) },
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			if err := storage.Close(ctx); err != nil {
+				t.Fatal(err)
+			}
+		})
+		return storage
+	}
+
+	take := func(t *testing.T, storage *MemStorage, key string) (uint64, bool) {
+		t.Helper()
+
+		_, remaining, _, ok, err := storage.Take(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return remaining, ok
+	}
+
+	t.Run("unknown overflow", func(t *testing.T) {
+		if _, err := NewMemStorage(&Config{Overflow: OverflowShared + 1}); err != ErrUnknownOverflow {
+			t.Errorf("expected %v, got %v", ErrUnknownOverflow, err)
+		}
+	})
+
+	t.Run("evict", func(t *testing.T) {
+		var evicted, overflowed []string
+		storage := newStorage(t, OverflowEvict, &evicted, &overflowed)
+
+		take(t, storage, "a")
+		time.Sleep(time.Millisecond)
+		take(t, storage, "b")
+		take(t, storage, "c")
+
+		if got, want := storage.Len(), 2; got != want {
+			t.Errorf("len: expected %d, got %d", want, got)
+		}
+		if want := []string{"a"}; !reflect.DeepEqual(evicted, want) {
+			t.Errorf("evicted: expected %v, got %v", want, evicted)
+		}
+		if len(overflowed) != 0 {
+			t.Errorf("overflowed: expected none, got %v", overflowed)
+		}
+
+		// Set makes room for a new key as well
+		if err := storage.Set(ctx, "d", 5, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := storage.Len(), 2; got != want {
+			t.Errorf("len: expected %d, got %d", want, got)
+		}
+		if got, want := len(evicted), 2; got != want {
+			t.Errorf("evicted: expected %d, got %d", want, got)
+		}
+	})
+
+	t.Run("deny", func(t *testing.T) {
+		var evicted, overflowed []string
+		storage := newStorage(t, OverflowDeny, &evicted, &overflowed)
+
+		take(t, storage, "a")
+		take(t, storage, "b")
+		if _, ok := take(t, storage, "c"); ok {
+			t.Errorf("new key is not denied")
+		}
+		if remaining, ok := take(t, storage, "a"); !ok || remaining != 0 {
+			t.Errorf("known key: expected taken with 0 remaining, got %v with %d", ok, remaining)
+		}
+
+		decisions, err := storage.TakeMany(ctx, []rlstorage.TakeRequest{{Key: "b"}, {Key: "d"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range decisions {
+			if d.Allowed {
+				t.Errorf("batch with denied key is allowed")
+			}
+		}
+		if remaining, ok := take(t, storage, "b"); !ok || remaining != 0 {
+			t.Errorf("denied batch took tokens: %v with %d", ok, remaining)
+		}
+
+		if want := []string{"c", "d"}; !reflect.DeepEqual(overflowed, want) {
+			t.Errorf("overflowed: expected %v, got %v", want, overflowed)
+		}
+		if len(evicted) != 0 {
+			t.Errorf("evicted: expected none, got %v", evicted)
+		}
+	})
+
+	t.Run("shared", func(t *testing.T) {
+		var evicted, overflowed []string
+		storage := newStorage(t, OverflowShared, &evicted, &overflowed)
+
+		take(t, storage, "a")
+		take(t, storage, "b")
+
+		// new keys share the tokens of the overflow bucket
+		if remaining, ok := take(t, storage, "c"); !ok || remaining != 1 {
+			t.Errorf("c: expected taken with 1 remaining, got %v with %d", ok, remaining)
+		}
+		decisions, err := storage.TakeMany(ctx, []rlstorage.TakeRequest{{Key: "d"}, {Key: "e"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range decisions {
+			if d.Allowed {
+				t.Errorf("batch exceeding shared bucket is allowed")
+			}
+		}
+		if remaining, ok := take(t, storage, "f"); !ok || remaining != 0 {
+			t.Errorf("f: expected taken with 0 remaining, got %v with %d", ok, remaining)
+		}
+		if _, ok := take(t, storage, "g"); ok {
+			t.Errorf("g: shared bucket is not exhausted")
+		}
+
+		if got, want := storage.Len(), 2; got != want {
+			t.Errorf("len: expected %d, got %d", want, got)
+		}
+		if got, want := len(overflowed), 5; got != want {
+			t.Errorf("overflowed: expected %d, got %d", want, got)
+		}
+	})
+}
@@ -0,0 +1,99 @@
+package memstorage
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// fnv-1a 32 bit parameters
+	fnvOffset = 2166136261
+	fnvPrime  = 16777619
+)
+
+// shard is a lock-striped segment of the buckets map. Keys are spread over shards
+// by hash, so first-seen keys and purge lock only a part of the storage.
+type shard struct {
+	buckets map[string]*bucket
+	lock    sync.RWMutex
+}
+
+func newShard(initAlloc int) *shard {
+	return &shard{buckets: make(map[string]*bucket, initAlloc)}
+}
+
+// hashKey is fnv-1a of key. It does not allocate unlike hash/fnv.
+func hashKey(key string) uint32 {
+	hash := uint32(fnvOffset)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= fnvPrime
+	}
+	return hash
+}
+
+// shardCount rounds n up to a power of two, so the shard is selected by mask
+func shardCount(n int) int {
+	count := 1
+	for count < n {
+		count <<= 1
+	}
+	return count
+}
+
+// lookup returns the bucket of key if it exists
+func (s *shard) lookup(key string) (*bucket, bool) {
+	s.lock.RLock()
+	bucket, ok := s.buckets[key]
+	s.lock.RUnlock()
+	return bucket, ok
+}
+
+// purge removes the buckets inactive for more than minTTL nanoseconds.
+// Returns the number of evicted buckets.
+func (s *shard) purge(now, minTTL uint64) int {
+	evicted := 0
+
+	s.lock.Lock()
+	for key, bucket := range s.buckets {
+		bucket.lock.Lock()
+		lastTime := bucket.startTime + (bucket.lastTick * uint64(bucket.interval))
+		bucket.lock.Unlock()
+
+		if now-lastTime > minTTL {
+			delete(s.buckets, key)
+			evicted++
+		}
+	}
+	s.lock.Unlock()
+	return evicted
+}
+
+// evictionSamples is the number of buckets compared to find the least recently used one
+const evictionSamples = 8
+
+// evict removes the least recently used bucket of a few sampled ones, like Redis does.
+// Map iteration starts at a random bucket, so the samples differ between calls.
+// Returns the key of the evicted bucket. s.lock should be held.
+func (s *shard) evict() (string, bool) {
+	var oldestKey string
+	var oldest uint64
+	sampled := 0
+	for key, bucket := range s.buckets {
+		accessed := atomic.LoadUint64(&bucket.accessed)
+		if sampled == 0 || accessed < oldest {
+			oldestKey, oldest = key, accessed
+		}
+
+		sampled++
+		if sampled == evictionSamples {
+			break
+		}
+	}
+
+	if sampled == 0 {
+		return "", false
+	}
+	delete(s.buckets, oldestKey)
+	return oldestKey, true
+}
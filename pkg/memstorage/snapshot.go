@@ -0,0 +1,194 @@
+package memstorage
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// snapshotVersion is the version of the snapshot format written by Snapshot.
+// Increment it when the fields of snapshotBucket change incompatibly.
+const snapshotVersion = 1
+
+var (
+	ErrSnapshotVersion = fmt.Errorf("unsupported snapshot version")
+	ErrSnapshotHeader  = fmt.Errorf("snapshot header is missing")
+)
+
+// snapshotHeader is the first line of a snapshot
+type snapshotHeader struct {
+	Version int `json:"version"`
+	// TakenAt is the unix time of the snapshot in nanoseconds
+	TakenAt uint64 `json:"taken_at"`
+}
+
+// snapshotBucket is a line of a snapshot after the header. Times are unix nanoseconds.
+type snapshotBucket struct {
+	Key       string        `json:"key"`
+	StartTime uint64        `json:"start"`
+	LastTick  uint64        `json:"tick"`
+	Interval  time.Duration `json:"interval"`
+	MaxTokens uint64        `json:"tokens"`
+	Available uint64        `json:"available"`
+}
+
+// Snapshot writes all buckets to w as JSON lines: a header with the format version followed
+// by a line per bucket with its limit, interval and state. Shards are locked one at a time,
+// so buckets taken during the snapshot may be written before or after the take.
+func (storage *MemStorage) Snapshot(w io.Writer) error {
+	buffered := bufio.NewWriter(w)
+	encoder := json.NewEncoder(buffered)
+	if err := encoder.Encode(&snapshotHeader{Version: snapshotVersion, TakenAt: nanoNow()}); err != nil {
+		return err
+	}
+
+	for _, shard := range storage.shards {
+		shard.lock.RLock()
+		buckets := make([]snapshotBucket, 0, len(shard.buckets))
+		for key, bucket := range shard.buckets {
+			bucket.lock.Lock()
+			buckets = append(buckets, snapshotBucket{
+				Key:       key,
+				StartTime: bucket.startTime,
+				LastTick:  bucket.lastTick,
+				Interval:  bucket.interval,
+				MaxTokens: bucket.maxTokens,
+				Available: bucket.availableTokens,
+			})
+			bucket.lock.Unlock()
+		}
+		shard.lock.RUnlock()
+
+		for i := range buckets {
+			if err := encoder.Encode(&buckets[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return buffered.Flush()
+}
+
+// Restore reads buckets written by Snapshot replacing the buckets with the same keys.
+// Buckets keep refilling from their snapshot state, so the time between Snapshot and Restore
+// is accounted. MaxKeys is respected by evicting the least recently used buckets.
+func (storage *MemStorage) Restore(r io.Reader) error {
+	decoder := json.NewDecoder(bufio.NewReader(r))
+
+	var header snapshotHeader
+	if err := decoder.Decode(&header); err != nil {
+		if errors.Is(err, io.EOF) {
+			return ErrSnapshotHeader
+		}
+		return err
+	}
+	if header.Version < 1 || header.Version > snapshotVersion {
+		return fmt.Errorf("%w: %d", ErrSnapshotVersion, header.Version)
+	}
+
+	for {
+		var b snapshotBucket
+		if err := decoder.Decode(&b); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if b.MaxTokens == 0 || b.Interval <= 0 {
+			return fmt.Errorf("invalid bucket %q in snapshot", b.Key)
+		}
+
+		bucket := newBucket(b.MaxTokens, b.Interval)
+		bucket.startTime = b.StartTime
+		bucket.lastTick = b.LastTick
+		bucket.availableTokens = b.Available
+
+		shard := storage.shard(b.Key)
+		shard.lock.Lock()
+		evicted, ok := storage.add(shard, b.Key, bucket)
+		shard.lock.Unlock()
+
+		storage.evicted(evicted, ok)
+	}
+}
+
+// SnapshotFile writes the snapshot to path atomically: to a temporary file in the same
+// directory first which is renamed to path, so a crash could not leave a partial snapshot.
+// Snapshots to files are serialized, so the snapshot of Close is not replaced by a periodic one.
+func (storage *MemStorage) SnapshotFile(path string) error {
+	storage.snapshotLock.Lock()
+	defer storage.snapshotLock.Unlock()
+
+	return storage.writeSnapshotFile(path)
+}
+
+// writeSnapshotFile is SnapshotFile without lock. storage.snapshotLock should be held.
+func (storage *MemStorage) writeSnapshotFile(path string) error {
+	file, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if err := storage.Snapshot(file); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// RestoreFile restores the snapshot of path. A missing file is not an error,
+// so the first start with a snapshot path succeeds.
+func (storage *MemStorage) RestoreFile(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	return storage.Restore(file)
+}
+
+// snapshots periodically writes the snapshot to snapshotPath until the storage is closed
+func (storage *MemStorage) snapshots(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		// stopped flag is checked under lock, so a storage cleared by Close is not written
+		// over its final snapshot
+		storage.snapshotLock.Lock()
+		if atomic.LoadUint32(&storage.stopped) == 1 {
+			storage.snapshotLock.Unlock()
+			return
+		}
+		err := storage.writeSnapshotFile(storage.snapshotPath)
+		storage.snapshotLock.Unlock()
+
+		if err != nil && storage.onSnapshotError != nil {
+			storage.onSnapshotError(err)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package memstorage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemStorage_SnapshotRestore(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewMemStorage(&Config{Tokens: 3, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close(ctx)
+
+	if err := storage.Set(ctx, "custom", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"custom", "default", "default"} {
+		if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var snapshot bytes.Buffer
+	if err := storage.Snapshot(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Count(snapshot.String(), "\n"), 3; got != want {
+		t.Errorf("lines: expected %d, got %d", want, got)
+	}
+
+	restored, err := NewMemStorage(&Config{Tokens: 3, Interval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close(ctx)
+
+	if err := restored.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		key              string
+		limit, remaining uint64
+	}{
+		{key: "custom", limit: 10, remaining: 9},
+		{key: "default", limit: 3, remaining: 1},
+	} {
+		limit, remaining, err := restored.Get(ctx, c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit != c.limit || remaining != c.remaining {
+			t.Errorf("%s: expected %d/%d, got %d/%d", c.key, c.remaining, c.limit, remaining, limit)
+		}
+	}
+
+	// restored buckets keep their state
+	if _, remaining, _, ok, err := restored.Take(ctx, "default"); err != nil || !ok || remaining != 0 {
+		t.Errorf("take: expected 0 remaining, got %d/%v/%v", remaining, ok, err)
+	}
+}
+
+func TestMemStorage_RestoreErrors(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewMemStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close(ctx)
+
+	for _, c := range []struct {
+		name     string
+		snapshot string
+		err      error
+	}{
+		{name: "empty", snapshot: "", err: ErrSnapshotHeader},
+		{name: "newer version", snapshot: `{"version":2}` + "\n", err: ErrSnapshotVersion},
+		{name: "no version", snapshot: `{}` + "\n", err: ErrSnapshotVersion},
+	} {
+		if err := storage.Restore(strings.NewReader(c.snapshot)); !errors.Is(err, c.err) {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+
+	invalid := `{"version":1}` + "\n" + `{"key":"a","tokens":0,"interval":1}` + "\n"
+	if err := storage.Restore(strings.NewReader(invalid)); err == nil {
+		t.Errorf("invalid bucket: expected error")
+	}
+}
+
+func TestMemStorage_SnapshotFile(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "memstorage")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	path := filepath.Join(dir, "snapshot.jsonl")
+
+	cfg := &Config{
+		Tokens:           2,
+		Interval:         time.Hour,
+		SnapshotPath:     path,
+		SnapshotInterval: 10 * time.Millisecond,
+		OnSnapshotError:  func(err error) { t.Error(err) },
+	}
+	storage, err := NewMemStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := storage.Take(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// periodic snapshot
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("snapshot is not written")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// final snapshot on close
+	if _, _, _, _, err := storage.Take(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	restarted, err := NewMemStorage(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restarted.Close(ctx)
+
+	if _, remaining, err := restarted.Get(ctx, "a"); err != nil || remaining != 0 {
+		t.Errorf("restart: expected 0 remaining, got %d/%v", remaining, err)
+	}
+
+	matches, err := filepath.Glob(filepath.Join(dir, "*.tmp"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 0 {
+		t.Errorf("temporary files are left: %v", matches)
+	}
+
+	// corrupt snapshot fails the start
+	if err := ioutil.WriteFile(path, []byte("{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewMemStorage(cfg); err == nil {
+		t.Errorf("corrupt snapshot: expected error")
+	}
+}
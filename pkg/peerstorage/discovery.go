@@ -0,0 +1,41 @@
+package peerstorage
+
+import (
+	"context"
+	"net"
+	"sort"
+)
+
+// Discovery returns the addresses (host:port) of all peers including this one.
+// It is called periodically, so the peers could change while the storage runs.
+type Discovery func(ctx context.Context) ([]string, error)
+
+// StaticPeers returns Discovery of a fixed list of peers
+func StaticPeers(addrs ...string) Discovery {
+	peers := append([]string(nil), addrs...)
+	return func(context.Context) ([]string, error) {
+		return peers, nil
+	}
+}
+
+// DNSPeers returns Discovery of the addresses name resolves to, e.g. a headless service
+// of Kubernetes. All peers should listen on port. A nil resolver is net.DefaultResolver.
+func DNSPeers(resolver *net.Resolver, name, port string) Discovery {
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	return func(ctx context.Context) ([]string, error) {
+		hosts, err := resolver.LookupHost(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+
+		peers := make([]string, 0, len(hosts))
+		for _, host := range hosts {
+			peers = append(peers, net.JoinHostPort(host, port))
+		}
+		sort.Strings(peers)
+		return peers, nil
+	}
+}
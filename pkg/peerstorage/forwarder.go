@@ -0,0 +1,142 @@
+package peerstorage
+
+import (
+	"context"
+	"time"
+)
+
+// forwarded is a take waiting for its batch
+type forwarded struct {
+	key    string
+	result chan takeResult
+}
+
+// forwarder batches the takes forwarded to a single peer. A batch is sent when it has
+// batchSize takes or batchWait passed since its first take. Batches are sent concurrently.
+type forwarder struct {
+	storage   *PeerStorage
+	peer      string
+	batchSize int
+	batchWait time.Duration
+
+	queue chan *forwarded
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newForwarder(storage *PeerStorage, peer string) *forwarder {
+	f := &forwarder{
+		storage:   storage,
+		peer:      peer,
+		batchSize: storage.batchSize,
+		batchWait: storage.batchWait,
+		queue:     make(chan *forwarded, storage.batchSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	go f.run()
+	return f
+}
+
+// take queues the take of key and waits for its result
+func (f *forwarder) take(ctx context.Context, key string) (takeResult, error) {
+	req := &forwarded{key: key, result: make(chan takeResult, 1)}
+	select {
+	case f.queue <- req:
+	case <-f.stop:
+		return takeResult{}, ErrPeerRemoved
+	case <-ctx.Done():
+		return takeResult{}, ctx.Err()
+	}
+
+	select {
+	case result := <-req.result:
+		return result, nil
+	case <-f.done:
+		// the take could be queued after the queue was drained
+		select {
+		case result := <-req.result:
+			return result, nil
+		default:
+			return takeResult{}, ErrPeerRemoved
+		}
+	case <-ctx.Done():
+		return takeResult{}, ctx.Err()
+	}
+}
+
+func (f *forwarder) run() {
+	defer close(f.done)
+
+	for {
+		var batch []*forwarded
+		select {
+		case req := <-f.queue:
+			batch = append(batch, req)
+		case <-f.stop:
+			f.drain()
+			return
+		}
+
+		timer := time.NewTimer(f.batchWait)
+	collect:
+		for len(batch) < f.batchSize {
+			select {
+			case req := <-f.queue:
+				batch = append(batch, req)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		go f.send(batch)
+	}
+}
+
+// drain fails the takes queued before the forwarder was stopped
+func (f *forwarder) drain() {
+	for {
+		select {
+		case req := <-f.queue:
+			req.result <- takeResult{err: ErrPeerRemoved}
+		default:
+			return
+		}
+	}
+}
+
+// send forwards the batch to the peer and delivers the results. Takes of a failed batch
+// get its error.
+func (f *forwarder) send(batch []*forwarded) {
+	req := takeRequest{Keys: make([]string, len(batch))}
+	for i, forwarded := range batch {
+		req.Keys[i] = forwarded.key
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), f.storage.timeout)
+	defer cancel()
+
+	var resp takeResponse
+	err := f.storage.post(ctx, f.peer, PathTake, &req, &resp)
+	if err == nil && len(resp.Results) != len(batch) {
+		err = ErrPeerResponse
+	}
+
+	for i, forwarded := range batch {
+		if err != nil {
+			forwarded.result <- takeResult{err: err}
+			continue
+		}
+		forwarded.result <- resp.Results[i]
+	}
+	if f.storage.onBatch != nil {
+		f.storage.onBatch(f.peer, len(batch))
+	}
+}
+
+// close stops the forwarder. Queued takes fail with ErrPeerRemoved, sent ones are delivered.
+func (f *forwarder) close() {
+	close(f.stop)
+	<-f.done
+}
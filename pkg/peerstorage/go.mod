@@ -0,0 +1,12 @@
+module peer-storage
+
+require (
+	pkg/memstorage v1.0.0
+	pkg/rl-storage v1.0.0
+)
+
+replace pkg/memstorage => ./../memstorage
+
+replace pkg/rl-storage => ./../storage
+
+go 1.14
@@ -0,0 +1,177 @@
+package peerstorage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	rlstorage "pkg/rl-storage"
+	"time"
+)
+
+const (
+	// PathTake is the endpoint of batched takes forwarded by peers
+	PathTake = "/peerstorage/v1/take"
+	// PathOp is the endpoint of single Get, Set, Burst, Reset and Delete calls forwarded by peers
+	PathOp = "/peerstorage/v1/op"
+
+	opGet    = "get"
+	opSet    = "set"
+	opBurst  = "burst"
+	opReset  = "reset"
+	opDelete = "delete"
+)
+
+// takeRequest is a batch of takes forwarded to the owner of the keys
+type takeRequest struct {
+	Keys []string `json:"keys"`
+}
+
+type takeResponse struct {
+	Results []takeResult `json:"results"`
+}
+
+// takeResult is the result of a single take in the order of takeRequest.Keys
+type takeResult struct {
+	Limit     uint64 `json:"limit"`
+	Remaining uint64 `json:"remaining"`
+	Reset     uint64 `json:"reset"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+
+	// err is the error of forwarding, it is not sent
+	err error
+}
+
+// opRequest is a single call forwarded to the owner of the key
+type opRequest struct {
+	Op       string        `json:"op"`
+	Key      string        `json:"key"`
+	Tokens   uint64        `json:"tokens,omitempty"`
+	Interval time.Duration `json:"interval,omitempty"`
+}
+
+type opResponse struct {
+	Limit     uint64 `json:"limit"`
+	Remaining uint64 `json:"remaining"`
+	Error     string `json:"error,omitempty"`
+}
+
+// remoteError converts the error reported by a peer. Stopped storage is reported as
+// rlstorage.ErrStopped, so callers could check it.
+func remoteError(msg string) error {
+	if msg == "" {
+		return nil
+	}
+	if msg == rlstorage.ErrStopped.Error() {
+		return rlstorage.ErrStopped
+	}
+	return fmt.Errorf("%w: %s", ErrPeer, msg)
+}
+
+func errorString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// Handler returns http.Handler serving the calls forwarded by peers. They are always served
+// by the local storage, so peers with different views of membership could not forward in loops.
+// It should be served on the address this peer is discovered by.
+func (storage *PeerStorage) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc(PathTake, storage.handleTake)
+	mux.HandleFunc(PathOp, storage.handleOp)
+	return mux
+}
+
+func (storage *PeerStorage) handleTake(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req takeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	resp := takeResponse{Results: make([]takeResult, len(req.Keys))}
+	for i, key := range req.Keys {
+		limit, remaining, reset, ok, err := storage.local.Take(r.Context(), key)
+		resp.Results[i] = takeResult{Limit: limit, Remaining: remaining, Reset: reset, OK: ok, Error: errorString(err)}
+	}
+	writeJSON(w, &resp)
+}
+
+func (storage *PeerStorage) handleOp(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req opRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var resp opResponse
+	var err error
+	ctx := r.Context()
+	switch req.Op {
+	case opGet:
+		resp.Limit, resp.Remaining, err = storage.local.Get(ctx, req.Key)
+	case opSet:
+		err = storage.local.Set(ctx, req.Key, req.Tokens, req.Interval)
+	case opBurst:
+		err = storage.local.Burst(ctx, req.Key, req.Tokens)
+	case opReset:
+		err = storage.local.Reset(ctx, req.Key)
+	case opDelete:
+		err = storage.local.Delete(ctx, req.Key)
+	default:
+		http.Error(w, fmt.Sprintf("unknown op %q", req.Op), http.StatusBadRequest)
+		return
+	}
+	resp.Error = errorString(err)
+	writeJSON(w, &resp)
+}
+
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
+
+// post sends body as JSON to path of peer and decodes the response into resp
+func (storage *PeerStorage) post(ctx context.Context, peer, path string, body, resp interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+peer+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := storage.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrPeer, peer, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("%w: %s: %s: %s", ErrPeer, peer, res.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(res.Body).Decode(resp)
+}
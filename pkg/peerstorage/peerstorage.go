@@ -0,0 +1,356 @@
+package peerstorage
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoppedFlag  = fmt.Errorf("setting stop flag failed")
+	ErrNoSelf       = fmt.Errorf("self address is empty")
+	ErrNilDiscovery = fmt.Errorf("discovery is nil")
+	ErrPeer         = fmt.Errorf("peer request failed")
+	ErrPeerResponse = fmt.Errorf("%w: unexpected number of results", ErrPeer)
+	ErrPeerRemoved  = fmt.Errorf("peer was removed")
+)
+
+// PeerStorage is a node of rate limiters coordinating without Redis. Keys are assigned to
+// their owner nodes by consistent hashing, the owner keeps the bucket of a key in its MemStorage
+// and the other nodes forward takes of the key to it over HTTP in batches.
+//
+// Every node should serve Handler on the address it is discovered by. When a node leaves or
+// joins, the keys moving between nodes start with fresh buckets.
+type PeerStorage struct {
+	self  string
+	local *memstorage.MemStorage
+
+	discovery       Discovery
+	refreshInterval time.Duration
+	replicas        int
+	client          *http.Client
+	timeout         time.Duration
+	batchSize       int
+	batchWait       time.Duration
+	onBatch         func(peer string, size int)
+	onRefreshError  func(err error)
+
+	// ring is *ring, it is replaced on membership change
+	ring atomic.Value
+
+	// forwardersLock guards forwarders and the changes of ring, so forwarders always
+	// match the peers of ring
+	forwardersLock sync.Mutex
+	forwarders     map[string]*forwarder
+
+	stopped  uint32
+	stopChan chan struct{}
+	done     sync.WaitGroup
+}
+
+// Config is used to NewPeerStorage. It setups the PeerStorage
+type Config struct {
+	// Self is the address (host:port) of this node as it is discovered by peers. Required.
+	Self string
+	// Discovery returns the addresses of all nodes. Self is added if it is missing.
+	// Default is StaticPeers of Self only.
+	Discovery Discovery
+	// RefreshInterval is the rate at which Discovery is called. Default is 10 seconds.
+	RefreshInterval time.Duration
+	// OnRefreshError is called with the errors of Discovery. The last known peers are kept.
+	OnRefreshError func(err error)
+	// Storage setups the MemStorage of the keys owned by this node.
+	Storage *memstorage.Config
+	// Replicas is the number of points of a node on the hash ring. All nodes should use
+	// the same value. Default is 128.
+	Replicas int
+	// Client sends forwarded calls. Default is http.Client with Timeout.
+	Client *http.Client
+	// Timeout bounds a single forwarded call. Default is 1 second.
+	Timeout time.Duration
+	// BatchSize is the maximum number of takes forwarded to a peer at once. Default is 64.
+	BatchSize int
+	// BatchWait is how long a forwarded take waits for others to join its batch.
+	// It is added to the latency of forwarded takes. Default is 500 microseconds.
+	BatchWait time.Duration
+	// OnBatch is called after a batch of size takes was forwarded to peer. It could be used
+	// to collect metrics.
+	OnBatch func(peer string, size int)
+}
+
+func NewPeerStorage(cfg *Config) (*PeerStorage, error) {
+	if cfg == nil || cfg.Self == "" {
+		return nil, ErrNoSelf
+	}
+
+	discovery := StaticPeers(cfg.Self)
+	if cfg.Discovery != nil {
+		discovery = cfg.Discovery
+	}
+
+	refreshInterval := 10 * time.Second
+	if cfg.RefreshInterval > 0 {
+		refreshInterval = cfg.RefreshInterval
+	}
+
+	replicas := 128
+	if cfg.Replicas > 0 {
+		replicas = cfg.Replicas
+	}
+
+	timeout := 1 * time.Second
+	if cfg.Timeout > 0 {
+		timeout = cfg.Timeout
+	}
+
+	client := &http.Client{Timeout: timeout}
+	if cfg.Client != nil {
+		client = cfg.Client
+	}
+
+	batchSize := 64
+	if cfg.BatchSize > 0 {
+		batchSize = cfg.BatchSize
+	}
+
+	batchWait := 500 * time.Microsecond
+	if cfg.BatchWait > 0 {
+		batchWait = cfg.BatchWait
+	}
+
+	local, err := memstorage.NewMemStorage(cfg.Storage)
+	if err != nil {
+		return nil, err
+	}
+
+	storage := &PeerStorage{
+		self:            cfg.Self,
+		local:           local,
+		discovery:       discovery,
+		refreshInterval: refreshInterval,
+		replicas:        replicas,
+		client:          client,
+		timeout:         timeout,
+		batchSize:       batchSize,
+		batchWait:       batchWait,
+		onBatch:         cfg.OnBatch,
+		onRefreshError:  cfg.OnRefreshError,
+		forwarders:      make(map[string]*forwarder),
+		stopChan:        make(chan struct{}),
+	}
+	storage.ring.Store(newRing([]string{storage.self}, replicas))
+
+	// the first discovery fails the start, so misconfigured nodes do not own all keys
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := storage.Refresh(ctx); err != nil {
+		local.Close(ctx)
+		return nil, err
+	}
+
+	storage.done.Add(1)
+	go storage.refresh()
+	return storage, nil
+}
+
+// Refresh calls Discovery and updates the peers. It is called periodically, but could be
+// called directly, e.g. on a membership change notification.
+func (storage *PeerStorage) Refresh(ctx context.Context) error {
+	addrs, err := storage.discovery(ctx)
+	if err != nil {
+		return err
+	}
+	storage.setPeers(addrs)
+	return nil
+}
+
+// setPeers rebuilds the ring of addrs and self, starts forwarders of new peers and stops
+// the ones of removed peers. The ring is replaced together with the forwarders, so
+// concurrent refreshes could not leave them of different peers.
+func (storage *PeerStorage) setPeers(addrs []string) {
+	peers := map[string]bool{storage.self: true}
+	for _, addr := range addrs {
+		peers[addr] = true
+	}
+
+	list := make([]string, 0, len(peers))
+	for peer := range peers {
+		list = append(list, peer)
+	}
+	r := newRing(list, storage.replicas)
+
+	storage.forwardersLock.Lock()
+	defer storage.forwardersLock.Unlock()
+
+	for peer, f := range storage.forwarders {
+		if !peers[peer] {
+			f.close()
+			delete(storage.forwarders, peer)
+		}
+	}
+	for peer := range peers {
+		if _, ok := storage.forwarders[peer]; !ok && peer != storage.self {
+			storage.forwarders[peer] = newForwarder(storage, peer)
+		}
+	}
+	storage.ring.Store(r)
+}
+
+func (storage *PeerStorage) refresh() {
+	defer storage.done.Done()
+
+	ticker := time.NewTicker(storage.refreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), storage.timeout)
+		err := storage.Refresh(ctx)
+		cancel()
+		if err != nil && storage.onRefreshError != nil {
+			storage.onRefreshError(err)
+		}
+	}
+}
+
+// Peers returns the addresses of all nodes including this one in sorted order
+func (storage *PeerStorage) Peers() []string {
+	return append([]string(nil), storage.ring.Load().(*ring).peers...)
+}
+
+// Owner returns the address of the node owning key
+func (storage *PeerStorage) Owner(key string) string {
+	return storage.ring.Load().(*ring).owner(key)
+}
+
+// forwarder returns the owner of key and its forwarder. The forwarder is nil if the key is
+// owned by this node or the owner was removed, e.g. by Close.
+func (storage *PeerStorage) forwarder(key string) (*forwarder, string) {
+	storage.forwardersLock.Lock()
+	defer storage.forwardersLock.Unlock()
+
+	owner := storage.Owner(key)
+	if owner == storage.self {
+		return nil, owner
+	}
+	return storage.forwarders[owner], owner
+}
+
+// Take takes a token of key from its owner. Takes forwarded to the same peer are batched.
+// Returns tokens limit, remaining tokens count, reset time, success flag and error.
+func (storage *PeerStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, 0, false, rlstorage.ErrStopped
+	}
+
+	f, owner := storage.forwarder(key)
+	if owner == storage.self {
+		return storage.local.Take(ctx, key)
+	}
+	if f == nil {
+		return 0, 0, 0, false, ErrPeerRemoved
+	}
+
+	result, err := f.take(ctx, key)
+	if err == nil {
+		err = result.err
+	}
+	if err == nil {
+		err = remoteError(result.Error)
+	}
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	return result.Limit, result.Remaining, result.Reset, result.OK, nil
+}
+
+// op calls the owner of req.Key with the single op
+func (storage *PeerStorage) op(ctx context.Context, req *opRequest) (uint64, uint64, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, rlstorage.ErrStopped
+	}
+
+	f, owner := storage.forwarder(req.Key)
+	if owner == storage.self {
+		switch req.Op {
+		case opGet:
+			return storage.local.Get(ctx, req.Key)
+		case opSet:
+			return 0, 0, storage.local.Set(ctx, req.Key, req.Tokens, req.Interval)
+		case opBurst:
+			return 0, 0, storage.local.Burst(ctx, req.Key, req.Tokens)
+		case opReset:
+			return 0, 0, storage.local.Reset(ctx, req.Key)
+		default:
+			return 0, 0, storage.local.Delete(ctx, req.Key)
+		}
+	}
+	if f == nil {
+		return 0, 0, ErrPeerRemoved
+	}
+
+	var resp opResponse
+	if err := storage.post(ctx, owner, PathOp, req, &resp); err != nil {
+		return 0, 0, err
+	}
+	return resp.Limit, resp.Remaining, remoteError(resp.Error)
+}
+
+// Get returns current limit and remaining tokens of key from its owner
+func (storage *PeerStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	return storage.op(ctx, &opRequest{Op: opGet, Key: key})
+}
+
+// Set setups the limit and interval of key on its owner
+func (storage *PeerStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	_, _, err := storage.op(ctx, &opRequest{Op: opSet, Key: key, Tokens: tokens, Interval: interval})
+	return err
+}
+
+// Burst adds tokens to key on its owner
+func (storage *PeerStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	_, _, err := storage.op(ctx, &opRequest{Op: opBurst, Key: key, Tokens: tokens})
+	return err
+}
+
+// Reset refills key on its owner
+func (storage *PeerStorage) Reset(ctx context.Context, key string) error {
+	_, _, err := storage.op(ctx, &opRequest{Op: opReset, Key: key})
+	return err
+}
+
+// Delete removes key from its owner
+func (storage *PeerStorage) Delete(ctx context.Context, key string) error {
+	_, _, err := storage.op(ctx, &opRequest{Op: opDelete, Key: key})
+	return err
+}
+
+// Close stops the forwarders and the local storage. Peers forwarding takes to this node
+// get rlstorage.ErrStopped until they drop it from their peers.
+func (storage *PeerStorage) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
+		return ErrStoppedFlag
+	}
+
+	close(storage.stopChan)
+	storage.done.Wait()
+
+	storage.forwardersLock.Lock()
+	for peer, f := range storage.forwarders {
+		f.close()
+		delete(storage.forwarders, peer)
+	}
+	storage.forwardersLock.Unlock()
+
+	return storage.local.Close(ctx)
+}
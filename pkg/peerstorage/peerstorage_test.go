@@ -0,0 +1,297 @@
+package peerstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testNode is a node of the test cluster served on loopback
+type testNode struct {
+	*PeerStorage
+	server *http.Server
+	// batches is the number of batches forwarded by the node
+	batches uint64
+}
+
+// testCluster starts n nodes of cfg knowing each other
+func testCluster(t *testing.T, n int, cfg Config) []*testNode {
+	t.Helper()
+
+	listeners := make([]net.Listener, n)
+	addrs := make([]string, n)
+	for i := range listeners {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listeners[i] = l
+		addrs[i] = l.Addr().String()
+	}
+
+	nodes := make([]*testNode, n)
+	for i := range nodes {
+		node := new(testNode)
+		c := cfg
+		c.Self = addrs[i]
+		if c.Discovery == nil {
+			c.Discovery = StaticPeers(addrs...)
+		}
+		if c.Storage == nil {
+			c.Storage = &memstorage.Config{Tokens: 5, Interval: time.Hour}
+		}
+		c.OnBatch = func(peer string, size int) {
+			atomic.AddUint64(&node.batches, 1)
+		}
+
+		storage, err := NewPeerStorage(&c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.PeerStorage = storage
+		node.server = &http.Server{Handler: storage.Handler()}
+		go node.server.Serve(listeners[i])
+
+		t.Cleanup(func() {
+			node.server.Close()
+			// nodes stopped by the test are not closed again
+			if atomic.LoadUint32(&node.stopped) == 1 {
+				return
+			}
+			if err := node.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+		nodes[i] = node
+	}
+	return nodes
+}
+
+// ownedBy returns a key owned by node
+func ownedBy(tb testing.TB, node *testNode, prefix string) string {
+	tb.Helper()
+
+	for i := 0; i < 10000; i++ {
+		if key := fmt.Sprintf("%s-%d", prefix, i); node.Owner(key) == node.self {
+			return key
+		}
+	}
+	tb.Fatalf("no key is owned by %s", node.self)
+	return ""
+}
+
+func TestNewPeerStorage_Config(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewPeerStorage(nil); err != ErrNoSelf {
+		t.Errorf("nil: expected %v, got %v", ErrNoSelf, err)
+	}
+
+	failed := errors.New("discovery failed")
+	_, err := NewPeerStorage(&Config{
+		Self:      "127.0.0.1:1",
+		Discovery: func(context.Context) ([]string, error) { return nil, failed },
+	})
+	if err != failed {
+		t.Errorf("discovery: expected %v, got %v", failed, err)
+	}
+}
+
+func TestPeerStorage_SharedLimit(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	nodes := testCluster(t, 3, Config{})
+	for _, key := range []string{"a", "b", "c", "d"} {
+		owner := nodes[0].Owner(key)
+		for _, node := range nodes[1:] {
+			if got := node.Owner(key); got != owner {
+				t.Errorf("%s: owner %s differs from %s", key, got, owner)
+			}
+		}
+
+		// takes through every node share the limit of the owner
+		taken := 0
+		for i := 0; i < 9; i++ {
+			_, _, _, ok, err := nodes[i%len(nodes)].Take(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok {
+				taken++
+			}
+		}
+		if taken != 5 {
+			t.Errorf("%s: expected 5 takes, got %d", key, taken)
+		}
+	}
+}
+
+func TestPeerStorage_Batching(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	nodes := testCluster(t, 2, Config{
+		BatchWait: 10 * time.Millisecond,
+		Storage:   &memstorage.Config{Tokens: 1000, Interval: time.Hour},
+	})
+	key := ownedBy(t, nodes[1], "batched")
+
+	takes := 100
+	var wg sync.WaitGroup
+	var allowed uint64
+	for i := 0; i < takes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, _, _, ok, err := nodes[0].Take(ctx, key)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				atomic.AddUint64(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadUint64(&allowed); got != uint64(takes) {
+		t.Errorf("allowed: expected %d, got %d", takes, got)
+	}
+	if batches := atomic.LoadUint64(&nodes[0].batches); batches == 0 || batches >= uint64(takes)/2 {
+		t.Errorf("takes are not batched: %d batches of %d takes", batches, takes)
+	}
+	if _, remaining, err := nodes[1].Get(ctx, key); err != nil || remaining != 1000-uint64(takes) {
+		t.Errorf("owner: expected %d remaining, got %d/%v", 1000-takes, remaining, err)
+	}
+}
+
+func TestPeerStorage_Ops(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	nodes := testCluster(t, 2, Config{})
+	key := ownedBy(t, nodes[1], "ops")
+	node := nodes[0]
+
+	if err := node.Set(ctx, key, 2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if limit, remaining, err := node.Get(ctx, key); err != nil || limit != 2 || remaining != 2 {
+		t.Errorf("set: expected 2/2, got %d/%d/%v", remaining, limit, err)
+	}
+
+	node.Take(ctx, key)
+	if err := node.Burst(ctx, key, 3); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := node.Get(ctx, key); err != nil || remaining != 4 {
+		t.Errorf("burst: expected 4 remaining, got %d/%v", remaining, err)
+	}
+
+	node.Take(ctx, key)
+	if err := node.Reset(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if limit, remaining, err := node.Get(ctx, key); err != nil || limit != 2 || remaining != 2 {
+		t.Errorf("reset: expected 2/2, got %d/%d/%v", remaining, limit, err)
+	}
+
+	if err := node.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if limit, _, err := nodes[1].local.Get(ctx, key); err != nil || limit != 0 {
+		t.Errorf("delete: expected no key on the owner, got limit %d/%v", limit, err)
+	}
+}
+
+func TestPeerStorage_Membership(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	var lock sync.Mutex
+	var peers []string
+	discovery := func(context.Context) ([]string, error) {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), peers...), nil
+	}
+
+	nodes := testCluster(t, 2, Config{Discovery: discovery, RefreshInterval: time.Hour})
+	if got, want := len(nodes[0].Peers()), 1; got != want {
+		t.Errorf("peers: expected %d, got %d", want, got)
+	}
+
+	lock.Lock()
+	peers = []string{nodes[0].self, nodes[1].self}
+	lock.Unlock()
+	for _, node := range nodes {
+		if err := node.Refresh(ctx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(nodes[0].Peers()), 2; got != want {
+		t.Errorf("peers: expected %d, got %d", want, got)
+	}
+
+	// the owner is down: takes of its keys fail
+	key := ownedBy(t, nodes[1], "down")
+	nodes[1].server.Close()
+	if _, _, _, _, err := nodes[0].Take(ctx, key); !errors.Is(err, ErrPeer) {
+		t.Errorf("take of a down peer: expected %v, got %v", ErrPeer, err)
+	}
+
+	// the peer is removed: its keys are owned by the others
+	lock.Lock()
+	peers = []string{nodes[0].self}
+	lock.Unlock()
+	if err := nodes[0].Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, ok, err := nodes[0].Take(ctx, key); err != nil || !ok {
+		t.Errorf("take after removal: got %v/%v", ok, err)
+	}
+}
+
+func TestPeerStorage_Stopped(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	nodes := testCluster(t, 2, Config{})
+	key := ownedBy(t, nodes[1], "stopped")
+
+	if err := nodes[1].Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, _, err := nodes[0].Take(ctx, key); !errors.Is(err, rlstorage.ErrStopped) {
+		t.Errorf("take of a stopped owner: expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+}
+
+func TestDNSPeers(t *testing.T) {
+	t.Parallel()
+
+	peers, err := DNSPeers(nil, "localhost", "8080")(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, peer := range peers {
+		if peer == "127.0.0.1:8080" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected 127.0.0.1:8080 in %v", peers)
+	}
+}
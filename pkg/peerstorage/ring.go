@@ -0,0 +1,70 @@
+package peerstorage
+
+import (
+	"sort"
+	"strconv"
+)
+
+const (
+	// fnv-1a 64 bit parameters
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+func hashKey(key string) uint64 {
+	hash := uint64(fnvOffset)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= fnvPrime
+	}
+
+	// fnv of similar keys differs in low bits only, the finalizer of splitmix64 spreads them
+	hash ^= hash >> 30
+	hash *= 0xbf58476d1ce4e5b9
+	hash ^= hash >> 27
+	hash *= 0x94d049bb133111eb
+	hash ^= hash >> 31
+	return hash
+}
+
+// ring is a consistent hash ring of peers. Every peer has replicas points on the ring,
+// so keys are spread evenly and only the keys of a changed peer move to others.
+type ring struct {
+	peers  []string
+	hashes []uint64
+	owners map[uint64]string
+}
+
+func newRing(peers []string, replicas int) *ring {
+	r := &ring{owners: make(map[uint64]string, len(peers)*replicas)}
+	for _, peer := range peers {
+		r.peers = append(r.peers, peer)
+		for i := 0; i < replicas; i++ {
+			hash := hashKey(peer + "#" + strconv.Itoa(i))
+			if _, ok := r.owners[hash]; ok {
+				// collision of points, the first peer keeps it
+				continue
+			}
+			r.owners[hash] = peer
+			r.hashes = append(r.hashes, hash)
+		}
+	}
+
+	sort.Strings(r.peers)
+	sort.Slice(r.hashes, func(i, j int) bool { return r.hashes[i] < r.hashes[j] })
+	return r
+}
+
+// owner returns the peer owning key: the one of the first point after the hash of key
+func (r *ring) owner(key string) string {
+	if len(r.hashes) == 0 {
+		return ""
+	}
+
+	hash := hashKey(key)
+	i := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= hash })
+	if i == len(r.hashes) {
+		i = 0
+	}
+	return r.owners[r.hashes[i]]
+}
@@ -0,0 +1,41 @@
+package peerstorage
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_Owner(t *testing.T) {
+	t.Parallel()
+
+	if got := newRing(nil, 16).owner("key"); got != "" {
+		t.Errorf("empty ring: expected no owner, got %q", got)
+	}
+
+	peers := []string{"a:1", "b:1", "c:1", "d:1"}
+	r := newRing(peers, 128)
+
+	keys := 10000
+	owned := make(map[string]int)
+	owners := make([]string, keys)
+	for i := 0; i < keys; i++ {
+		owners[i] = r.owner(fmt.Sprintf("key-%d", i))
+		owned[owners[i]]++
+	}
+
+	// every peer owns its share of keys give or take a half
+	for _, peer := range peers {
+		if share := keys / len(peers); owned[peer] < share/2 || owned[peer] > share*3/2 {
+			t.Errorf("%s owns %d of %d keys", peer, owned[peer], keys)
+		}
+	}
+
+	// only the keys of the removed peer move
+	removed := newRing(peers[:3], 128)
+	for i := 0; i < keys; i++ {
+		owner := removed.owner(fmt.Sprintf("key-%d", i))
+		if owners[i] != "d:1" && owner != owners[i] {
+			t.Fatalf("key-%d moved from %s to %s", i, owners[i], owner)
+		}
+	}
+}
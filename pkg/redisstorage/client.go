@@ -0,0 +1,105 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	rcmdASKING = "ASKING"
+
+	// maxRedirects is the number of MOVED/ASK redirects followed by a single operation
+	maxRedirects = 5
+)
+
+var (
+	ErrTooManyRedirects = fmt.Errorf("too many cluster redirects")
+	ErrNotCluster       = fmt.Errorf("redirect to another node without cluster client")
+)
+
+// client provides connections to the node that serves a key
+type client interface {
+	// conn returns connection to the node serving key.
+	conn(ctx context.Context, key string) (redis.Conn, error)
+	// connAddr returns connection to the node by its address. Empty addr means any node.
+	connAddr(ctx context.Context, addr string) (redis.Conn, error)
+	// nodes returns addresses of all nodes holding keys.
+	nodes() []string
+	// moved records the new owner of slot after MOVED redirect.
+	moved(slot int, addr string)
+	// failed is called on operation errors. Returns true if the operation should be retried.
+	failed(err error) bool
+	close() error
+}
+
+// poolClient is a client of a single Redis server
+type poolClient struct {
+	pool *redis.Pool
+}
+
+func (c *poolClient) conn(ctx context.Context, _ string) (redis.Conn, error) {
+	return c.pool.GetContext(ctx)
+}
+
+func (c *poolClient) connAddr(ctx context.Context, addr string) (redis.Conn, error) {
+	if addr != "" {
+		return nil, ErrNotCluster
+	}
+	return c.pool.GetContext(ctx)
+}
+
+func (c *poolClient) nodes() []string {
+	return []string{""}
+}
+
+func (c *poolClient) moved(int, string) {}
+
+func (c *poolClient) failed(error) bool {
+	return false
+}
+
+func (c *poolClient) close() error {
+	return c.pool.Close()
+}
+
+// redirect parses MOVED and ASK errors: "MOVED 3999 127.0.0.1:6381"
+func redirect(err error) (kind string, slot int, addr string, ok bool) {
+	var rerr redis.Error
+	if !errors.As(err, &rerr) {
+		return
+	}
+
+	parts := strings.Fields(string(rerr))
+	if len(parts) != 3 || (parts[0] != "MOVED" && parts[0] != "ASK") {
+		return
+	}
+
+	slot, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return
+	}
+	return parts[0], slot, parts[2], true
+}
+
+// readOnly reports whether err is READONLY reply of a replica, the command was not run
+func readOnly(err error) bool {
+	var rerr redis.Error
+	return errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "READONLY")
+}
+
+// askingConn sends ASKING before every command, since the flag is reset after a single command
+type askingConn struct {
+	redis.Conn
+}
+
+func (c askingConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if _, err := c.Conn.Do(rcmdASKING); err != nil {
+		return nil, fmt.Errorf("failed to send asking: %w", err)
+	}
+	return c.Conn.Do(command, args...)
+}
@@ -0,0 +1,282 @@
+package redisstorage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	rcmdCLUSTER = "CLUSTER"
+
+	// slotCount is the number of hash slots of Redis Cluster
+	slotCount = 16384
+)
+
+var (
+	ErrNoClusterAddrs = fmt.Errorf("no cluster addresses specified")
+	ErrNilClusterDial = fmt.Errorf("cluster dial is nil")
+	ErrNoSlotOwner    = fmt.Errorf("no node serves the slot")
+)
+
+// ClusterConfig is used to NewRSCluster. It setups connections to Redis Cluster.
+type ClusterConfig struct {
+	// Addrs are the seed nodes used to discover slots of the cluster.
+	Addrs []string
+	// Dial connects to a node by its address.
+	Dial func(addr string) (redis.Conn, error)
+	// MaxActive is the maximum number of connections per node. Zero means no limit.
+	MaxActive uint
+}
+
+// NewRSCluster returns storage working with Redis Cluster. Slots are discovered with
+// CLUSTER SLOTS and updated on MOVED redirects, ASK redirects are followed once.
+// Every operation but TakeMany touches a single key. TakeMany fails with CROSSSLOT unless all
+// of its keys share a slot, use Config.HashTag to place related keys on the same slot.
+func NewRSCluster(cfg *Config, cluster *ClusterConfig) (*RedisStorage, error) {
+	if cluster == nil || len(cluster.Addrs) == 0 {
+		return nil, ErrNoClusterAddrs
+	}
+
+	if cluster.Dial == nil {
+		return nil, ErrNilClusterDial
+	}
+
+	c := &clusterClient{
+		seeds:     cluster.Addrs,
+		dial:      cluster.Dial,
+		maxActive: int(cluster.MaxActive),
+		pools:     make(map[string]*redis.Pool),
+	}
+
+	if err := c.refresh(); err != nil {
+		return nil, err
+	}
+
+	return newRS(cfg, newRedigoScripter(c, nil))
+}
+
+// clusterClient routes keys to the nodes of Redis Cluster
+type clusterClient struct {
+	seeds     []string
+	dial      func(addr string) (redis.Conn, error)
+	maxActive int
+
+	// lock guards slots and pools
+	lock  sync.RWMutex
+	slots [slotCount]string
+	pools map[string]*redis.Pool
+}
+
+// refresh loads slots from the first seed (or known node) that answers
+func (c *clusterClient) refresh() error {
+	addrs := append([]string(nil), c.seeds...)
+	addrs = append(addrs, c.nodes()...)
+
+	var err error
+	for _, addr := range addrs {
+		var slots [slotCount]string
+		if slots, err = c.loadSlots(addr); err == nil {
+			c.lock.Lock()
+			c.slots = slots
+			c.lock.Unlock()
+			return nil
+		}
+	}
+	return fmt.Errorf("failed to load cluster slots: %w", err)
+}
+
+// loadSlots asks addr for the slots with CLUSTER SLOTS
+func (c *clusterClient) loadSlots(addr string) (slots [slotCount]string, err error) {
+	conn, err := c.dial(addr)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ranges, err := redis.Values(conn.Do(rcmdCLUSTER, "SLOTS"))
+	if err != nil {
+		return
+	}
+
+	for _, r := range ranges {
+		// start, end, master [ip, port, id...], replicas...
+		values, err_ := redis.Values(r, nil)
+		if err_ != nil || len(values) < 3 {
+			err = fmt.Errorf("unexpected slots range %#v", r)
+			return
+		}
+
+		var start, end int
+		var master []interface{}
+		if _, err = redis.Scan(values, &start, &end, &master); err != nil {
+			return
+		}
+
+		var host string
+		var port int
+		if _, err = redis.Scan(master, &host, &port); err != nil {
+			return
+		}
+		if host == "" {
+			// node does not know its own address
+			host, _, _ = net.SplitHostPort(addr)
+		}
+
+		owner := net.JoinHostPort(host, strconv.Itoa(port))
+		for slot := start; slot <= end && slot < slotCount; slot++ {
+			slots[slot] = owner
+		}
+	}
+	return
+}
+
+func (c *clusterClient) pool(addr string) *redis.Pool {
+	c.lock.RLock()
+	pool, ok := c.pools[addr]
+	c.lock.RUnlock()
+	if ok {
+		return pool
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if pool, ok := c.pools[addr]; ok {
+		return pool
+	}
+
+	pool = &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return c.dial(addr)
+		},
+		TestOnBorrow: func(c redis.Conn, _ time.Time) error {
+			_, err := c.Do(rcmdPING)
+			return err
+		},
+		MaxActive:   c.maxActive,
+		IdleTimeout: 5 * time.Minute,
+	}
+	c.pools[addr] = pool
+	return pool
+}
+
+func (c *clusterClient) conn(ctx context.Context, key string) (redis.Conn, error) {
+	slot := keySlot(key)
+
+	c.lock.RLock()
+	addr := c.slots[slot]
+	c.lock.RUnlock()
+
+	if addr == "" {
+		if err := c.refresh(); err != nil {
+			return nil, err
+		}
+
+		c.lock.RLock()
+		addr = c.slots[slot]
+		c.lock.RUnlock()
+		if addr == "" {
+			return nil, ErrNoSlotOwner
+		}
+	}
+
+	return c.pool(addr).GetContext(ctx)
+}
+
+func (c *clusterClient) connAddr(ctx context.Context, addr string) (redis.Conn, error) {
+	if addr == "" {
+		nodes := c.nodes()
+		if len(nodes) == 0 {
+			return nil, ErrNoSlotOwner
+		}
+		addr = nodes[0]
+	}
+	return c.pool(addr).GetContext(ctx)
+}
+
+// nodes returns addresses of masters serving any slot
+func (c *clusterClient) nodes() []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+
+	seen := make(map[string]bool)
+	var nodes []string
+	for _, addr := range c.slots {
+		if addr != "" && !seen[addr] {
+			seen[addr] = true
+			nodes = append(nodes, addr)
+		}
+	}
+	return nodes
+}
+
+func (c *clusterClient) moved(slot int, addr string) {
+	if slot < 0 || slot >= slotCount {
+		return
+	}
+
+	c.lock.Lock()
+	c.slots[slot] = addr
+	c.lock.Unlock()
+}
+
+func (c *clusterClient) failed(error) bool {
+	return false
+}
+
+func (c *clusterClient) close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+	for addr, pool := range c.pools {
+		if err_ := pool.Close(); err_ != nil && err == nil {
+			err = err_
+		}
+		delete(c.pools, addr)
+	}
+	return err
+}
+
+// HashTagBefore returns Config.HashTag func that uses the part of the key before the first sep
+// as the hash tag. So "org:42" and "org:42/user:7" land on the same slot with "/" separator.
+func HashTagBefore(sep string) func(key string) string {
+	return func(key string) string {
+		if i := strings.Index(key, sep); i >= 0 {
+			return key[:i]
+		}
+		return key
+	}
+}
+
+// keySlot returns the cluster slot of key respecting {hash tags}
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % slotCount)
+}
+
+// crc16 is CRC16-CCITT (XMODEM) used by Redis Cluster
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
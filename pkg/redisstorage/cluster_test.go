@@ -0,0 +1,354 @@
+package redisstorage
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	rlstorage "pkg/rl-storage"
+)
+
+// fakeCluster is an in-process Redis Cluster built of miniredis servers. It answers
+// CLUSTER SLOTS and emulates MOVED and ASK redirects, everything else is served by miniredis.
+type fakeCluster struct {
+	servers map[string]*miniredis.Miniredis
+	addrs   []string
+
+	lock sync.Mutex
+	// owners are the nodes owning slots: slot -> addr
+	owners [slotCount]string
+	// migrating are the slots being migrated: slot -> target addr
+	migrating map[int]string
+	// redirects is the number of returned redirects
+	redirects int
+}
+
+func newFakeCluster(tb testing.TB, nodes int) *fakeCluster {
+	tb.Helper()
+
+	fc := &fakeCluster{
+		servers:   make(map[string]*miniredis.Miniredis),
+		migrating: make(map[int]string),
+	}
+	for i := 0; i < nodes; i++ {
+		server, err := miniredis.Run()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(server.Close)
+
+		fc.servers[server.Addr()] = server
+		fc.addrs = append(fc.addrs, server.Addr())
+	}
+
+	for slot := range fc.owners {
+		fc.owners[slot] = fc.addrs[slot*nodes/slotCount]
+	}
+	return fc
+}
+
+func (fc *fakeCluster) dial(addr string) (redis.Conn, error) {
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeNodeConn{Conn: conn, cluster: fc, addr: addr}, nil
+}
+
+// owner returns the node owning key
+func (fc *fakeCluster) owner(key string) string {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	return fc.owners[keySlot(key)]
+}
+
+// move reassigns slot of key to addr
+func (fc *fakeCluster) move(key, addr string) {
+	fc.lock.Lock()
+	fc.owners[keySlot(key)] = addr
+	fc.lock.Unlock()
+}
+
+// migrate marks slot of key as migrating to addr
+func (fc *fakeCluster) migrate(key, addr string) {
+	fc.lock.Lock()
+	fc.migrating[keySlot(key)] = addr
+	fc.lock.Unlock()
+}
+
+func (fc *fakeCluster) slots() []interface{} {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+
+	var ranges []interface{}
+	start := 0
+	for slot := 1; slot <= slotCount; slot++ {
+		if slot < slotCount && fc.owners[slot] == fc.owners[start] {
+			continue
+		}
+
+		host, port, _ := net.SplitHostPort(fc.owners[start])
+		portNumber, _ := strconv.Atoi(port)
+		ranges = append(ranges, []interface{}{
+			int64(start), int64(slot - 1),
+			[]interface{}{[]byte(host), int64(portNumber), []byte("node")},
+		})
+		start = slot
+	}
+	return ranges
+}
+
+type fakeNodeConn struct {
+	redis.Conn
+	cluster *fakeCluster
+	addr    string
+	asking  bool
+}
+
+// commandKey returns the key of the command if it has one
+func commandKey(command string, args []interface{}) (string, bool) {
+	index := 0
+	switch strings.ToUpper(command) {
+	case "", "PING", "SCAN", "SCRIPT":
+		return "", false
+	case "EVAL", "EVALSHA":
+		index = 2
+	}
+
+	if len(args) <= index {
+		return "", false
+	}
+	return fmt.Sprint(args[index]), true
+}
+
+func (c *fakeNodeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	switch strings.ToUpper(command) {
+	case "CLUSTER":
+		return c.cluster.slots(), nil
+	case "ASKING":
+		c.asking = true
+		return "OK", nil
+	}
+
+	asking := c.asking
+	c.asking = false
+
+	if key, ok := commandKey(command, args); ok {
+		slot := keySlot(key)
+
+		c.cluster.lock.Lock()
+		owner, target := c.cluster.owners[slot], c.cluster.migrating[slot]
+		var redirect error
+		switch {
+		case c.addr == owner && target != "":
+			redirect = redis.Error(fmt.Sprintf("ASK %d %s", slot, target))
+		case c.addr == owner, c.addr == target && asking:
+		default:
+			redirect = redis.Error(fmt.Sprintf("MOVED %d %s", slot, owner))
+		}
+		if redirect != nil {
+			c.cluster.redirects++
+		}
+		c.cluster.lock.Unlock()
+
+		if redirect != nil {
+			return nil, redirect
+		}
+	}
+
+	return c.Conn.Do(command, args...)
+}
+
+func testClusterStorage(tb testing.TB, fc *fakeCluster, cfg *Config) *RedisStorage {
+	tb.Helper()
+
+	storage, err := NewRSCluster(cfg, &ClusterConfig{
+		Addrs: fc.addrs[:1],
+		Dial:  fc.dial,
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return storage
+}
+
+func TestKeySlot(t *testing.T) {
+	t.Parallel()
+
+	type case_ struct {
+		key  string
+		slot int
+	}
+
+	// values from CLUSTER KEYSLOT
+	cases := []case_{
+		{key: "123456789", slot: 12739},
+		{key: "foo", slot: 12182},
+		{key: "{user1000}.following", slot: 3443},
+		{key: "{user1000}.followers", slot: 3443},
+		{key: "foo{}{bar}", slot: 8363},
+		{key: "foo{{bar}}zap", slot: 4015},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.key, func(t *testing.T) {
+			t.Parallel()
+			if got, want := keySlot(c.key), c.slot; got != want {
+				t.Errorf("slot: got %d, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestRedisStorage_Cluster(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fc := newFakeCluster(t, 3)
+	storage := testClusterStorage(t, fc, &Config{Tokens: 10, Interval: time.Minute, Prefix: testPrefix})
+
+	// keys are spread over the nodes
+	keys := make([]string, 30)
+	for i := range keys {
+		keys[i] = key(t)
+		if _, _, _, ok, err := storage.Take(ctx, keys[i]); err != nil || !ok {
+			t.Fatalf("take: %v, %v", ok, err)
+		}
+	}
+	used := make(map[string]bool)
+	for _, key := range keys {
+		owner := fc.owner(testPrefix + key)
+		used[owner] = true
+		if !fc.servers[owner].Exists(testPrefix + key) {
+			t.Errorf("key %s is not stored on its owner %s", key, owner)
+		}
+	}
+	if got, want := len(used), 3; got != want {
+		t.Errorf("nodes used: got %d, want %d", got, want)
+	}
+
+	// scan collects keys of all nodes
+	scanned := 0
+	if err := storage.Scan(ctx, "", func(state rlstorage.KeyState) bool {
+		scanned++
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scanned, len(keys); got != want {
+		t.Errorf("scanned: got %d, want %d", got, want)
+	}
+
+	// scripts are loaded on each node again after flush
+	for _, addr := range fc.addrs {
+		conn, err := redis.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Do("SCRIPT", "FLUSH"); err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+	}
+	if _, _, _, _, err := storage.Take(ctx, keys[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRedisStorage_ClusterRedirects(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fc := newFakeCluster(t, 2)
+	storage := testClusterStorage(t, fc, &Config{Tokens: 10, Interval: time.Minute})
+
+	key := key(t)
+	owner := fc.owner(key)
+	other := fc.addrs[0]
+	if other == owner {
+		other = fc.addrs[1]
+	}
+
+	// MOVED: the slot is permanently served by other node
+	fc.move(key, other)
+	if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.servers[other].Exists(key) {
+		t.Errorf("key was not moved")
+	}
+	if got, want := fc.redirects, 1; got != want {
+		t.Errorf("redirects: got %d, want %d", got, want)
+	}
+	// slot is remembered
+	if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fc.redirects, 1; got != want {
+		t.Errorf("redirects: got %d, want %d", got, want)
+	}
+
+	// ASK: the slot is migrating back, the key is served by the target only with ASKING
+	migrated := key + "-migrated"
+	fc.move(migrated, other)
+	fc.migrate(migrated, owner)
+	if err := storage.Set(ctx, migrated, 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if !fc.servers[owner].Exists(migrated) {
+		t.Errorf("key was not asked")
+	}
+}
+
+func TestRedisStorage_ClusterHashTag(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fc := newFakeCluster(t, 3)
+	storage := testClusterStorage(t, fc, &Config{
+		Tokens:   10,
+		Interval: time.Minute,
+		Prefix:   testPrefix,
+		HashTag:  HashTagBefore("/"),
+	})
+
+	org := "org:" + key(t)
+	user := org + "/user:1"
+	for _, key := range []string{org, user} {
+		if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	server := fc.servers[fc.owner("{"+org+"}")]
+	for _, key := range []string{testPrefix + "{" + org + "}" + org, testPrefix + "{" + org + "}" + user} {
+		if !server.Exists(key) {
+			t.Errorf("key %s is not on the tag's node", key)
+		}
+	}
+
+	var scanned []string
+	if err := storage.Scan(ctx, org+"/", func(state rlstorage.KeyState) bool {
+		scanned = append(scanned, state.Key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.Join(scanned, ","), user; got != want {
+		t.Errorf("scan: got %s, want %s", got, want)
+	}
+}
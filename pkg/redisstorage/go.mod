@@ -1,6 +1,7 @@
 module redis-storage
 
 require (
+	github.com/alicebob/miniredis/v2 v2.30.0
 	github.com/gomodule/redigo v1.8.4
 	pkg/rl-storage v1.0.0
 )
@@ -0,0 +1,181 @@
+package redisstorage
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/gomodule/redigo/redis"
+	rlstorage "pkg/rl-storage"
+)
+
+const (
+	rcmdEVAL    = "EVAL"
+	rcmdEVALSHA = "EVALSHA"
+)
+
+// NewRedigoScripter returns Scripter working with a single Redis server through the redigo pool.
+// Use NewRSCluster and NewRSSentinel for Redis Cluster and Sentinel.
+func NewRedigoScripter(pool *redis.Pool) Scripter {
+	return newRedigoScripter(&poolClient{pool: pool}, nil)
+}
+
+func newRedigoScripter(c client, tracer rlstorage.Tracer) *redigoScripter {
+	if tracer == nil {
+		tracer = rlstorage.NopTracer{}
+	}
+	return &redigoScripter{client: c, tracer: tracer}
+}
+
+// redigoScripter is Scripter of redigo connections provided by client
+type redigoScripter struct {
+	client client
+	tracer rlstorage.Tracer
+}
+
+func (s *redigoScripter) EvalSha(ctx context.Context, sha string, keys []string, args ...interface{}) (interface{}, error) {
+	return s.eval(ctx, rcmdEVALSHA, sha, keys, args)
+}
+
+func (s *redigoScripter) Eval(ctx context.Context, src string, keys []string, args ...interface{}) (interface{}, error) {
+	return s.eval(ctx, rcmdEVAL, src, keys, args)
+}
+
+func (s *redigoScripter) eval(ctx context.Context, command, script string, keys []string, args []interface{}) (reply interface{}, err error) {
+	commandArgs := make([]interface{}, 0, 2+len(keys)+len(args))
+	commandArgs = append(commandArgs, script, len(keys))
+	for _, key := range keys {
+		commandArgs = append(commandArgs, key)
+	}
+	commandArgs = append(commandArgs, args...)
+
+	err = s.do(ctx, keys[0], func(conn redis.Conn) (err error) {
+		reply, err = conn.Do(command, commandArgs...)
+		return err
+	})
+	return
+}
+
+func (s *redigoScripter) Del(ctx context.Context, key string) error {
+	return s.do(ctx, key, func(conn redis.Conn) error {
+		_, err := conn.Do(rcmdDEL, key)
+		return err
+	})
+}
+
+func (s *redigoScripter) Scan(ctx context.Context, pattern string, f func(keys []string) bool) error {
+	for _, addr := range s.client.nodes() {
+		if stop, err := s.scanNode(ctx, addr, pattern, f); err != nil || stop {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanNode scans keys of a single node. Returns true if f asked to stop.
+func (s *redigoScripter) scanNode(ctx context.Context, addr, pattern string, f func(keys []string) bool) (bool, error) {
+	conn, err := s.conn(ctx, "", addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	cursor := int64(0)
+	for {
+		if err := ctx.Err(); err != nil {
+			return false, err
+		}
+
+		values, err := redis.Values(conn.Do(rcmdSCAN, cursor, "MATCH", pattern, "COUNT", scanCount))
+		if err != nil {
+			return false, fmt.Errorf("failed to scan keys: %w", err)
+		}
+
+		var keys []string
+		if _, err := redis.Scan(values, &cursor, &keys); err != nil {
+			return false, fmt.Errorf("unexpected scan response: %w", err)
+		}
+
+		if len(keys) > 0 && !f(keys) {
+			return true, nil
+		}
+
+		if cursor == 0 {
+			return false, nil
+		}
+	}
+}
+
+func (s *redigoScripter) Close() error {
+	return s.client.close()
+}
+
+// do calls f with connection to the node serving key following cluster redirects
+// and retrying after failover. f is retried only if it is known not to have run: the
+// connection could not be got or a demoted master rejected the command with READONLY.
+// A connection error after the command was sent resolves the master again but is
+// returned, as the old master could have run it. The time spent waiting for the
+// connection is traced.
+func (s *redigoScripter) do(ctx context.Context, key string, f func(conn redis.Conn) error) error {
+	addr, asking := "", false
+	for i := 0; i <= maxRedirects; i++ {
+		conn, err := s.conn(ctx, key, addr)
+		if err != nil {
+			if s.client.failed(err) {
+				continue
+			}
+			return err
+		}
+
+		if asking {
+			conn = askingConn{conn}
+		}
+
+		err = f(conn)
+		conn.Close()
+
+		kind, slot, target, ok := redirect(err)
+		if !ok {
+			if err != nil && s.client.failed(err) && readOnly(err) {
+				continue
+			}
+			return err
+		}
+
+		switch kind {
+		case "MOVED":
+			s.client.moved(slot, target)
+			addr, asking = "", false
+		case "ASK":
+			addr, asking = target, true
+		}
+	}
+	return ErrTooManyRedirects
+}
+
+// conn gets a connection by key or by node address (if addr is not empty).
+// The time spent waiting for it is traced.
+func (s *redigoScripter) conn(ctx context.Context, key, addr string) (redis.Conn, error) {
+	_, span := s.tracer.Start(ctx, spanPoolWait)
+	defer span.End()
+
+	var (
+		conn redis.Conn
+		err  error
+	)
+	if addr != "" {
+		conn, err = s.client.connAddr(ctx, addr)
+	} else {
+		conn, err = s.client.conn(ctx, key)
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		return nil, fmt.Errorf("failed to get connection from pool: %w", err)
+	}
+	if err := conn.Err(); err != nil {
+		conn.Close()
+		span.RecordError(err)
+		return nil, fmt.Errorf("connection not usable: %w", err)
+	}
+	return conn, nil
+}
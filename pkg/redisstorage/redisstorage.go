@@ -2,8 +2,10 @@ package redisstorage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -12,22 +14,64 @@ import (
 )
 
 const (
-	fieldInterval      = "i"
-	fieldMaxTokens     = "m"
-	fieldCurrentTokens = "k"
-
-	rcmdEXPIRE  = "EXPIRE"
-	rcmdHINCRBY = "HINCRBY"
-	rcmdHMGET   = "HMGET"
-	rcmdHSET    = "HSET"
-	rcmdPING    = "PING"
+	rcmdDEL  = "DEL"
+	rcmdPING = "PING"
+	rcmdSCAN = "SCAN"
+
+	spanTake     = "redisstorage.Take"
+	spanTakeMany = "redisstorage.TakeMany"
+	spanGet      = "redisstorage.Get"
+	spanSet      = "redisstorage.Set"
+	spanBurst    = "redisstorage.Burst"
+	spanDelete   = "redisstorage.Delete"
+	spanReset    = "redisstorage.Reset"
+	spanScan     = "redisstorage.Scan"
+	spanMigrate  = "redisstorage.Migrate"
+	spanPoolWait = "redisstorage.pool_wait"
+	spanScript   = "redisstorage.script"
+	spanCommand  = "redisstorage.command"
+
+	// scanCount is the COUNT hint of a single SCAN call
+	scanCount = 100
 )
 
+var (
+	ErrClockSkew     = fmt.Errorf("client clock differs from redis server clock")
+	ErrSchemaVersion = fmt.Errorf("bucket is written with newer schema version")
+	ErrNilScripter   = fmt.Errorf("scripter is nil")
+	ErrPrefixHashTag = fmt.Errorf("prefix must not contain '{'")
+	// ErrMalformedBucket is reported to Config.OnScanError for buckets with non-numeric fields
+	ErrMalformedBucket = fmt.Errorf("bucket has malformed fields")
+	// ErrNoPrefix is returned by Scan and Migrate without Config.Prefix, as every hash
+	// of the DB could be taken for a bucket then
+	ErrNoPrefix = fmt.Errorf("%w: key prefix is required to scan buckets", rlstorage.ErrNotSupported)
+)
+
+// scriptErrors are the errors raised by scripts by their codes
+var scriptErrors = map[string]error{
+	"CLOCKSKEW":     ErrClockSkew,
+	"SCHEMAVERSION": ErrSchemaVersion,
+}
+
 type RedisStorage struct {
 	tokens   uint64
 	interval time.Duration
-	pool     *redis.Pool
-	script   *redis.Script
+	scripter Scripter
+	prefix   string
+	hashTag  func(key string) string
+	take     *luaScript
+	takeMany *luaScript
+	get      *luaScript
+	set      *luaScript
+	burst    *luaScript
+	reset    *luaScript
+	migrate  *luaScript
+	scan     *luaScript
+	tracer   rlstorage.Tracer
+
+	serverTime   bool
+	maxClockSkew time.Duration
+	onScanError  func(key string, err error)
 
 	stopped uint32
 }
@@ -38,15 +82,53 @@ type Config struct {
 	MaxActive uint
 
 	Dial func() (redis.Conn, error)
+	// Tracer starts a child span per operation with a nested span for script (command)
+	// execution, which contains the span of pool wait. Default is rlstorage.NopTracer.
+	Tracer rlstorage.Tracer
+	// Prefix is prepended to every key, so buckets do not collide with other data of the same DB.
+	// Prefix must not contain '{', otherwise Redis Cluster hashes it instead of HashTag.
+	// Changing it abandons the buckets written with the previous prefix.
+	// Scan and Migrate require it, so they touch the buckets only.
+	Prefix string
+	// HashTag returns the hash tag of key. If set, keys are stored as "{tag}key", so keys
+	// with the same tag land on the same Redis Cluster slot. See HashTagBefore.
+	HashTag func(key string) string
+	// ServerTime makes scripts use the time of the Redis server (TIME) instead of the client clock,
+	// so buckets refill consistently even if the clocks of the clients have drifted.
+	ServerTime bool
+	// MaxClockSkew is the tolerated difference between the client and the server clocks.
+	// Take fails with ErrClockSkew if it is exceeded. Zero disables the check.
+	// It is not used with ServerTime.
+	MaxClockSkew time.Duration
+	// OnScanError is called with the keys Scan and Migrate skip because they could not be read:
+	// buckets written by a newer deploy (ErrSchemaVersion) and malformed ones (ErrMalformedBucket).
+	OnScanError func(key string, err error)
 }
 
 func NewRSWithPool(cfg *Config, pool *redis.Pool) (*RedisStorage, error) {
+	return newRS(cfg, newRedigoScripter(&poolClient{pool: pool}, nil))
+}
+
+// NewRSWithScripter returns storage running its scripts with s. Config.Dial and Config.MaxActive
+// are not used, the connections are managed by s.
+func NewRSWithScripter(cfg *Config, s Scripter) (*RedisStorage, error) {
+	if s == nil {
+		return nil, ErrNilScripter
+	}
+	return newRS(cfg, s)
+}
+
+func newRS(cfg *Config, s Scripter) (*RedisStorage, error) {
 	if cfg == nil {
 		cfg = new(Config)
 	}
 
+	if strings.Contains(cfg.Prefix, "{") {
+		return nil, ErrPrefixHashTag
+	}
+
 	tokens := uint64(1)
-	if cfg.Tokens > 9 {
+	if cfg.Tokens > 0 {
 		tokens = cfg.Tokens
 	}
 
@@ -55,18 +137,57 @@ func NewRSWithPool(cfg *Config, pool *redis.Pool) (*RedisStorage, error) {
 		interval = cfg.Interval
 	}
 
-	script := redis.NewScript(1, script)
+	var tracer rlstorage.Tracer = rlstorage.NopTracer{}
+	if cfg.Tracer != nil {
+		tracer = cfg.Tracer
+	}
+
+	// pool wait of own connections is traced as a part of the operation
+	if redigo, ok := s.(*redigoScripter); ok {
+		redigo.tracer = tracer
+	}
 
 	rs := &RedisStorage{
 		tokens:   tokens,
 		interval: interval,
-		pool:     pool,
-		script:   script,
-		stopped:  0,
+		scripter: s,
+		prefix:   cfg.Prefix,
+		hashTag:  cfg.HashTag,
+		take:     newLuaScript(takeScript),
+		takeMany: newLuaScript(takeManyScript),
+		get:      newLuaScript(getScript),
+		set:      newLuaScript(setScript),
+		burst:    newLuaScript(burstScript),
+		reset:    newLuaScript(resetScript),
+		migrate:  newLuaScript(migrateScript),
+		scan:     newLuaScript(scanScript),
+		tracer:   tracer,
+
+		serverTime:   cfg.ServerTime,
+		maxClockSkew: cfg.MaxClockSkew,
+		onScanError:  cfg.OnScanError,
+
+		stopped: 0,
 	}
 	return rs, nil
 }
 
+// serverTimeString is the script argument telling whether the server time is used
+func (rs *RedisStorage) serverTimeString() string {
+	if rs.serverTime {
+		return "1"
+	}
+	return "0"
+}
+
+// endSpan records err (if any) and finishes span
+func endSpan(span rlstorage.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
+
 func NewRS(cfg *Config) (*RedisStorage, error) {
 	return NewRSWithPool(cfg, &redis.Pool{
 		Dial:        cfg.Dial,
@@ -80,145 +201,417 @@ func NewRS(cfg *Config) (*RedisStorage, error) {
 	})
 }
 
+// key returns the Redis key for the user key: prefix, hash tag and the key itself
+func (rs *RedisStorage) key(key string) string {
+	if rs.hashTag == nil {
+		return rs.prefix + key
+	}
+
+	if tag := rs.hashTag(key); tag != "" {
+		return rs.prefix + "{" + tag + "}" + key
+	}
+	return rs.prefix + key
+}
+
+// userKey is the reverse of key. Returns false if key does not have the prefix.
+func (rs *RedisStorage) userKey(key string) (string, bool) {
+	if !strings.HasPrefix(key, rs.prefix) {
+		return "", false
+	}
+
+	key = key[len(rs.prefix):]
+	if rs.hashTag == nil || !strings.HasPrefix(key, "{") {
+		return key, true
+	}
+
+	if i := strings.IndexByte(key, '}'); i > 0 {
+		return key[i+1:], true
+	}
+	return key, true
+}
+
 func (rs *RedisStorage) Take(ctx context.Context, key string) (limit uint64, remaining uint64, next uint64, ok bool, err error) {
 	if atomic.LoadUint32(&rs.stopped) == 1 {
 		err = rlstorage.ErrStopped
 		return
 	}
 
-	now := uint64(time.Now().UTC().UnixNano())
-	conn, err_ := rs.pool.GetContext(ctx)
-	if err_ != nil {
-		err = fmt.Errorf("failed to get connection from pool: %w", err_)
+	ctx, span := rs.tracer.Start(ctx, spanTake)
+	defer func() { endSpan(span, err) }()
+
+	response, err := rs.eval(ctx, rs.take, key)
+	if err != nil {
 		return
 	}
-	if err_ := conn.Err(); err_ != nil {
-		err = fmt.Errorf("connection not usable: %w", err_)
-		return
+
+	limit, remaining, next, ok = uint64(response[0]), uint64(response[1]), uint64(response[2]), response[3] == 1
+	return
+}
+
+// TakeMany takes tokens from all keys of reqs or from none of them with a single script.
+// With Redis Cluster all keys should share a hash tag (see Config.HashTag), otherwise
+// Redis rejects the script with CROSSSLOT error.
+func (rs *RedisStorage) TakeMany(ctx context.Context, reqs []rlstorage.TakeRequest) (decisions []*rlstorage.Decision, err error) {
+	if atomic.LoadUint32(&rs.stopped) == 1 {
+		return nil, rlstorage.ErrStopped
 	}
-	defer conn.Close()
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+
+	ctx, span := rs.tracer.Start(ctx, spanTakeMany)
+	defer func() { endSpan(span, err) }()
 
-	nowString := strconv.FormatUint(now, 10)
-	tokensString := strconv.FormatUint(rs.tokens, 10)
-	intervalString := strconv.FormatInt(rs.interval.Nanoseconds(), 10)
+	keys, costs := rlstorage.MergeTakeRequests(reqs)
+	args := make([]string, len(keys))
+	for i, key := range keys {
+		args[i] = strconv.FormatUint(costs[key], 10)
+	}
 
-	response, err := redis.Int64s(rs.script.Do(conn, key, nowString, tokensString, intervalString))
+	response, err := rs.evalKeys(ctx, rs.takeMany, keys, args...)
 	if err != nil {
-		err = fmt.Errorf("script error: %w", err)
-		return
+		return nil, err
+	}
+	if len(response) != 1+3*len(keys) {
+		return nil, fmt.Errorf("expected %d values in response %#v", 1+3*len(keys), response)
 	}
 
-	if len(response) != 4 {
-		err = fmt.Errorf("expected 4 values in response %#v", response)
+	allowed := response[0] == 1
+	byKey := make(map[string]*rlstorage.Decision, len(keys))
+	for i, key := range keys {
+		values := response[1+3*i:]
+		byKey[key] = rlstorage.NewDecision(uint64(values[0]), uint64(values[1]), uint64(values[2]), allowed)
 	}
 
-	limit, remaining, next, ok = uint64(response[0]), uint64(response[1]), uint64(response[2]), response[3] == 1
-	return
+	decisions = make([]*rlstorage.Decision, len(reqs))
+	for i, req := range reqs {
+		d := *byKey[req.Key]
+		d.Cost = req.Cost
+		if d.Cost == 0 {
+			d.Cost = 1
+		}
+		decisions[i] = &d
+	}
+	return decisions, nil
 }
 
+// Get reports the limit and the tokens remaining as if the bucket was refilled now. Zeros are
+// returned if key does not exist.
 func (rs *RedisStorage) Get(ctx context.Context, key string) (limit, remainig uint64, err error) {
 	if atomic.LoadUint32(&rs.stopped) == 1 {
 		err = rlstorage.ErrStopped
 		return
 	}
 
-	conn, err_ := rs.pool.GetContext(ctx)
-	if err_ != nil {
-		err = fmt.Errorf("failed to get connection from pool: %w", err)
+	ctx, span := rs.tracer.Start(ctx, spanGet)
+	defer func() { endSpan(span, err) }()
+
+	response, err := rs.eval(ctx, rs.get, key)
+	if err != nil || response[3] == 0 {
 		return
 	}
-	if err_ := conn.Err(); err_ != nil {
-		err = fmt.Errorf("connection not usable: %w", err_)
-		return
+
+	limit, remainig = uint64(response[0]), uint64(response[1])
+	return
+}
+
+// TakeDecision is Take that reports rlstorage.Decision
+func (rs *RedisStorage) TakeDecision(ctx context.Context, key string) (*rlstorage.Decision, error) {
+	limit, remaining, reset, ok, err := rs.Take(ctx, key)
+	if err != nil {
+		return nil, err
 	}
-	defer conn.Close()
+	return rlstorage.NewDecision(limit, remaining, reset, ok), nil
+}
 
-	response, err_ := redis.Int64s(conn.Do(rcmdHMGET, key, fieldMaxTokens, fieldCurrentTokens))
-	if err_ != nil {
-		err = fmt.Errorf("failed to get key fields: %w", err_)
-		return
+// GetDecision is Get that also reports the reset time. Both are read atomically.
+// Missing key is reported as a fresh bucket with the default limit.
+func (rs *RedisStorage) GetDecision(ctx context.Context, key string) (d *rlstorage.Decision, err error) {
+	if atomic.LoadUint32(&rs.stopped) == 1 {
+		return nil, rlstorage.ErrStopped
+	}
+
+	ctx, span := rs.tracer.Start(ctx, spanGet)
+	defer func() { endSpan(span, err) }()
+
+	response, err := rs.eval(ctx, rs.get, key)
+	if err != nil {
+		return nil, err
 	}
 
-	if len(response) != 2 {
-		err_ = fmt.Errorf("expected 2 keys in response: %#v", response)
+	d = rlstorage.NewDecision(uint64(response[0]), uint64(response[1]), uint64(response[2]), response[1] > 0)
+	d.Cost = 0
+	return d, nil
+}
+
+// Set replaces the bucket of key with a full one of tokens per interval
+func (rs *RedisStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) (err error) {
+	if atomic.LoadUint32(&rs.stopped) == 1 {
+		err = rlstorage.ErrStopped
 		return
 	}
 
-	limit, remainig = uint64(response[0]), uint64(response[1])
+	ctx, span := rs.tracer.Start(ctx, spanSet)
+	defer func() { endSpan(span, err) }()
+
+	_, err = rs.eval(ctx, rs.set, key, strconv.FormatUint(tokens, 10), strconv.FormatInt(interval.Nanoseconds(), 10))
 	return
 }
 
-func (rs *RedisStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) (err error) {
+// Burst adds tokens to the bucket of key. The limit could be exceeded until the bucket is refilled.
+func (rs *RedisStorage) Burst(ctx context.Context, key string, tokens uint64) (err error) {
 	if atomic.LoadUint32(&rs.stopped) == 1 {
 		err = rlstorage.ErrStopped
 		return
 	}
-	conn, err_ := rs.pool.GetContext(ctx)
-	if err_ != nil {
-		err = fmt.Errorf("failed to get connection from pool: %w", err_)
+
+	ctx, span := rs.tracer.Start(ctx, spanBurst)
+	defer func() { endSpan(span, err) }()
+
+	_, err = rs.eval(ctx, rs.burst, key, strconv.FormatUint(tokens, 10))
+	return
+}
+
+// Delete removes key with all its fields. The next Take would use the defaults.
+func (rs *RedisStorage) Delete(ctx context.Context, key string) (err error) {
+	if atomic.LoadUint32(&rs.stopped) == 1 {
+		err = rlstorage.ErrStopped
 		return
 	}
-	if err_ := conn.Err(); err_ != nil {
-		err = fmt.Errorf("connection not usable: %w", err_)
+
+	ctx, span := rs.tracer.Start(ctx, spanDelete)
+	defer func() { endSpan(span, err) }()
+
+	commandCtx, commandSpan := rs.tracer.Start(ctx, spanCommand)
+	err = rs.scripter.Del(commandCtx, rs.key(key))
+	endSpan(commandSpan, err)
+	if err != nil {
+		err = fmt.Errorf("failed to delete key: %w", err)
+	}
+	return
+}
+
+// Reset refills key keeping its limit and interval. Does nothing if key does not exist.
+func (rs *RedisStorage) Reset(ctx context.Context, key string) (err error) {
+	if atomic.LoadUint32(&rs.stopped) == 1 {
+		err = rlstorage.ErrStopped
 		return
 	}
-	defer conn.Close()
 
-	tokensString := strconv.FormatUint(tokens, 10)
-	intervalString := strconv.FormatInt(interval.Nanoseconds(), 10)
+	ctx, span := rs.tracer.Start(ctx, spanReset)
+	defer func() { endSpan(span, err) }()
 
-	if err_ = conn.Send(rcmdHSET, key,
-		fieldCurrentTokens, tokensString,
-		fieldMaxTokens, tokensString,
-		fieldInterval, intervalString,
-	); err_ != nil {
-		err = fmt.Errorf("failed to set key: %w", err_)
+	_, err = rs.eval(ctx, rs.reset, key)
+	return
+}
+
+// eval runs script on the key with the common arguments followed by args. Scripts reply
+// with 5 integers at most, shorter replies are padded with zeros.
+func (rs *RedisStorage) eval(ctx context.Context, script *luaScript, key string, args ...string) (response [5]int64, err error) {
+	values, err := rs.evalKeys(ctx, script, []string{key}, args...)
+	if err != nil {
 		return
 	}
 
-	if err_ := conn.Send(rcmdEXPIRE, key, 24*time.Hour); err_ != nil {
-		err = fmt.Errorf("failed to set expiritaion on key: %w", err_)
+	if len(values) > len(response) {
+		err = fmt.Errorf("expected %d values at most in response %#v", len(response), values)
 		return
 	}
+	copy(response[:], values)
 	return
 }
 
-func (rs *RedisStorage) Burst(ctx context.Context, key string, tokens uint64) (err error) {
+// evalKeys runs script on the keys with the common arguments followed by args and returns
+// its integer reply. All keys should be served by the same node.
+func (rs *RedisStorage) evalKeys(ctx context.Context, script *luaScript, keys []string, args ...string) ([]int64, error) {
+	now := uint64(time.Now().UTC().UnixNano())
+	redisKeys := make([]string, len(keys))
+	for i, key := range keys {
+		redisKeys[i] = rs.key(key)
+	}
+
+	scriptArgs := make([]interface{}, 0, 5+len(args))
+	scriptArgs = append(scriptArgs,
+		strconv.FormatUint(now, 10),
+		strconv.FormatUint(rs.tokens, 10),
+		strconv.FormatInt(rs.interval.Nanoseconds(), 10),
+		rs.serverTimeString(),
+		strconv.FormatInt(rs.maxClockSkew.Nanoseconds(), 10),
+	)
+	for _, arg := range args {
+		scriptArgs = append(scriptArgs, arg)
+	}
+
+	// the pool wait is traced by the scripter within the script span
+	scriptCtx, scriptSpan := rs.tracer.Start(ctx, spanScript)
+	reply, err := script.run(scriptCtx, rs.scripter, redisKeys, scriptArgs...)
+	endSpan(scriptSpan, err)
+	if err != nil {
+		// some servers prefix errors of scripts with ERR and the script position
+		for code, codeErr := range scriptErrors {
+			if strings.Contains(err.Error(), code) {
+				return nil, fmt.Errorf("%w: %s", codeErr, err)
+			}
+		}
+		return nil, fmt.Errorf("script error: %w", err)
+	}
+
+	if _, ok := reply.(int64); ok {
+		reply = []interface{}{reply}
+	}
+	values, err := redis.Int64s(reply, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected script response: %w", err)
+	}
+	return values, nil
+}
+
+// statuses of keys reported by scanScript
+const (
+	scanNotBucket = iota
+	scanBucket
+	// scanOutdated is a bucket of an older schema version
+	scanOutdated
+	// scanNewer is a bucket of a newer schema version
+	scanNewer
+	// scanMalformed is a bucket with non-numeric fields
+	scanMalformed
+)
+
+// scanError reports the key skipped by Scan or Migrate
+func (rs *RedisStorage) scanError(key string, err error) {
+	if rs.onScanError != nil {
+		rs.onScanError(key, err)
+	}
+}
+
+// Scan iterates over keys starting with prefix with SCAN on every node. Remaining tokens are
+// reported as if the bucket was refilled now. Keys that are not buckets (other types or
+// hashes without the bucket fields) are skipped. Buckets that could not be read are skipped and
+// reported to Config.OnScanError. It fails with ErrNoPrefix without Config.Prefix.
+func (rs *RedisStorage) Scan(ctx context.Context, prefix string, f func(state rlstorage.KeyState) bool) (err error) {
 	if atomic.LoadUint32(&rs.stopped) == 1 {
 		err = rlstorage.ErrStopped
 		return
 	}
 
-	conn, err_ := rs.pool.GetContext(ctx)
-	if err_ != nil {
-		err = fmt.Errorf("failed to get connection from pool: %w", err_)
-		return
+	ctx, span := rs.tracer.Start(ctx, spanScan)
+	defer func() { endSpan(span, err) }()
+
+	return rs.scanBuckets(ctx, prefix, func(state rlstorage.KeyState, status int64) bool {
+		return f(state)
+	})
+}
+
+// scanBuckets calls f with every bucket starting with prefix and its status
+func (rs *RedisStorage) scanBuckets(ctx context.Context, prefix string, f func(state rlstorage.KeyState, status int64) bool) (err error) {
+	if rs.prefix == "" {
+		return ErrNoPrefix
 	}
-	if err_ := conn.Err(); err_ != nil {
-		err = fmt.Errorf("connection not usable: %w", err_)
-		return
+
+	// hash tags are in front of keys, so the prefix is checked after the tag is stripped
+	pattern := escapePattern(rs.prefix+prefix) + "*"
+	if rs.hashTag != nil {
+		pattern = escapePattern(rs.prefix) + "*"
 	}
-	defer conn.Close()
 
-	tokensString := strconv.FormatUint(tokens, 10)
-	if err = conn.Send(rcmdHINCRBY, key, fieldCurrentTokens, tokensString); err != nil {
-		err = fmt.Errorf("failed ti inc key^ %w", err)
-		return
+	scanErr := rs.scripter.Scan(ctx, pattern, func(keys []string) bool {
+		for _, key := range keys {
+			userKey, ok := rs.userKey(key)
+			if !ok || !strings.HasPrefix(userKey, prefix) {
+				continue
+			}
+
+			var response [5]int64
+			if response, err = rs.eval(ctx, rs.scan, userKey); err != nil {
+				return false
+			}
+			switch response[0] {
+			case scanNotBucket:
+				continue
+			case scanNewer:
+				rs.scanError(userKey, fmt.Errorf("%w: key %s", ErrSchemaVersion, userKey))
+				continue
+			case scanMalformed:
+				rs.scanError(userKey, fmt.Errorf("%w: key %s", ErrMalformedBucket, userKey))
+				continue
+			}
+
+			state := rlstorage.KeyState{
+				Key:       userKey,
+				Tokens:    uint64(response[1]),
+				Remaining: uint64(response[2]),
+				Interval:  time.Duration(response[3]),
+			}
+			if !f(state, response[0]) {
+				return false
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = scanErr
+	}
+	return
+}
+
+// Migrate upgrades the fields of every bucket to the current schema version. Scripts upgrade
+// buckets on their own when they are written, so Migrate is only needed to finish the upgrade
+// before a deploy that could not read older versions. Returns the number of upgraded buckets.
+// Buckets written by a newer deploy are skipped and reported to Config.OnScanError
+// with ErrSchemaVersion. It fails with ErrNoPrefix without Config.Prefix.
+func (rs *RedisStorage) Migrate(ctx context.Context) (migrated int, err error) {
+	if atomic.LoadUint32(&rs.stopped) == 1 {
+		return 0, rlstorage.ErrStopped
 	}
 
-	if err_ := conn.Send(rcmdEXPIRE, key, 24*time.Hour); err_ != nil {
-		err = fmt.Errorf("failed to set expiritaion on key: %w", err_)
-		return
+	ctx, span := rs.tracer.Start(ctx, spanMigrate)
+	defer func() { endSpan(span, err) }()
+
+	var migrateErr error
+	err = rs.scanBuckets(ctx, "", func(state rlstorage.KeyState, status int64) bool {
+		if status != scanOutdated {
+			return true
+		}
+
+		var response [5]int64
+		if response, migrateErr = rs.eval(ctx, rs.migrate, state.Key); migrateErr != nil {
+			if !errors.Is(migrateErr, ErrSchemaVersion) {
+				return false
+			}
+			// upgraded by a newer deploy since it was scanned
+			rs.scanError(state.Key, migrateErr)
+			migrateErr = nil
+			return true
+		}
+		migrated += int(response[0])
+		return true
+	})
+	if err == nil {
+		err = migrateErr
 	}
 	return
 }
 
+// escapePattern escapes glob special characters of s for MATCH
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteRune('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
 func (rs *RedisStorage) Close(_ context.Context) error {
 	if !atomic.CompareAndSwapUint32(&rs.stopped, 0, 1) {
 		return nil
 	}
 
-	if err := rs.pool.Close(); err != nil {
+	if err := rs.scripter.Close(); err != nil {
 		return err
 	}
 
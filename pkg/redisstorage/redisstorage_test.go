@@ -4,13 +4,21 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/gomodule/redigo/redis"
 	"os"
+	rlstorage "pkg/rl-storage"
+	"reflect"
+	"strconv"
 	"testing"
 	"time"
 )
 
+// testPrefix is the prefix of the keys of testStorage
+const testPrefix = "rl-test:"
+
 func key(tb testing.TB) string {
 	tb.Helper()
 
@@ -23,39 +31,49 @@ func key(tb testing.TB) string {
 	return key[:64]
 }
 
-func TestRedisStorage_All(t *testing.T) {
-	t.Parallel()
+// testStorage returns storage connected to the Redis specified by REDIS_HOST, REDIS_PORT
+// and REDIS_PASSWORD environment (see test/docker-compose.test.yml) or to miniredis otherwise.
+// Keys are prefixed with testPrefix.
+func testStorage(tb testing.TB, tokens uint64, interval time.Duration) *RedisStorage {
+	tb.Helper()
 
-	ctx := context.Background()
 	host := os.Getenv("REDIS_HOST")
 	if host == "" {
-		t.Fatal("missing \"REDIS_HOST\"")
+		storage, _ := testMiniStorage(tb, &Config{Tokens: tokens, Interval: interval, Prefix: testPrefix})
+		return storage
 	}
+
 	port := os.Getenv("REDIS_PORT")
 	if port == "" {
-		t.Fatal("missing \"REDIS_PORT\"")
+		tb.Fatal("missing \"REDIS_PORT\"")
 	}
 	password := os.Getenv("REDIS_PASSWORD")
-	if password == "" {
-		t.Fatal("missing \"REDIS_PASSWORD\"")
-	}
 
 	storage, err := NewRS(&Config{
-		Tokens:   15,
-		Interval: 1 * time.Second,
+		Tokens:   tokens,
+		Interval: interval,
+		Prefix:   testPrefix,
 		Dial: func() (redis.Conn, error) {
 			return redis.Dial("tcp", host+":"+port, redis.DialPassword(password))
 		},
 	})
 	if err != nil {
-		t.Fatal(err)
+		tb.Fatal(err)
 	}
 
-	t.Cleanup(func() {
-		if err := storage.Close(ctx); err != nil {
-			t.Fatal(err)
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
 		}
 	})
+	return storage
+}
+
+func TestRedisStorage_All(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := testStorage(t, 15, 1*time.Second)
 
 	key := key(t)
 
@@ -156,3 +174,526 @@ func TestRedisStorage_All(t *testing.T) {
 		t.Errorf("reset: got %v, want to be less than %v", got, want)
 	}
 }
+
+func TestRedisStorage_ResetDeleteScan(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage := testStorage(t, 15, 1*time.Second)
+
+	prefix := key(t)[:16] + ":"
+	key := prefix + key(t)
+
+	if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Reset(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	_, remaining, err := storage.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining, uint64(15); got != want {
+		t.Errorf("remaining: got %d, want %d", got, want)
+	}
+
+	var states []rlstorage.KeyState
+	if err := storage.Scan(ctx, prefix, func(state rlstorage.KeyState) bool {
+		states = append(states, state)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := states, []rlstorage.KeyState{{Key: key, Tokens: 15, Remaining: 15, Interval: 1 * time.Second}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scan: got %v, want %v", got, want)
+	}
+
+	if err := storage.Delete(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	limit, _, err := storage.Get(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := limit, uint64(0); got != want {
+		t.Errorf("limit: got %d, want %d", got, want)
+	}
+}
+
+// testMiniStorage returns storage connected to a miniredis server
+func testMiniStorage(tb testing.TB, cfg *Config) (*RedisStorage, *miniredis.Miniredis) {
+	tb.Helper()
+
+	server, err := miniredis.Run()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(server.Close)
+
+	cfg.Dial = func() (redis.Conn, error) {
+		return redis.Dial("tcp", server.Addr())
+	}
+	storage, err := NewRS(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return storage, server
+}
+
+func TestRedisStorage_ServerTime(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage, server := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute, ServerTime: true})
+
+	// server clock is an hour behind the client
+	serverNow := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	server.SetTime(serverNow)
+
+	_, _, next, ok, err := storage.Take(ctx, key(t))
+	if err != nil || !ok {
+		t.Fatalf("take: %v, %v", ok, err)
+	}
+	if got, want := time.Unix(0, int64(next)), serverNow.Add(time.Minute); got.Sub(want) > time.Millisecond || want.Sub(got) > time.Millisecond {
+		t.Errorf("next: got %v, want %v", got, want)
+	}
+}
+
+type parentKey struct{}
+
+// parentTracer records the names of the started spans with the names of their parents
+type parentTracer struct {
+	spans []string
+}
+
+type parentSpan struct{}
+
+func (parentSpan) SetAttribute(key string, value interface{}) {}
+func (parentSpan) RecordError(err error)                      {}
+func (parentSpan) End()                                       {}
+
+func (t *parentTracer) Start(ctx context.Context, name string) (context.Context, rlstorage.Span) {
+	if parent, ok := ctx.Value(parentKey{}).(string); ok {
+		name = parent + "/" + name
+	}
+	t.spans = append(t.spans, name)
+	return context.WithValue(ctx, parentKey{}, name), parentSpan{}
+}
+
+func TestRedisStorage_Tracer(t *testing.T) {
+	t.Parallel()
+
+	tracer := new(parentTracer)
+	storage, _ := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute, Tracer: tracer})
+	if _, _, _, _, err := storage.Take(context.Background(), key(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	// the first EVALSHA fails with NOSCRIPT and EVAL waits for the pool again
+	want := []string{
+		spanTake,
+		spanTake + "/" + spanScript,
+		spanTake + "/" + spanScript + "/" + spanPoolWait,
+		spanTake + "/" + spanScript + "/" + spanPoolWait,
+	}
+	if got := tracer.spans; !reflect.DeepEqual(got, want) {
+		t.Errorf("spans: got %v, want %v", got, want)
+	}
+}
+
+func TestRedisStorage_MaxClockSkew(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage, server := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute, MaxClockSkew: time.Second})
+
+	key := key(t)
+	if _, _, _, ok, err := storage.Take(ctx, key); err != nil || !ok {
+		t.Fatalf("take: %v, %v", ok, err)
+	}
+
+	server.SetTime(time.Now().Add(time.Hour))
+	if _, _, _, _, err := storage.Take(ctx, key); !errors.Is(err, ErrClockSkew) {
+		t.Errorf("take: got %v, want %v", err, ErrClockSkew)
+	}
+}
+
+func TestRedisStorage_Tokens(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	// limits below 10 used to be replaced by the default of one token
+	for _, tokens := range []uint64{0, 1, 5, 9, 10} {
+		storage, _ := testMiniStorage(t, &Config{Tokens: tokens, Interval: time.Minute})
+
+		want := tokens
+		if want == 0 {
+			want = 1
+		}
+		limit, remaining, _, ok, err := storage.Take(ctx, key(t))
+		if err != nil || !ok {
+			t.Fatalf("tokens %d: take: %v, %v", tokens, ok, err)
+		}
+		if limit != want || remaining != want-1 {
+			t.Errorf("tokens %d: got %d/%d, want %d/%d", tokens, remaining, limit, want-1, want)
+		}
+	}
+}
+
+func TestRedisStorage_Refill(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage, server := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute, ServerTime: true})
+
+	start := time.Now().Truncate(time.Microsecond)
+	server.SetTime(start)
+
+	key := key(t)
+	for i := 0; i < 11; i++ {
+		if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d, err := storage.GetDecision(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Allowed || d.Remaining != 0 {
+		t.Errorf("decision: got %+v, want no remaining tokens", d)
+	}
+
+	// the next interval -- get reports the refilled bucket without changing it
+	server.SetTime(start.Add(90 * time.Second))
+	d, err = storage.GetDecision(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := d.Remaining, uint64(10); got != want {
+		t.Errorf("remaining: got %d, want %d", got, want)
+	}
+	// nanoseconds are not exact in Lua numbers
+	if got, want := d.ResetAt, start.Add(2*time.Minute); got.Sub(want) > time.Microsecond || want.Sub(got) > time.Microsecond {
+		t.Errorf("reset: got %v, want %v", got, want)
+	}
+	if got, want := server.HGet(key, "k"), "0"; got != want {
+		t.Errorf("stored tokens: got %s, want %s", got, want)
+	}
+
+	_, remaining, _, ok, err := storage.Take(ctx, key)
+	if err != nil || !ok {
+		t.Fatalf("take: %v, %v", ok, err)
+	}
+	if got, want := remaining, uint64(9); got != want {
+		t.Errorf("remaining: got %d, want %d", got, want)
+	}
+
+	// burst on a missing key creates the full bucket first
+	burst := key + "-burst"
+	if err := storage.Burst(ctx, burst, 3); err != nil {
+		t.Fatal(err)
+	}
+	limit, remaining, err := storage.Get(ctx, burst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limit != 10 || remaining != 13 {
+		t.Errorf("get: got %d/%d, want 13/10", remaining, limit)
+	}
+}
+
+func TestRedisStorage_TakeMany(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage, _ := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute})
+
+	user, org := key(t), key(t)
+	if err := storage.Set(ctx, org, 3, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	requests := []rlstorage.TakeRequest{{Key: user}, {Key: org, Cost: 2}}
+	decisions, err := storage.TakeMany(ctx, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(decisions), 2; got != want {
+		t.Fatalf("decisions: got %d, want %d", got, want)
+	}
+	if !decisions[0].Allowed || decisions[0].Limit != 10 || decisions[0].Remaining != 9 || decisions[0].Cost != 1 {
+		t.Errorf("unexpected user decision %+v", decisions[0])
+	}
+	if !decisions[1].Allowed || decisions[1].Limit != 3 || decisions[1].Remaining != 1 || decisions[1].Cost != 2 {
+		t.Errorf("unexpected org decision %+v", decisions[1])
+	}
+
+	// org has not enough tokens -- nothing is taken from user either
+	decisions, err = storage.TakeMany(ctx, requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decisions[0].Allowed || decisions[1].Allowed {
+		t.Errorf("expected not allowed: %+v, %+v", decisions[0], decisions[1])
+	}
+	_, remaining, err := storage.Get(ctx, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := remaining, uint64(9); got != want {
+		t.Errorf("user remaining: got %d, want %d", got, want)
+	}
+}
+
+func TestRedisStorage_PrefixSchemaVersion(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	storage, server := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute, Prefix: "rl:"})
+
+	key := key(t)
+	if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if !server.Exists("rl:" + key) {
+		t.Fatalf("key is not prefixed")
+	}
+	if got, want := server.HGet("rl:"+key, "v"), schemaVersion; got != want {
+		t.Errorf("version: got %s, want %s", got, want)
+	}
+
+	// foreign data of the same DB is neither scanned nor migrated
+	server.HSet(key, "m", "10")
+	// neither are hashes and other keys under the prefix which are not buckets
+	server.HSet("rl:"+key+"-hash", "m", "10")
+	if err := server.Set("rl:"+key+"-string", "10"); err != nil {
+		t.Fatal(err)
+	}
+	// legacy bucket written before the version field was added
+	legacy := key + "-legacy"
+	server.HSet("rl:"+legacy, "s", "1.7e+18", "t", "0", "i", "60000000000", "k", "4", "m", "10")
+
+	var scanned []string
+	if err := storage.Scan(ctx, "", func(state rlstorage.KeyState) bool {
+		scanned = append(scanned, state.Key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(scanned), 2; got != want {
+		t.Errorf("scanned: got %v, want %d keys", scanned, want)
+	}
+
+	migrated, err := storage.Migrate(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := migrated, 1; got != want {
+		t.Errorf("migrated: got %d, want %d", got, want)
+	}
+	if got, want := server.HGet("rl:"+legacy, "v"), schemaVersion; got != want {
+		t.Errorf("legacy version: got %s, want %s", got, want)
+	}
+	if got, want := server.HGet("rl:"+legacy, "k"), "4"; got != want {
+		t.Errorf("legacy tokens: got %s, want %s", got, want)
+	}
+	for _, foreign := range []string{key, "rl:" + key + "-hash"} {
+		if server.HGet(foreign, "v") != "" {
+			t.Errorf("foreign key %s was migrated", foreign)
+		}
+	}
+
+	// bucket written by a newer deploy is not overwritten
+	server.HSet("rl:"+key, "v", "99")
+	if _, _, _, _, err := storage.Take(ctx, key); !errors.Is(err, ErrSchemaVersion) {
+		t.Errorf("take: got %v, want %v", err, ErrSchemaVersion)
+	}
+}
+
+func TestRedisStorage_ScanErrors(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	skipped := make(map[string]error)
+	storage, server := testMiniStorage(t, &Config{
+		Tokens:   10,
+		Interval: time.Minute,
+		Prefix:   "rl:",
+		OnScanError: func(key string, err error) {
+			skipped[key] = err
+		},
+	})
+
+	if _, _, _, _, err := storage.Take(ctx, "good"); err != nil {
+		t.Fatal(err)
+	}
+	// written by a newer deploy
+	server.HSet("rl:newer", "v", "99", "m", "10")
+	// foreign hashes with non-numeric fields
+	server.HSet("rl:malformed", "m", "ten", "k", "1", "i", "60000000000")
+	server.HSet("rl:version", "v", "one")
+	server.HSet("rl:interval", "v", schemaVersion, "m", "10", "k", "1", "i", "0")
+	// not a bucket at all
+	server.HSet("rl:foreign", "m", "ten")
+
+	var scanned []string
+	if err := storage.Scan(ctx, "", func(state rlstorage.KeyState) bool {
+		scanned = append(scanned, state.Key)
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := scanned, []string{"good"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("scanned: got %v, want %v", got, want)
+	}
+
+	want := map[string]error{
+		"newer":     ErrSchemaVersion,
+		"malformed": ErrMalformedBucket,
+		"version":   ErrMalformedBucket,
+		"interval":  ErrMalformedBucket,
+	}
+	if got := len(skipped); got != len(want) {
+		t.Errorf("skipped: got %v, want %v", skipped, want)
+	}
+	for key, wantErr := range want {
+		if err := skipped[key]; !errors.Is(err, wantErr) {
+			t.Errorf("skipped %s: got %v, want %v", key, err, wantErr)
+		}
+	}
+
+	// migrate goes on over the skipped keys
+	if _, err := storage.Migrate(ctx); err != nil {
+		t.Errorf("migrate: got %v", err)
+	}
+	if got, want := server.HGet("rl:newer", "v"), "99"; got != want {
+		t.Errorf("newer version: got %s, want %s", got, want)
+	}
+}
+
+func TestRedisStorage_ScriptEdgeCases(t *testing.T) {
+	t.Parallel()
+
+	type case_ struct {
+		name     string
+		interval time.Duration
+		// prepare changes the server before the take
+		prepare func(server *miniredis.Miniredis, key string, start time.Time)
+		// limit and remaining after the take
+		limit, remaining uint64
+		ttl              time.Duration
+	}
+
+	cases := []case_{
+		{
+			name:     "new key",
+			interval: time.Minute,
+			prepare:  func(*miniredis.Miniredis, string, time.Time) {},
+			limit:    2, remaining: 1, ttl: 3 * time.Minute,
+		},
+		{
+			name:     "sub-second interval rounds ttl up",
+			interval: 100 * time.Millisecond,
+			prepare:  func(*miniredis.Miniredis, string, time.Time) {},
+			limit:    2, remaining: 1, ttl: 3 * time.Second,
+		},
+		{
+			name:     "expired key",
+			interval: time.Minute,
+			prepare: func(server *miniredis.Miniredis, key string, start time.Time) {
+				server.HSet(key, "s", "0", "t", "0", "i", "60000000000", "k", "0", "m", "2")
+				server.SetTTL(key, time.Second)
+				server.FastForward(2 * time.Second)
+			},
+			limit: 2, remaining: 1, ttl: 3 * time.Minute,
+		},
+		{
+			name:     "only limit field",
+			interval: time.Minute,
+			prepare: func(server *miniredis.Miniredis, key string, start time.Time) {
+				server.HSet(key, "m", "5")
+			},
+			limit: 5, remaining: 4, ttl: 3 * time.Minute,
+		},
+		{
+			name:     "no limit field",
+			interval: time.Minute,
+			prepare: func(server *miniredis.Miniredis, key string, start time.Time) {
+				server.HSet(key, "k", "1")
+			},
+			limit: 2, remaining: 0, ttl: 3 * time.Minute,
+		},
+		{
+			name:     "server clock moved backwards",
+			interval: time.Minute,
+			prepare: func(server *miniredis.Miniredis, key string, start time.Time) {
+				server.HSet(key, "s", strconv.FormatInt(start.Add(time.Hour).UnixNano(), 10), "t", "0", "k", "1", "m", "2")
+			},
+			limit: 2, remaining: 0, ttl: 3 * time.Minute,
+		},
+		{
+			name:     "many intervals passed",
+			interval: time.Minute,
+			prepare: func(server *miniredis.Miniredis, key string, start time.Time) {
+				server.HSet(key, "s", strconv.FormatInt(start.Add(-time.Hour).UnixNano(), 10), "t", "3", "k", "0", "m", "2")
+			},
+			limit: 2, remaining: 1, ttl: 3 * time.Minute,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+
+			ctx := context.Background()
+			storage, server := testMiniStorage(t, &Config{Tokens: 2, Interval: c.interval, ServerTime: true})
+			start := time.Now().Truncate(time.Microsecond)
+			server.SetTime(start)
+
+			key := key(t)
+			c.prepare(server, key, start)
+
+			limit, remaining, _, _, err := storage.Take(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if limit != c.limit || remaining != c.remaining {
+				t.Errorf("take: got %d/%d, want %d/%d", remaining, limit, c.remaining, c.limit)
+			}
+			if got, want := server.TTL(key), c.ttl; got != want {
+				t.Errorf("ttl: got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestRedisStorage_ScanPrefix(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	if _, err := NewRSWithScripter(&Config{Prefix: "{rl}:"}, newRedigoScripter(&poolClient{pool: &redis.Pool{}}, nil)); !errors.Is(err, ErrPrefixHashTag) {
+		t.Errorf("prefix: got %v, want %v", err, ErrPrefixHashTag)
+	}
+
+	// without prefix every hash of the DB could be taken for a bucket
+	storage, server := testMiniStorage(t, &Config{Tokens: 10, Interval: time.Minute})
+	server.HSet("app", "m", "1", "k", "1", "i", "1")
+	err := storage.Scan(ctx, "", func(state rlstorage.KeyState) bool { return true })
+	if !errors.Is(err, ErrNoPrefix) || !errors.Is(err, rlstorage.ErrNotSupported) {
+		t.Errorf("scan: got %v, want %v", err, ErrNoPrefix)
+	}
+	if _, err := storage.Migrate(ctx); !errors.Is(err, ErrNoPrefix) {
+		t.Errorf("migrate: got %v, want %v", err, ErrNoPrefix)
+	}
+	if got := server.HGet("app", "v"); got != "" {
+		t.Errorf("foreign key was migrated")
+	}
+}
@@ -1,27 +1,43 @@
 package redisstorage
 
-const script = `
+// schemaVersion is the version of the layout of the bucket fields written by the scripts.
+// Increment it with a new entry of migrations in scriptHeader when the layout changes.
+const schemaVersion = "1"
+
+// scriptHeader is shared by all scripts: it parses the common arguments, resolves the time
+// and defines functions loading and saving the bucket stored in the hash of a key.
+const scriptHeader = `
 -- constants
+-- SCHEMA_VERSION is the version of the fields layout written by the scripts
+local SCHEMA_VERSION = ` + schemaVersion + `
 -- redis commands
 local RCMD_EXPIRE = 'EXPIRE'
 local RCMD_HGETALL = 'HGETALL'
 local RCMD_HSET = 'HSET'
+local RCMD_TIME = 'TIME'
+local RCMD_TYPE = 'TYPE'
 -- key's fields
 local FIELD_START = 's'
 local FIELD_TICK = 't'
 local FIELD_INTERVAL = 'i'
 local FIELD_CURRENT_TOKENS = 'k'
 local FIELD_MAX_TOKENS = 'm'
+local FIELD_VERSION = 'v'
 
 -- script arguments
 local key = KEYS[1]
--- now is current unix time in nanoseconds, its passed because time should be the time 
+-- now is current unix time in nanoseconds, its passed because time should be the time
 -- of calling not the time of invoking.
 local now = tonumber(ARGV[1])
 -- default tokens for interval. It should be used if there is no value exists for the key.
 local defaultMaxTokens = tonumber(ARGV[2])
 -- default interval in nanoseconds. Same as defaultmaxtokens.
 local defaultInterval = tonumber(ARGV[3])
+-- useServerTime is 1 if the time of the redis server should be used instead of now.
+local useServerTime = tonumber(ARGV[4]) == 1
+-- maxClockSkew in nanoseconds is the tolerated difference between now and the server time.
+-- Zero disables the check.
+local maxClockSkew = tonumber(ARGV[5])
 
 -- utility functions
 local function hashGetAll(key)
@@ -35,9 +51,20 @@ local function hashGetAll(key)
     return result
 end
 
+local function serverTime()
+    -- TIME is non deterministic, so writes after it should be replicated as effects
+    -- (it is the default since redis 5)
+    if redis.replicate_commands then
+        redis.replicate_commands()
+    end
+
+    local time = redis.call(RCMD_TIME)
+    return tonumber(time[1]) * 1000000000 + tonumber(time[2]) * 1000
+end
+
 local function availableTokens(lastTick, current, maxTokens, fillRate)
     local delta = current - lastTick
-    local availableTkns = delta * fillRate
+    local availableTkns = math.floor(delta * fillRate)
 
     if availableTkns > maxTokens then
         availableTkns = maxTokens
@@ -61,68 +88,268 @@ local function tick(start, current, interval)
 end
 
 local function timeToLive(interval)
-    return 3 * math.floor(interval / 1000000000)
+    local ttl = 3 * math.ceil(interval / 1000000000)
+
+    if ttl > 0 then
+        return ttl
+    end
+
+    return 1
+end
+
+-- integer formats numbers without exponent, so nanoseconds are stored precisely enough
+local function integer(val)
+    return string.format('%d', val)
+end
+
+-- migrations[v] upgrades the fields of version v to version v + 1.
+-- Buckets written before the version field was added are version 0.
+local migrations = {
+    -- version 1 has the same fields, numbers of version 0 could be written with exponent
+    [0] = function(data)
+        return data
+    end,
+}
+
+-- migrate upgrades the fields of the key to SCHEMA_VERSION. Newer versions are written
+-- by a newer deploy and could not be read safely. Returns the fields and true if they were upgraded.
+local function migrate(key, data)
+    local version = 0
+    if isPresent(data[FIELD_VERSION]) then
+        version = tonumber(data[FIELD_VERSION])
+    end
+
+    if version > SCHEMA_VERSION then
+        error('SCHEMAVERSION key ' .. key .. ' has schema version ' .. version ..
+            ' newer than ' .. SCHEMA_VERSION)
+    end
+
+    for v = version, SCHEMA_VERSION - 1 do
+        data = migrations[v](data)
+    end
+    return data, version < SCHEMA_VERSION
+end
+
+-- load returns the bucket of the key. Missing fields are filled with defaults.
+local function load(key)
+    local data = hashGetAll(key)
+    local exists = isPresent(data[FIELD_MAX_TOKENS])
+    local migrated = false
+    if exists then
+        data, migrated = migrate(key, data)
+    end
+
+    local bucket = {
+        exists = exists,
+        migrated = migrated,
+        start = now,
+        lastTick = 0,
+        maxTokens = defaultMaxTokens,
+        interval = defaultInterval,
+    }
+
+    if isPresent(data[FIELD_START]) then
+        bucket.start = tonumber(data[FIELD_START])
+    end
+    if isPresent(data[FIELD_TICK]) then
+        bucket.lastTick = tonumber(data[FIELD_TICK])
+    end
+    if isPresent(data[FIELD_MAX_TOKENS]) then
+        bucket.maxTokens = tonumber(data[FIELD_MAX_TOKENS])
+    end
+    if isPresent(data[FIELD_INTERVAL]) then
+        bucket.interval = tonumber(data[FIELD_INTERVAL])
+    end
+
+    bucket.tokens = bucket.maxTokens
+    if isPresent(data[FIELD_CURRENT_TOKENS]) then
+        bucket.tokens = tonumber(data[FIELD_CURRENT_TOKENS])
+    end
+
+    return bucket
+end
+
+-- refill adds the tokens for the ticks passed since the last refill. Returns the reset time.
+local function refill(bucket)
+    local currentTick = tick(bucket.start, now, bucket.interval)
+
+    if bucket.lastTick < currentTick then
+        local rate = bucket.interval / bucket.maxTokens
+        bucket.tokens = availableTokens(bucket.lastTick, currentTick, bucket.maxTokens, rate)
+        bucket.lastTick = currentTick
+    end
+
+    return bucket.start + ((currentTick + 1) * bucket.interval)
+end
+
+-- save stores all fields of the bucket and prolongs the key
+local function save(key, bucket)
+    redis.call(RCMD_HSET, key,
+        FIELD_START, integer(bucket.start),
+        FIELD_TICK, integer(bucket.lastTick),
+        FIELD_INTERVAL, integer(bucket.interval),
+        FIELD_CURRENT_TOKENS, integer(bucket.tokens),
+        FIELD_MAX_TOKENS, integer(bucket.maxTokens),
+        FIELD_VERSION, SCHEMA_VERSION)
+    redis.call(RCMD_EXPIRE, key, timeToLive(bucket.interval))
 end
 
 -- script begin
-local data = hashGetAll(key)
-local start = now
-if isPresent(data[FIELD_START]) then
-    start = tonumber(data[FIELD_START])
-else
-    redis.call(RCMD_HSET, key, FIELD_START, now)
-    redis.call(RCMD_EXPIRE, key, 30)
+if useServerTime or maxClockSkew > 0 then
+    local serverNow = serverTime()
+    if useServerTime then
+        now = serverNow
+    elseif math.abs(now - serverNow) > maxClockSkew then
+        return redis.error_reply('CLOCKSKEW client time ' .. now .. ' differs from server time ' .. serverNow)
+    end
 end
+`
 
-local lastTick = 0
-if isPresent(data[FIELD_TICK]) then
-    lastTick = tonumber(data[FIELD_TICK])
-else
-    redis.call(RCMD_HSET, key, FIELD_TICK, 0)
-    redis.call(RCMD_EXPIRE, key, 30)
+// takeScript takes a single token. Returns limit, remaining tokens, reset time and 1 if the token was taken.
+const takeScript = scriptHeader + `
+local bucket = load(key)
+local nextTime = refill(bucket)
+
+local ok = 0
+if bucket.tokens > 0 then
+    bucket.tokens = bucket.tokens - 1
+    ok = 1
 end
+save(key, bucket)
 
+return {bucket.maxTokens, bucket.tokens, nextTime, ok}
+`
 
-local maxTokens = defaultMaxTokens
-if isPresent(data[FIELD_MAX_TOKENS]) then
-    maxTokens = tonumber(data[FIELD_MAX_TOKENS])
-else
-    redis.call(RCMD_HSET, key, FIELD_MAX_TOKENS, defaultMaxTokens)
-    redis.call(RCMD_EXPIRE, key, 30)
+// getScript reports the bucket as if it was refilled now without changing it.
+// Returns limit, remaining tokens, reset time, 1 if the key exists and interval.
+const getScript = scriptHeader + `
+local bucket = load(key)
+local nextTime = refill(bucket)
+
+local exists = 0
+if bucket.exists then
+    exists = 1
 end
+return {bucket.maxTokens, bucket.tokens, nextTime, exists, bucket.interval}
+`
+
+// setScript replaces the bucket with a full one of ARGV[6] tokens per ARGV[7] nanoseconds
+const setScript = scriptHeader + `
+local tokens = tonumber(ARGV[6])
+local interval = tonumber(ARGV[7])
+
+save(key, {
+    start = now,
+    lastTick = 0,
+    maxTokens = tokens,
+    tokens = tokens,
+    interval = interval,
+})
+return 1
+`
+
+// burstScript adds ARGV[6] tokens to the refilled bucket. The limit could be exceeded until the next tick.
+const burstScript = scriptHeader + `
+local bucket = load(key)
+refill(bucket)
 
-local tokens = maxTokens
-if isPresent(data[FIELD_CURRENT_TOKENS]) then
-    tokens = tonumber(data[FIELD_CURRENT_TOKENS])
+bucket.tokens = bucket.tokens + tonumber(ARGV[6])
+save(key, bucket)
+return 1
+`
+
+// resetScript refills the bucket keeping its limit and interval. Returns 0 if the key does not exist.
+const resetScript = scriptHeader + `
+local bucket = load(key)
+if not bucket.exists then
+    return 0
 end
 
-local interval = defaultInterval
-if isPresent(data[FIELD_INTERVAL]) then
-    interval = tonumber(data[FIELD_INTERVAL])
+bucket.start = now
+bucket.lastTick = 0
+bucket.tokens = bucket.maxTokens
+save(key, bucket)
+return 1
+`
+
+// takeManyScript takes ARGV[5+i] tokens from KEYS[i] only if every key has enough tokens.
+// Returns 1 if the tokens were taken followed by limit, remaining tokens and reset time of every key.
+const takeManyScript = scriptHeader + `
+local buckets = {}
+local ok = 1
+for i, key in ipairs(KEYS) do
+    local bucket = load(key)
+    bucket.nextTime = refill(bucket)
+    bucket.cost = tonumber(ARGV[5 + i])
+    if bucket.tokens < bucket.cost then
+        ok = 0
+    end
+    buckets[i] = bucket
 end
 
-local currentTick = tick(start, now, interval)
-local nextTime = start + ((currentTick + 1) * interval)
+local result = {ok}
+for i, key in ipairs(KEYS) do
+    local bucket = buckets[i]
+    if ok == 1 then
+        bucket.tokens = bucket.tokens - bucket.cost
+    end
+    save(key, bucket)
 
-if lastTick > currentTick then
-    local rate = interval / tokens
-    tokens = availableTokens(lastTick, currentTick, maxTokens, rate)
-    lastTick = currentTick
-    redis.call(RCMD_HSET, key,
-        FIELD_START, start,
-        FIELD_TICK, lastTick,
-        FIELD_INTERVAL, interval,
-        FIELD_CURRENT_TOKENS, tokens)
-    redis.call(RCMD_EXPIRE, key, timeToLive(interval))
+    table.insert(result, bucket.maxTokens)
+    table.insert(result, bucket.tokens)
+    table.insert(result, bucket.nextTime)
+end
+return result
+`
+
+// migrateScript upgrades the fields of the bucket to the current schema version keeping its state.
+// Returns 1 if the bucket was upgraded.
+const migrateScript = scriptHeader + `
+local bucket = load(key)
+if not bucket.migrated then
+    return 0
+end
+
+save(key, bucket)
+return 1
+`
+
+// scanScript reports the key if it is a bucket: a hash with the version field or, if it was
+// written before the version field was added, with all of the limit, tokens and interval fields.
+// Buckets that could not be read are reported without failing the script, so a single key
+// does not stop the scan. Returns status (see scanNotBucket), limit, remaining tokens and interval.
+const scanScript = scriptHeader + `
+if redis.call(RCMD_TYPE, key).ok ~= 'hash' then
+    return {0}
 end
 
-if tokens > 0 then
-    tokens = tokens - 1
-    redis.call(RCMD_HSET, key, FIELD_CURRENT_TOKENS, tokens)
-    redis.call(RCMD_EXPIRE, key, timeToLive(interval))
+local data = hashGetAll(key)
+local status = 1
+if isPresent(data[FIELD_VERSION]) then
+    local version = tonumber(data[FIELD_VERSION])
+    if version == nil then
+        return {4}
+    elseif version > SCHEMA_VERSION then
+        return {3}
+    elseif version < SCHEMA_VERSION then
+        status = 2
+    end
+elseif isPresent(data[FIELD_MAX_TOKENS]) and isPresent(data[FIELD_CURRENT_TOKENS]) and isPresent(data[FIELD_INTERVAL]) then
+    status = 2
+else
+    return {0}
+end
 
-    return {maxTokens, tokens, nextTime, true}
+for _, field in ipairs({FIELD_START, FIELD_TICK, FIELD_INTERVAL, FIELD_CURRENT_TOKENS, FIELD_MAX_TOKENS}) do
+    if isPresent(data[field]) and tonumber(data[field]) == nil then
+        return {4}
+    end
+end
+if isPresent(data[FIELD_INTERVAL]) and tonumber(data[FIELD_INTERVAL]) <= 0 then
+    return {4}
 end
 
-return{maxTokens, tokens, nextTime, false}
+local bucket = load(key)
+refill(bucket)
+return {status, bucket.maxTokens, bucket.tokens, bucket.interval}
 `
@@ -0,0 +1,55 @@
+package redisstorage
+
+import (
+	"flag"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate scripttemplate.lua from script.go")
+
+// scriptTemplate returns the readable source of the scripts: the shared header followed
+// by the body of every script
+func scriptTemplate() string {
+	var b strings.Builder
+	b.WriteString("-- Generated from script.go by: go test -run TestScriptTemplate -update\n")
+	b.WriteString("-- It is the readable source of the scripts, the scripts themselves are in script.go.\n")
+	b.WriteString("\n-- scriptHeader is shared by all scripts")
+	b.WriteString(scriptHeader)
+	for _, script := range []struct {
+		name, src string
+	}{
+		{"takeScript", takeScript},
+		{"getScript", getScript},
+		{"setScript", setScript},
+		{"burstScript", burstScript},
+		{"resetScript", resetScript},
+		{"takeManyScript", takeManyScript},
+		{"migrateScript", migrateScript},
+		{"scanScript", scanScript},
+	} {
+		b.WriteString("\n-- " + script.name + " = scriptHeader +")
+		b.WriteString(strings.TrimPrefix(script.src, scriptHeader))
+	}
+	return b.String()
+}
+
+func TestScriptTemplate(t *testing.T) {
+	t.Parallel()
+
+	want := scriptTemplate()
+	if *update {
+		if err := ioutil.WriteFile("scripttemplate.lua", []byte(want), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := ioutil.ReadFile("scripttemplate.lua")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Error("scripttemplate.lua is out of date with script.go, regenerate it with -update")
+	}
+}
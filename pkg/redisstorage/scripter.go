@@ -0,0 +1,46 @@
+package redisstorage
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"strings"
+)
+
+// Scripter runs the scripts and commands of RedisStorage. It hides the Redis client library:
+// see NewRedigoScripter and the goredisstorage module for go-redis. Implementations route keys
+// to the nodes serving them with Redis Cluster and follow the master with Sentinel.
+type Scripter interface {
+	// EvalSha runs the script cached by Redis under its SHA1 hash. The error of a script
+	// missing from the cache should contain "NOSCRIPT" so it is loaded with Eval.
+	EvalSha(ctx context.Context, sha string, keys []string, args ...interface{}) (interface{}, error)
+	// Eval runs the script source. Redis caches it, so the next EvalSha succeeds.
+	Eval(ctx context.Context, src string, keys []string, args ...interface{}) (interface{}, error)
+	// Del removes key.
+	Del(ctx context.Context, key string) error
+	// Scan calls f with the batches of keys matching pattern of every master until f returns false.
+	Scan(ctx context.Context, pattern string, f func(keys []string) bool) error
+	// Close releases the connections.
+	Close() error
+}
+
+// luaScript is a script with its SHA1 hash, so its source is sent only when Redis
+// does not have it cached yet
+type luaScript struct {
+	src string
+	sha string
+}
+
+func newLuaScript(src string) *luaScript {
+	hash := sha1.Sum([]byte(src))
+	return &luaScript{src: src, sha: hex.EncodeToString(hash[:])}
+}
+
+// run calls EVALSHA falling back to EVAL on NOSCRIPT error
+func (s *luaScript) run(ctx context.Context, scripter Scripter, keys []string, args ...interface{}) (interface{}, error) {
+	reply, err := scripter.EvalSha(ctx, s.sha, keys, args...)
+	if err != nil && strings.Contains(err.Error(), "NOSCRIPT") {
+		return scripter.Eval(ctx, s.src, keys, args...)
+	}
+	return reply, err
+}
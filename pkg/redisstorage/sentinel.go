@@ -0,0 +1,203 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+)
+
+const (
+	rcmdSENTINEL = "SENTINEL"
+)
+
+var (
+	ErrNoSentinelAddrs = fmt.Errorf("no sentinel addresses specified")
+	ErrNoMasterName    = fmt.Errorf("no master name specified")
+	ErrNilSentinelDial = fmt.Errorf("sentinel dial is nil")
+	ErrStaleConn       = fmt.Errorf("connection to the previous master")
+)
+
+// SentinelConfig is used to NewRSSentinel. It setups discovery of the master with Redis Sentinel.
+type SentinelConfig struct {
+	// MasterName is the name of the master monitored by the sentinels.
+	MasterName string
+	// Addrs are the addresses of the sentinels. They are asked in order.
+	Addrs []string
+	// Dial connects to a sentinel or to the master by its address.
+	Dial func(addr string) (redis.Conn, error)
+	// MaxActive is the maximum number of connections to the master. Zero means no limit.
+	MaxActive uint
+	// OnFailover is called when the master address changes.
+	OnFailover func(from, to string)
+}
+
+// NewRSSentinel returns storage working with the master discovered by the sentinels.
+// The master is resolved again on READONLY and connection errors, connections to the
+// previous master are drained from the pool. Commands rejected with READONLY are retried
+// on the new master. Commands failed with connection errors are not: the old master could
+// have run them, so a retried Take would be counted twice.
+func NewRSSentinel(cfg *Config, sentinel *SentinelConfig) (*RedisStorage, error) {
+	if sentinel == nil || len(sentinel.Addrs) == 0 {
+		return nil, ErrNoSentinelAddrs
+	}
+
+	if sentinel.MasterName == "" {
+		return nil, ErrNoMasterName
+	}
+
+	if sentinel.Dial == nil {
+		return nil, ErrNilSentinelDial
+	}
+
+	c := &sentinelClient{
+		masterName: sentinel.MasterName,
+		sentinels:  sentinel.Addrs,
+		dial:       sentinel.Dial,
+		onFailover: sentinel.OnFailover,
+	}
+
+	c.pool = &redis.Pool{
+		Dial: c.dialMaster,
+		TestOnBorrow: func(conn redis.Conn, _ time.Time) error {
+			if sc, ok := conn.(*sentinelConn); ok && sc.generation != atomic.LoadUint64(&c.generation) {
+				return ErrStaleConn
+			}
+			_, err := conn.Do(rcmdPING)
+			return err
+		},
+		MaxActive:   int(sentinel.MaxActive),
+		IdleTimeout: 5 * time.Minute,
+	}
+
+	if _, err := c.resolve(); err != nil {
+		return nil, err
+	}
+
+	return newRS(cfg, newRedigoScripter(c, nil))
+}
+
+// sentinelClient is a client of the master discovered by sentinels
+type sentinelClient struct {
+	masterName string
+	sentinels  []string
+	dial       func(addr string) (redis.Conn, error)
+	onFailover func(from, to string)
+	pool       *redis.Pool
+
+	// generation is incremented on every master change
+	generation uint64
+
+	// lock guards master
+	lock   sync.Mutex
+	master string
+}
+
+// sentinelConn remembers the generation of the master it was dialed to
+type sentinelConn struct {
+	redis.Conn
+	generation uint64
+}
+
+func (c *sentinelClient) dialMaster() (redis.Conn, error) {
+	c.lock.Lock()
+	master := c.master
+	generation := atomic.LoadUint64(&c.generation)
+	c.lock.Unlock()
+
+	conn, err := c.dial(master)
+	if err != nil {
+		return nil, err
+	}
+	return &sentinelConn{Conn: conn, generation: generation}, nil
+}
+
+// resolve asks the sentinels for the master address. Returns true if the master has changed.
+func (c *sentinelClient) resolve() (bool, error) {
+	var err error
+	for _, addr := range c.sentinels {
+		var master string
+		if master, err = c.askSentinel(addr); err != nil {
+			continue
+		}
+
+		c.lock.Lock()
+		previous := c.master
+		changed := previous != master
+		if changed {
+			c.master = master
+			atomic.AddUint64(&c.generation, 1)
+		}
+		c.lock.Unlock()
+
+		if changed && previous != "" && c.onFailover != nil {
+			c.onFailover(previous, master)
+		}
+		return changed, nil
+	}
+	return false, fmt.Errorf("failed to resolve master %q: %w", c.masterName, err)
+}
+
+func (c *sentinelClient) askSentinel(addr string) (string, error) {
+	conn, err := c.dial(addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do(rcmdSENTINEL, "get-master-addr-by-name", c.masterName))
+	if err != nil {
+		return "", err
+	}
+	if len(values) != 2 {
+		return "", fmt.Errorf("unexpected sentinel response %#v", values)
+	}
+	return net.JoinHostPort(values[0], values[1]), nil
+}
+
+func (c *sentinelClient) conn(ctx context.Context, _ string) (redis.Conn, error) {
+	return c.pool.GetContext(ctx)
+}
+
+func (c *sentinelClient) connAddr(ctx context.Context, addr string) (redis.Conn, error) {
+	if addr != "" {
+		return nil, ErrNotCluster
+	}
+	return c.pool.GetContext(ctx)
+}
+
+func (c *sentinelClient) nodes() []string {
+	return []string{""}
+}
+
+func (c *sentinelClient) moved(int, string) {}
+
+// failed resolves the master again on READONLY replies (the master was demoted)
+// and on connection errors (the master is down).
+func (c *sentinelClient) failed(err error) bool {
+	var rerr redis.Error
+	var nerr net.Error
+	switch {
+	case errors.As(err, &rerr):
+		if !strings.HasPrefix(string(rerr), "READONLY") {
+			return false
+		}
+	case errors.As(err, &nerr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+	default:
+		return false
+	}
+
+	changed, rerr_ := c.resolve()
+	return rerr_ == nil && changed
+}
+
+func (c *sentinelClient) close() error {
+	return c.pool.Close()
+}
@@ -0,0 +1,246 @@
+package redisstorage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+const sentinelAddr = "sentinel:26379"
+
+// fakeSentinel is a sentinel monitoring miniredis servers. A demoted master answers
+// write commands with READONLY, as Redis does after failover.
+type fakeSentinel struct {
+	servers map[string]*miniredis.Miniredis
+	addrs   []string
+
+	lock   sync.Mutex
+	master string
+	// lost makes the next command run but lose its reply
+	lost bool
+}
+
+func newFakeSentinel(tb testing.TB, nodes int) *fakeSentinel {
+	tb.Helper()
+
+	fs := &fakeSentinel{servers: make(map[string]*miniredis.Miniredis)}
+	for i := 0; i < nodes; i++ {
+		server, err := miniredis.Run()
+		if err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(server.Close)
+
+		fs.servers[server.Addr()] = server
+		fs.addrs = append(fs.addrs, server.Addr())
+	}
+	fs.master = fs.addrs[0]
+	return fs
+}
+
+func (fs *fakeSentinel) failover(addr string) {
+	fs.lock.Lock()
+	fs.master = addr
+	fs.lock.Unlock()
+}
+
+// loseReply makes the next command run on its server and fail with a connection error
+func (fs *fakeSentinel) loseReply() {
+	fs.lock.Lock()
+	fs.lost = true
+	fs.lock.Unlock()
+}
+
+func (fs *fakeSentinel) replyLost() bool {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	lost := fs.lost
+	fs.lost = false
+	return lost
+}
+
+func (fs *fakeSentinel) currentMaster() string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	return fs.master
+}
+
+func (fs *fakeSentinel) dial(addr string) (redis.Conn, error) {
+	if addr == sentinelAddr {
+		return &fakeSentinelConn{sentinel: fs}, nil
+	}
+
+	conn, err := redis.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &fakeReplicaConn{Conn: conn, sentinel: fs, addr: addr}, nil
+}
+
+// fakeSentinelConn answers SENTINEL get-master-addr-by-name
+type fakeSentinelConn struct {
+	redis.Conn
+	sentinel *fakeSentinel
+}
+
+func (c *fakeSentinelConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if !strings.EqualFold(command, rcmdSENTINEL) {
+		return nil, redis.Error("ERR unknown command")
+	}
+	host, port, _ := net.SplitHostPort(c.sentinel.currentMaster())
+	return []interface{}{[]byte(host), []byte(port)}, nil
+}
+
+func (c *fakeSentinelConn) Close() error {
+	return nil
+}
+
+// fakeReplicaConn rejects commands once its server is not the master
+type fakeReplicaConn struct {
+	redis.Conn
+	sentinel *fakeSentinel
+	addr     string
+}
+
+func (c *fakeReplicaConn) Do(command string, args ...interface{}) (interface{}, error) {
+	if command != "" && command != rcmdPING && c.sentinel.replyLost() {
+		c.Conn.Do(command, args...)
+		return nil, io.ErrUnexpectedEOF
+	}
+	if command != "" && command != rcmdPING && c.sentinel.currentMaster() != c.addr {
+		return nil, redis.Error("READONLY You can't write against a read only replica.")
+	}
+	return c.Conn.Do(command, args...)
+}
+
+func TestNewRSSentinel_Config(t *testing.T) {
+	t.Parallel()
+
+	fs := newFakeSentinel(t, 1)
+	cfg := &Config{Tokens: 10, Interval: time.Minute}
+
+	for _, c := range []struct {
+		name     string
+		sentinel *SentinelConfig
+		err      error
+	}{
+		{name: "nil", sentinel: nil, err: ErrNoSentinelAddrs},
+		{name: "no master", sentinel: &SentinelConfig{Addrs: []string{sentinelAddr}, Dial: fs.dial}, err: ErrNoMasterName},
+		{name: "no dial", sentinel: &SentinelConfig{Addrs: []string{sentinelAddr}, MasterName: "mymaster"}, err: ErrNilSentinelDial},
+	} {
+		if _, err := NewRSSentinel(cfg, c.sentinel); err != c.err {
+			t.Errorf("%s: got %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestRedisStorage_SentinelFailover(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := newFakeSentinel(t, 2)
+
+	var failovers [][2]string
+	storage, err := NewRSSentinel(&Config{Tokens: 10, Interval: time.Minute}, &SentinelConfig{
+		MasterName: "mymaster",
+		Addrs:      []string{"unreachable:26379", sentinelAddr},
+		Dial: func(addr string) (redis.Conn, error) {
+			if strings.HasPrefix(addr, "unreachable") {
+				return nil, &net.OpError{Op: "dial", Net: "tcp", Err: net.UnknownNetworkError(addr)}
+			}
+			return fs.dial(addr)
+		},
+		OnFailover: func(from, to string) {
+			failovers = append(failovers, [2]string{from, to})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key := key(t)
+	if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if !fs.servers[fs.addrs[0]].Exists(key) {
+		t.Fatalf("key is not stored on the master")
+	}
+
+	// pooled connection to the demoted master gets READONLY, the master is resolved again
+	fs.failover(fs.addrs[1])
+	if _, _, _, ok, err := storage.Take(ctx, key); err != nil || !ok {
+		t.Fatalf("take after failover: %v, %v", ok, err)
+	}
+	if !fs.servers[fs.addrs[1]].Exists(key) {
+		t.Errorf("key is not stored on the new master")
+	}
+	if got, want := len(failovers), 1; got != want {
+		t.Fatalf("failovers: got %d, want %d", got, want)
+	}
+	if got, want := failovers[0], [2]string{fs.addrs[0], fs.addrs[1]}; got != want {
+		t.Errorf("failover: got %v, want %v", got, want)
+	}
+
+	// connections to the previous master are not borrowed anymore
+	for i := 0; i < 3; i++ {
+		if _, _, err := storage.Get(ctx, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, want := len(failovers), 1; got != want {
+		t.Errorf("failovers: got %d, want %d", got, want)
+	}
+}
+
+func TestRedisStorage_SentinelConnectionError(t *testing.T) {
+	t.Parallel()
+
+	ctx := context.Background()
+	fs := newFakeSentinel(t, 2)
+	storage, err := NewRSSentinel(&Config{Tokens: 10, Interval: time.Minute}, &SentinelConfig{
+		MasterName: "mymaster",
+		Addrs:      []string{sentinelAddr},
+		Dial:       fs.dial,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	key := key(t)
+	if _, _, _, _, err := storage.Take(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+
+	// the old master runs the take but its reply is lost with the connection
+	fs.loseReply()
+	fs.failover(fs.addrs[1])
+	if _, _, _, _, err := storage.Take(ctx, key); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("take after connection error: got %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if got, want := fs.servers[fs.addrs[0]].HGet(key, "k"), "8"; got != want {
+		t.Errorf("tokens on the old master: got %s, want %s", got, want)
+	}
+
+	// the next take goes to the new master
+	if _, remaining, _, ok, err := storage.Take(ctx, key); err != nil || !ok || remaining != 9 {
+		t.Errorf("take on the new master: %d, %v, %v", remaining, ok, err)
+	}
+}
@@ -0,0 +1,84 @@
+package sketchstorage
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// fnv-1a 64 bit parameters
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// sketch is a count-min sketch: depth rows of width counters. A key increments one counter
+// of every row and its count is the minimum of them, so it could be overestimated by
+// collisions but never underestimated. Counters are accessed atomically.
+type sketch struct {
+	width    uint64
+	depth    int
+	counters []uint32
+}
+
+func newSketch(width, depth int) *sketch {
+	return &sketch{width: uint64(width), depth: depth, counters: make([]uint32, width*depth)}
+}
+
+// hashes returns two independent hashes of key. Row indexes are derived from them
+// by double hashing, so the key is hashed once for all rows.
+func hashes(key string) (uint64, uint64) {
+	hash := uint64(fnvOffset)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= fnvPrime
+	}
+
+	// the second hash is the first one mixed by splitmix64 finalizer, it is odd so rows differ
+	mixed := hash
+	mixed ^= mixed >> 30
+	mixed *= 0xbf58476d1ce4e5b9
+	mixed ^= mixed >> 27
+	mixed *= 0x94d049bb133111eb
+	mixed ^= mixed >> 31
+	return hash, mixed | 1
+}
+
+// index returns the position of the counter of row for hashes h1 and h2
+func (s *sketch) index(row int, h1, h2 uint64) int {
+	return row*int(s.width) + int((h1+uint64(row)*h2)%s.width)
+}
+
+// estimate returns the count of the key with hashes h1 and h2
+func (s *sketch) estimate(h1, h2 uint64) uint32 {
+	min := ^uint32(0)
+	for row := 0; row < s.depth; row++ {
+		if c := atomic.LoadUint32(&s.counters[s.index(row, h1, h2)]); c < min {
+			min = c
+		}
+	}
+	return min
+}
+
+// add raises the counters of the key with hashes h1 and h2 to its estimate plus delta
+// leaving greater counters untouched (conservative update). It reduces the overestimation
+// of other keys compared to incrementing every row. Counters never decrease, so racing adds
+// of other keys only raise the estimate, but adds of the same key should be serialized
+// with its estimate by the caller or increments are lost.
+func (s *sketch) add(h1, h2 uint64, delta uint32) {
+	target := s.estimate(h1, h2) + delta
+	for row := 0; row < s.depth; row++ {
+		counter := &s.counters[s.index(row, h1, h2)]
+		for {
+			c := atomic.LoadUint32(counter)
+			if c >= target || atomic.CompareAndSwapUint32(counter, c, target) {
+				break
+			}
+		}
+	}
+}
+
+// reset zeroes all counters. The caller should exclude concurrent access.
+func (s *sketch) reset() {
+	for i := range s.counters {
+		s.counters[i] = 0
+	}
+}
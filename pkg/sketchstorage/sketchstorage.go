@@ -0,0 +1,241 @@
+package sketchstorage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoppedFlag = fmt.Errorf("setting stop flag failed")
+	ErrEpsilon     = fmt.Errorf("epsilon should be in (0, 1)")
+	ErrDelta       = fmt.Errorf("delta should be in (0, 1)")
+)
+
+// SketchStorage limits keys with count-min sketches instead of per-key buckets, so its memory
+// does not depend on the number of keys. It counts takes in a sliding window of two sketches:
+// the current interval and the previous one weighted by the part of it still in the window.
+//
+// Counts could be overestimated by collisions but never underestimated, the check and the
+// update of a count are serialized per key by a set of locks sharded by the key hash. So a key
+// is never allowed more than Tokens takes within an interval aligned to the unix epoch. The
+// sliding window itself assumes that the takes of the previous interval were spread evenly,
+// so within an Interval across two aligned intervals a key could be allowed up to twice Tokens.
+// Per-key limits are not supported: Set, Burst, Reset and Delete return rlstorage.ErrNotSupported.
+type SketchStorage struct {
+	tokens   uint64
+	interval uint64
+
+	// lock guards the rotation of sketches, counters are updated under read lock
+	lock        sync.RWMutex
+	current     *sketch
+	previous    *sketch
+	windowStart uint64
+
+	// takes serialize counting and adding of keys sharing a shard
+	takes [takeShards]sync.Mutex
+
+	// now returns current unix time in nanoseconds, it is replaced by tests
+	now func() uint64
+
+	stopped uint32
+}
+
+// takeShards is the number of locks serializing takes, keys are spread over them by hash
+const takeShards = 64
+
+// Config is used to NewSketchStorage. It setups the SketchStorage
+type Config struct {
+	// Tokens is the number of tokens allowed per Interval. Default is 1.
+	Tokens uint64
+	// Interval is the time interval upon which rate limiting is enforced.
+	// Default is 1 second.
+	Interval time.Duration
+	// Epsilon bounds the overestimation of a key count by Epsilon multiplied by the number
+	// of all takes in the window. Lower values trade memory for precision: a sketch row
+	// has e/Epsilon counters. Default is 0.0001.
+	Epsilon float64
+	// Delta is the probability of the count exceeding the Epsilon bound. A sketch has
+	// ln(1/Delta) rows. Default is 0.01.
+	Delta float64
+	// Width and Depth set the size of a sketch explicitly overriding Epsilon and Delta.
+	Width int
+	Depth int
+}
+
+func NewSketchStorage(cfg *Config) (*SketchStorage, error) {
+	if cfg == nil {
+		cfg = new(Config)
+	}
+
+	tokens := uint64(1)
+	if cfg.Tokens > 0 {
+		tokens = cfg.Tokens
+	}
+
+	interval := 1 * time.Second
+	if cfg.Interval > 0 {
+		interval = cfg.Interval
+	}
+
+	epsilon := 0.0001
+	if cfg.Epsilon != 0 {
+		if cfg.Epsilon < 0 || cfg.Epsilon >= 1 {
+			return nil, ErrEpsilon
+		}
+		epsilon = cfg.Epsilon
+	}
+
+	delta := 0.01
+	if cfg.Delta != 0 {
+		if cfg.Delta < 0 || cfg.Delta >= 1 {
+			return nil, ErrDelta
+		}
+		delta = cfg.Delta
+	}
+
+	width := int(math.Ceil(math.E / epsilon))
+	if cfg.Width > 0 {
+		width = cfg.Width
+	}
+
+	depth := int(math.Ceil(math.Log(1 / delta)))
+	if cfg.Depth > 0 {
+		depth = cfg.Depth
+	}
+
+	return &SketchStorage{
+		tokens:   tokens,
+		interval: uint64(interval),
+		current:  newSketch(width, depth),
+		previous: newSketch(width, depth),
+		now:      nanoNow,
+	}, nil
+}
+
+func nanoNow() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// Bytes returns the memory used by the counters of the sketches. It does not change over time.
+func (storage *SketchStorage) Bytes() int {
+	return 2 * 4 * len(storage.current.counters)
+}
+
+// window rotates the sketches if now is past the current interval and returns them with
+// the weight of the previous one. The read lock is held on return.
+func (storage *SketchStorage) window(now uint64) (current, previous *sketch, weight float64, start uint64) {
+	storage.lock.RLock()
+	if now >= storage.windowStart+storage.interval {
+		storage.lock.RUnlock()
+		storage.rotate(now)
+		storage.lock.RLock()
+	}
+
+	start = storage.windowStart
+	elapsed := float64(now-start) / float64(storage.interval)
+	if elapsed > 1 {
+		// clock moved after the rotation check, the next call rotates
+		elapsed = 1
+	}
+	return storage.current, storage.previous, 1 - elapsed, start
+}
+
+func (storage *SketchStorage) rotate(now uint64) {
+	storage.lock.Lock()
+	defer storage.lock.Unlock()
+
+	start := now - now%storage.interval
+	switch {
+	case start <= storage.windowStart:
+		// rotated by another goroutine
+		return
+	case start == storage.windowStart+storage.interval:
+		storage.previous, storage.current = storage.current, storage.previous
+		storage.current.reset()
+	default:
+		// more than an interval passed, nothing is left in the window
+		storage.current.reset()
+		storage.previous.reset()
+	}
+	storage.windowStart = start
+}
+
+// count returns the number of takes of the key with hashes h1 and h2 in the sliding window
+func count(current, previous *sketch, weight float64, h1, h2 uint64) uint64 {
+	return uint64(current.estimate(h1, h2)) + uint64(float64(previous.estimate(h1, h2))*weight)
+}
+
+// Take attempts to remove a token from key. If take is successful, it returns true.
+// Returns tokens limit, remaining tokens count, reset time, success flag and error.
+func (storage *SketchStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, 0, false, rlstorage.ErrStopped
+	}
+
+	h1, h2 := hashes(key)
+	current, previous, weight, start := storage.window(storage.now())
+	defer storage.lock.RUnlock()
+
+	shard := &storage.takes[h1%takeShards]
+	shard.Lock()
+	defer shard.Unlock()
+
+	reset := start + storage.interval
+	taken := count(current, previous, weight, h1, h2)
+	if taken >= storage.tokens {
+		return storage.tokens, 0, reset, false, nil
+	}
+
+	current.add(h1, h2, 1)
+	return storage.tokens, storage.tokens - taken - 1, reset, true, nil
+}
+
+// Get returns the limit and the estimated remaining tokens of key
+func (storage *SketchStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, rlstorage.ErrStopped
+	}
+
+	h1, h2 := hashes(key)
+	current, previous, weight, _ := storage.window(storage.now())
+	defer storage.lock.RUnlock()
+
+	taken := count(current, previous, weight, h1, h2)
+	if taken >= storage.tokens {
+		return storage.tokens, 0, nil
+	}
+	return storage.tokens, storage.tokens - taken, nil
+}
+
+// Set is not supported: keys share counters, so they could not have their own limits
+func (storage *SketchStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Burst is not supported: tokens could not be added to a single key of the sketch
+func (storage *SketchStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Reset is not supported: counters of key could not be decreased without affecting other keys
+func (storage *SketchStorage) Reset(ctx context.Context, key string) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Delete is not supported for the same reason as Reset
+func (storage *SketchStorage) Delete(ctx context.Context, key string) error {
+	return rlstorage.ErrNotSupported
+}
+
+// Close stops the storage
+func (storage *SketchStorage) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
+		return ErrStoppedFlag
+	}
+	return nil
+}
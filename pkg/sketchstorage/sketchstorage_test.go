@@ -0,0 +1,245 @@
+package sketchstorage
+
+import (
+	"context"
+	"fmt"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testStorage returns the storage with a clock controlled by the test
+func testStorage(tb testing.TB, cfg *Config) (*SketchStorage, *uint64) {
+	tb.Helper()
+
+	storage, err := NewSketchStorage(cfg)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+
+	now := uint64(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC).UnixNano())
+	storage.now = func() uint64 { return now }
+	return storage, &now
+}
+
+func TestNewSketchStorage(t *testing.T) {
+	t.Parallel()
+
+	for _, c := range []struct {
+		name         string
+		cfg          *Config
+		width, depth int
+		err          error
+	}{
+		{name: "defaults", cfg: nil, width: 27183, depth: 5},
+		{name: "error bound", cfg: &Config{Epsilon: 0.01, Delta: 0.001}, width: 272, depth: 7},
+		{name: "size", cfg: &Config{Epsilon: 0.01, Width: 100, Depth: 3}, width: 100, depth: 3},
+		{name: "epsilon", cfg: &Config{Epsilon: 1}, err: ErrEpsilon},
+		{name: "delta", cfg: &Config{Delta: -0.1}, err: ErrDelta},
+	} {
+		storage, err := NewSketchStorage(c.cfg)
+		if err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		if got := int(storage.current.width); got != c.width {
+			t.Errorf("%s: width expected %d, got %d", c.name, c.width, got)
+		}
+		if got := storage.current.depth; got != c.depth {
+			t.Errorf("%s: depth expected %d, got %d", c.name, c.depth, got)
+		}
+		if got, want := storage.Bytes(), 2*4*c.width*c.depth; got != want {
+			t.Errorf("%s: bytes expected %d, got %d", c.name, want, got)
+		}
+	}
+}
+
+func TestSketchStorage_Take(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, now := testStorage(t, &Config{Tokens: 3, Interval: time.Second})
+	for i, want := range []struct {
+		remaining uint64
+		ok        bool
+	}{{2, true}, {1, true}, {0, true}, {0, false}} {
+		limit, remaining, _, ok, err := storage.Take(ctx, "a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit != 3 || remaining != want.remaining || ok != want.ok {
+			t.Errorf("take %d: expected 3/%d/%v, got %d/%d/%v", i, want.remaining, want.ok, limit, remaining, ok)
+		}
+	}
+
+	// other keys are not affected
+	if _, remaining, _, ok, err := storage.Take(ctx, "b"); err != nil || !ok || remaining != 2 {
+		t.Errorf("other key: got %d/%v/%v", remaining, ok, err)
+	}
+
+	// half of the previous interval is still in the window
+	*now += uint64(1500 * time.Millisecond)
+	if _, remaining, err := storage.Get(ctx, "a"); err != nil || remaining != 2 {
+		t.Errorf("sliding window: expected 2 remaining, got %d/%v", remaining, err)
+	}
+
+	// nothing is left after two intervals
+	*now += uint64(2 * time.Second)
+	if _, remaining, err := storage.Get(ctx, "a"); err != nil || remaining != 3 {
+		t.Errorf("next window: expected 3 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestSketchStorage_Concurrent(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	const tokens = 1000
+	storage, _ := testStorage(t, &Config{Tokens: tokens, Interval: time.Hour})
+
+	var allowed uint64
+	var wg sync.WaitGroup
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				_, _, _, ok, err := storage.Take(ctx, "key")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if ok {
+					atomic.AddUint64(&allowed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := atomic.LoadUint64(&allowed); got > tokens {
+		t.Errorf("allowed: expected at most %d, got %d", tokens, got)
+	}
+}
+
+func TestSketchStorage_ErrorBound(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	epsilon := 0.001
+	storage, _ := testStorage(t, &Config{Tokens: 1000, Interval: time.Minute, Epsilon: epsilon, Delta: 0.001})
+
+	// a heavy key and many light ones
+	takes := 0
+	for i := 0; i < 200; i++ {
+		if _, _, _, _, err := storage.Take(ctx, "heavy"); err != nil {
+			t.Fatal(err)
+		}
+		takes++
+	}
+	keys := 10000
+	for i := 0; i < keys; i++ {
+		if _, _, _, _, err := storage.Take(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+		takes++
+	}
+
+	bound := uint64(epsilon * float64(takes))
+	if _, remaining, _ := storage.Get(ctx, "heavy"); 1000-remaining > 200+bound {
+		t.Errorf("heavy: counted %d, bound %d", 1000-remaining, 200+bound)
+	}
+
+	exceeded := 0
+	for i := 0; i < keys; i++ {
+		_, remaining, err := storage.Get(ctx, fmt.Sprintf("key-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if counted := 1000 - remaining; counted < 1 {
+			t.Fatalf("key-%d is underestimated: %d", i, counted)
+		} else if counted > 1+bound {
+			exceeded++
+		}
+	}
+	if exceeded > keys/100 {
+		t.Errorf("%d of %d keys exceed the error bound", exceeded, keys)
+	}
+}
+
+func TestSketchStorage_NotSupported(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, _ := testStorage(t, nil)
+	for name, err := range map[string]error{
+		"set":    storage.Set(ctx, "a", 1, time.Second),
+		"burst":  storage.Burst(ctx, "a", 1),
+		"reset":  storage.Reset(ctx, "a"),
+		"delete": storage.Delete(ctx, "a"),
+	} {
+		if err != rlstorage.ErrNotSupported {
+			t.Errorf("%s: expected %v, got %v", name, rlstorage.ErrNotSupported, err)
+		}
+	}
+}
+
+func TestSketchStorage_Close(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := NewSketchStorage(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(ctx); err != ErrStoppedFlag {
+		t.Errorf("second close: expected %v, got %v", ErrStoppedFlag, err)
+	}
+	if _, _, _, _, err := storage.Take(ctx, "a"); err != rlstorage.ErrStopped {
+		t.Errorf("take: expected %v, got %v", rlstorage.ErrStopped, err)
+	}
+}
+
+func BenchmarkSketchStorage_Take(b *testing.B) {
+	ctx := context.Background()
+	storage, err := NewSketchStorage(&Config{Tokens: 100, Interval: time.Second})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			b.Fatal(err)
+		}
+	})
+
+	keys := make([]string, 1<<16)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			if _, _, _, _, err := storage.Take(ctx, keys[i%len(keys)]); err != nil {
+				b.Fatal(err)
+			}
+			i++
+		}
+	})
+}
@@ -0,0 +1,42 @@
+package rl_storage
+
+import (
+	"context"
+	"sort"
+)
+
+// TakeRequest is a single take of BatchStorage.TakeMany.
+type TakeRequest struct {
+	Key string
+	// Cost is the number of tokens to take. Zero means 1.
+	Cost uint64
+}
+
+// BatchStorage is implemented by storages that take from several keys at once.
+// It is used for hierarchical limits, e.g. per-user, per-org and global limits of a single request.
+type BatchStorage interface {
+	// TakeMany takes Cost tokens from every key only if all of them have enough tokens,
+	// otherwise nothing is taken. Decisions are returned in the order of reqs and either
+	// all of them are Allowed or none. Requests for the same key are summed up.
+	TakeMany(ctx context.Context, reqs []TakeRequest) ([]*Decision, error)
+}
+
+// MergeTakeRequests returns the unique keys of reqs in sorted order with their summed costs.
+// Storages use sorted keys to lock them in the same order.
+func MergeTakeRequests(reqs []TakeRequest) (keys []string, costs map[string]uint64) {
+	costs = make(map[string]uint64, len(reqs))
+	for _, req := range reqs {
+		cost := req.Cost
+		if cost == 0 {
+			cost = 1
+		}
+
+		if _, ok := costs[req.Key]; !ok {
+			keys = append(keys, req.Key)
+		}
+		costs[req.Key] += cost
+	}
+
+	sort.Strings(keys)
+	return keys, costs
+}
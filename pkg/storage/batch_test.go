@@ -0,0 +1,22 @@
+package rl_storage
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMergeTakeRequests(t *testing.T) {
+	t.Parallel()
+
+	keys, costs := MergeTakeRequests([]TakeRequest{
+		{Key: "user"},
+		{Key: "global", Cost: 2},
+		{Key: "user", Cost: 3},
+	})
+	if got, want := keys, []string{"global", "user"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys: expected %v, got %v", want, got)
+	}
+	if got, want := costs, map[string]uint64{"global": 2, "user": 4}; !reflect.DeepEqual(got, want) {
+		t.Errorf("costs: expected %v, got %v", want, got)
+	}
+}
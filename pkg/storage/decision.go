@@ -0,0 +1,89 @@
+package rl_storage
+
+import (
+	"context"
+	"time"
+)
+
+// Decision is the result of a single take from (or a look into) the storage.
+type Decision struct {
+	// Limit is the number of tokens available per interval.
+	Limit uint64
+	// Remaining is the number of tokens left for the current interval.
+	Remaining uint64
+	// ResetAt is the time when the next interval starts.
+	ResetAt time.Time
+	// RetryAfter is how long the client should wait before the next take could succeed.
+	// It is zero if Allowed.
+	RetryAfter time.Duration
+	// Allowed is whether the take was successful.
+	Allowed bool
+	// Cost is the number of tokens the take consumed (or tried to consume).
+	Cost uint64
+	// Policy is the name of the limit. Storages leave it empty, its set by the caller.
+	Policy string
+}
+
+// NewDecision builds Decision from the values returned by Storage.Take.
+// Reset is the number of nanoseconds since epoch. ResetAt is left zero if reset is 0,
+// e.g. for storages that do not report it.
+func NewDecision(limit, remaining, reset uint64, allowed bool) *Decision {
+	d := &Decision{
+		Limit:     limit,
+		Remaining: remaining,
+		Allowed:   allowed,
+		Cost:      1,
+	}
+
+	if reset > 0 {
+		d.ResetAt = time.Unix(0, int64(reset))
+	}
+
+	if !allowed {
+		if retry := time.Until(d.ResetAt); retry > 0 {
+			d.RetryAfter = retry
+		}
+	}
+	return d
+}
+
+// DecisionStorage is implemented by storages that report Decision directly.
+type DecisionStorage interface {
+	// TakeDecision takes a token by key like Take does.
+	TakeDecision(ctx context.Context, key string) (*Decision, error)
+	// GetDecision returns the current state of key like Get does. Allowed is whether
+	// the next take would succeed. Does not change state of the storage.
+	GetDecision(ctx context.Context, key string) (*Decision, error)
+}
+
+// AsDecisionStorage returns s if it implements DecisionStorage, otherwise an adapter
+// built over Take and Get. The adapter could not report ResetAt from Get.
+func AsDecisionStorage(s Storage) DecisionStorage {
+	if ds, ok := s.(DecisionStorage); ok {
+		return ds
+	}
+	return &decisionAdapter{storage: s}
+}
+
+type decisionAdapter struct {
+	storage Storage
+}
+
+func (a *decisionAdapter) TakeDecision(ctx context.Context, key string) (*Decision, error) {
+	limit, remaining, reset, ok, err := a.storage.Take(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return NewDecision(limit, remaining, reset, ok), nil
+}
+
+func (a *decisionAdapter) GetDecision(ctx context.Context, key string) (*Decision, error) {
+	limit, remaining, err := a.storage.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	d := NewDecision(limit, remaining, 0, remaining > 0)
+	d.Cost = 0
+	return d, nil
+}
@@ -0,0 +1,52 @@
+package rl_storage
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// fixedStorage returns the same values for every key
+type fixedStorage struct {
+	Storage
+	limit, remaining, reset uint64
+	ok                      bool
+}
+
+func (s *fixedStorage) Take(context.Context, string) (uint64, uint64, uint64, bool, error) {
+	return s.limit, s.remaining, s.reset, s.ok, nil
+}
+
+func (s *fixedStorage) Get(context.Context, string) (uint64, uint64, error) {
+	return s.limit, s.remaining, nil
+}
+
+func TestAsDecisionStorage(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	reset := time.Now().Add(time.Minute)
+	storage := AsDecisionStorage(&fixedStorage{limit: 10, remaining: 0, reset: uint64(reset.UnixNano()), ok: false})
+
+	decision, err := storage.TakeDecision(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := decision.ResetAt, time.Unix(0, reset.UnixNano()); !got.Equal(want) {
+		t.Errorf("reset: expected %v, got %v", want, got)
+	}
+	if got, want := decision.RetryAfter, time.Minute; got <= 0 || got > want {
+		t.Errorf("retry after: expected (0, %v], got %v", want, got)
+	}
+	if decision.Allowed || decision.Limit != 10 || decision.Cost != 1 {
+		t.Errorf("unexpected decision %+v", decision)
+	}
+
+	decision, err = storage.GetDecision(ctx, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := *decision, (Decision{Limit: 10}); got != want {
+		t.Errorf("decision: expected %+v, got %+v", want, got)
+	}
+}
@@ -6,8 +6,13 @@ import (
 	"time"
 )
 
-// ErrStopped should be returned when the storage is stopped.
-var ErrStopped = fmt.Errorf("store is stopped")
+var (
+	// ErrStopped should be returned when the storage is stopped.
+	ErrStopped = fmt.Errorf("store is stopped")
+	// ErrNotSupported should be returned by storages that could not implement an operation,
+	// e.g. per-key limits of probabilistic storages.
+	ErrNotSupported = fmt.Errorf("operation is not supported by the storage")
+)
 
 type Storage interface {
 	// Take takes the token from a storage by a given key if available and returning:
@@ -27,7 +32,27 @@ type Storage interface {
 	// Burst add more tokens to the the key's current bucket until next interval tick.
 	// This may lead current bucket interval tick to exceed the maximum number of ticks until next interval.
 	Burst(ctx context.Context, key string, tokens uint64) error
+	// Reset refills the key's bucket to its limit. Custom limits set with Set are kept.
+	// Does nothing if the key does not exist.
+	Reset(ctx context.Context, key string) error
+	// Delete removes the key with all its state. The next Take for the key would use the storage defaults.
+	Delete(ctx context.Context, key string) error
 	// Close terminates the storage and cleans up any data structures or connections.
 	// After Close(), Take() should always return zero
 	Close(ctx context.Context) error
 }
+
+// KeyState is the state of a single key reported by Scanner.
+type KeyState struct {
+	Key       string
+	Tokens    uint64
+	Remaining uint64
+	Interval  time.Duration
+}
+
+// Scanner is implemented by storages that could iterate over their keys.
+type Scanner interface {
+	// Scan calls f for every key starting with prefix until f returns false.
+	// Keys added or removed during the scan may or may not be reported.
+	Scan(ctx context.Context, prefix string, f func(state KeyState) bool) error
+}
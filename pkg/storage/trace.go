@@ -0,0 +1,34 @@
+package rl_storage
+
+import "context"
+
+// Tracer starts spans around limiter and storage operations. It is a small subset of
+// the OpenTelemetry tracer API so an OTel adapter is a few lines and not a hard dependency.
+type Tracer interface {
+	// Start starts a span named name as a child of the span in ctx (if any) and
+	// returns the context carrying the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a single traced operation.
+type Span interface {
+	// SetAttribute sets an attribute of the span. Value is a string, bool, int64 or uint64.
+	SetAttribute(key string, value interface{})
+	// RecordError marks the span as failed.
+	RecordError(err error)
+	// End finishes the span.
+	End()
+}
+
+// NopTracer is a Tracer that does nothing. It is used when no tracer is configured.
+type NopTracer struct{}
+
+func (NopTracer) Start(ctx context.Context, _ string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+type nopSpan struct{}
+
+func (nopSpan) SetAttribute(string, interface{}) {}
+func (nopSpan) RecordError(error)                {}
+func (nopSpan) End()                             {}
@@ -0,0 +1,548 @@
+package tieredstorage
+
+import (
+	"context"
+	"fmt"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ErrStoppedFlag    = fmt.Errorf("setting stop flag failed")
+	ErrNilStorage     = fmt.Errorf("remote storage is nil")
+	ErrNoBatchStorage = fmt.Errorf("remote storage does not support taking many tokens at once")
+	ErrUnknownMode    = fmt.Errorf("unknown consistency mode")
+)
+
+// Mode is the trade-off between the accuracy of the limit across instances and the number
+// of round trips to the remote storage
+type Mode int
+
+const (
+	// ModeExact takes every token from the remote storage. It is as accurate as the remote
+	// storage and costs a round trip per take.
+	ModeExact Mode = iota
+	// ModeLease takes LeaseSize tokens at once and hands them out locally. The limit is never
+	// exceeded, but tokens leased by one instance are not available to the others until they
+	// are used or returned, and a round trip is made per LeaseSize takes.
+	ModeLease
+	// ModeEventual decides takes locally with the remaining tokens reported by the remote storage
+	// and pushes the number of taken tokens every SyncInterval. Takes cost no round trips
+	// except the first one of a key per interval, but instances could exceed the limit together
+	// by the tokens they take between syncs.
+	ModeEventual
+)
+
+// TieredStorage is a local allowance of tokens per key in front of a shared remote storage,
+// e.g. RedisStorage, so takes do not cost a round trip to it each.
+type TieredStorage struct {
+	remote rlstorage.Storage
+	batch  rlstorage.BatchStorage
+
+	mode         Mode
+	leaseSize    uint64
+	syncInterval time.Duration
+	onSyncError  func(err error)
+
+	leases    map[string]*lease
+	leaseLock sync.RWMutex
+
+	// now returns current unix time in nanoseconds, it is replaced by tests
+	now func() uint64
+
+	stopped  uint32
+	stopChan chan struct{}
+	done     sync.WaitGroup
+}
+
+// lease is the local state of a key
+type lease struct {
+	lock sync.Mutex
+	// limit, remaining and reset are the last reported by the remote storage.
+	// With ModeEventual remaining is decreased by local takes.
+	limit     uint64
+	remaining uint64
+	reset     uint64
+	// expires is when the state is renewed remotely: reset, or SyncInterval after the
+	// renewal if the remote storage does not report reset
+	expires uint64
+	// renewing is closed when the remote take renewing the lease is done, it is nil if
+	// there is none. Takes of the key wait for it with the lease unlocked.
+	renewing chan struct{}
+	// tokens is the number of leased tokens not taken yet (ModeLease)
+	tokens uint64
+	// pending is the number of tokens taken locally and not pushed yet (ModeEventual)
+	pending uint64
+	// dropped is whether the lease was removed from the storage, so it should not be used anymore
+	dropped bool
+}
+
+// Config is used to NewTieredStorage. It setups the TieredStorage
+type Config struct {
+	// Mode is the consistency mode. Default is ModeExact.
+	Mode Mode
+	// LeaseSize is the number of tokens leased at once with ModeLease. Default is 10.
+	LeaseSize uint64
+	// SyncInterval is the rate at which taken tokens are pushed with ModeEventual and expired
+	// leases are released. Leases of remote storages not reporting reset expire after it.
+	// Default is 100 milliseconds.
+	SyncInterval time.Duration
+	// OnSyncError is called with the errors of background pushes.
+	OnSyncError func(err error)
+}
+
+// NewTieredStorage returns TieredStorage in front of remote. ModeLease and ModeEventual
+// require remote to implement rlstorage.BatchStorage. Closing the storage closes remote.
+func NewTieredStorage(remote rlstorage.Storage, cfg *Config) (*TieredStorage, error) {
+	if remote == nil {
+		return nil, ErrNilStorage
+	}
+	if cfg == nil {
+		cfg = new(Config)
+	}
+	if cfg.Mode < ModeExact || cfg.Mode > ModeEventual {
+		return nil, ErrUnknownMode
+	}
+
+	batch, ok := remote.(rlstorage.BatchStorage)
+	if !ok && cfg.Mode != ModeExact {
+		return nil, ErrNoBatchStorage
+	}
+
+	leaseSize := uint64(10)
+	if cfg.LeaseSize > 0 {
+		leaseSize = cfg.LeaseSize
+	}
+
+	syncInterval := 100 * time.Millisecond
+	if cfg.SyncInterval > 0 {
+		syncInterval = cfg.SyncInterval
+	}
+
+	storage := &TieredStorage{
+		remote:       remote,
+		batch:        batch,
+		mode:         cfg.Mode,
+		leaseSize:    leaseSize,
+		syncInterval: syncInterval,
+		onSyncError:  cfg.OnSyncError,
+		leases:       make(map[string]*lease),
+		now:          nanoNow,
+		stopChan:     make(chan struct{}),
+	}
+
+	if storage.mode != ModeExact {
+		storage.done.Add(1)
+		go storage.background()
+	}
+	return storage, nil
+}
+
+func nanoNow() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+func resetNanos(d *rlstorage.Decision) uint64 {
+	if d.ResetAt.IsZero() {
+		return 0
+	}
+	return uint64(d.ResetAt.UnixNano())
+}
+
+// lease returns the lease of key creating it if it does not exist
+func (storage *TieredStorage) lease(key string) *lease {
+	storage.leaseLock.RLock()
+	if l, ok := storage.leases[key]; ok {
+		storage.leaseLock.RUnlock()
+		return l
+	}
+	storage.leaseLock.RUnlock()
+
+	storage.leaseLock.Lock()
+	defer storage.leaseLock.Unlock()
+	if l, ok := storage.leases[key]; ok {
+		return l
+	}
+
+	l := new(lease)
+	storage.leases[key] = l
+	return l
+}
+
+// forget removes l of key from the storage unless it was replaced already.
+// l should be marked dropped first.
+func (storage *TieredStorage) forget(key string, l *lease) {
+	storage.leaseLock.Lock()
+	if storage.leases[key] == l {
+		delete(storage.leases, key)
+	}
+	storage.leaseLock.Unlock()
+}
+
+// lockedLease returns the locked lease of key once it is not being renewed. A lease dropped
+// while it was being locked is replaced by a new one, so tokens are not leased into a lease
+// nobody sees.
+func (storage *TieredStorage) lockedLease(ctx context.Context, key string) (*lease, error) {
+	for {
+		l := storage.lease(key)
+		l.lock.Lock()
+		if l.dropped {
+			l.lock.Unlock()
+			storage.forget(key, l)
+			continue
+		}
+		if l.renewing == nil {
+			return l, nil
+		}
+
+		renewing := l.renewing
+		l.lock.Unlock()
+		select {
+		case <-renewing:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// renew takes cost tokens of key from the remote storage like takeRemote and stores the
+// reported state in l. l should be locked, it is unlocked during the round trip.
+func (storage *TieredStorage) renew(ctx context.Context, key string, l *lease, cost uint64) (uint64, error) {
+	renewing := make(chan struct{})
+	l.renewing = renewing
+	l.lock.Unlock()
+
+	d, taken, err := storage.takeRemote(ctx, key, cost)
+
+	l.lock.Lock()
+	l.renewing = nil
+	close(renewing)
+	if err != nil {
+		return 0, err
+	}
+
+	l.limit, l.remaining, l.reset = d.Limit, d.Remaining, resetNanos(d)
+	l.expires = l.reset
+	if l.expires == 0 {
+		// the interval is unknown, the state is renewed as often as it is synced
+		l.expires = storage.now() + uint64(storage.syncInterval)
+	}
+	return taken, nil
+}
+
+// takeRemote takes up to cost tokens of key from the remote storage. If there are not enough
+// tokens for cost, the remaining ones are taken. Returns the decision and the number of taken tokens.
+func (storage *TieredStorage) takeRemote(ctx context.Context, key string, cost uint64) (*rlstorage.Decision, uint64, error) {
+	decisions, err := storage.batch.TakeMany(ctx, []rlstorage.TakeRequest{{Key: key, Cost: cost}})
+	if err != nil {
+		return nil, 0, err
+	}
+	d := decisions[0]
+	if d.Allowed {
+		return d, cost, nil
+	}
+	if d.Remaining == 0 || d.Remaining >= cost {
+		return d, 0, nil
+	}
+
+	cost = d.Remaining
+	decisions, err = storage.batch.TakeMany(ctx, []rlstorage.TakeRequest{{Key: key, Cost: cost}})
+	if err != nil {
+		return nil, 0, err
+	}
+	if d = decisions[0]; d.Allowed {
+		return d, cost, nil
+	}
+	return d, 0, nil
+}
+
+// Take attempts to remove a token from key. If take is successful, it returns true.
+// Returns tokens limit, remaining tokens count, reset time, success flag and error.
+func (storage *TieredStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, 0, false, rlstorage.ErrStopped
+	}
+
+	switch storage.mode {
+	case ModeLease:
+		return storage.takeLease(ctx, key)
+	case ModeEventual:
+		return storage.takeEventual(ctx, key)
+	default:
+		return storage.remote.Take(ctx, key)
+	}
+}
+
+// takeLease hands out a leased token leasing more if none is left. Leases expire with
+// the interval they were taken in, as the remote bucket is refilled then.
+func (storage *TieredStorage) takeLease(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	l, err := storage.lockedLease(ctx, key)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	defer l.lock.Unlock()
+
+	if l.expires <= storage.now() {
+		l.tokens = 0
+	}
+
+	if l.tokens == 0 {
+		taken, err := storage.renew(ctx, key, l, storage.leaseSize)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		l.tokens = taken
+	}
+
+	if l.tokens == 0 {
+		return l.limit, l.remaining, l.reset, false, nil
+	}
+	l.tokens--
+	return l.limit, l.remaining + l.tokens, l.reset, true, nil
+}
+
+// takeEventual takes a token locally. The first take of a key per interval is made remotely
+// to learn its state, the tokens pending from the previous interval are dropped then.
+// If the remote storage does not report reset, the interval could still go on, so the
+// pending tokens are taken together with the remote take.
+func (storage *TieredStorage) takeEventual(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	l, err := storage.lockedLease(ctx, key)
+	if err != nil {
+		return 0, 0, 0, false, err
+	}
+	defer l.lock.Unlock()
+
+	if l.expires <= storage.now() {
+		cost := uint64(1)
+		if l.reset == 0 {
+			cost += l.pending
+		}
+		taken, err := storage.renew(ctx, key, l, cost)
+		if err != nil {
+			return 0, 0, 0, false, err
+		}
+		l.pending = 0
+		return l.limit, l.remaining, l.reset, taken == cost, nil
+	}
+
+	if l.remaining == 0 {
+		return l.limit, 0, l.reset, false, nil
+	}
+	l.remaining--
+	l.pending++
+	return l.limit, l.remaining, l.reset, true, nil
+}
+
+// background pushes pending tokens and releases expired leases until the storage is closed
+func (storage *TieredStorage) background() {
+	defer storage.done.Done()
+
+	ticker := time.NewTicker(storage.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-storage.stopChan:
+			return
+		case <-ticker.C:
+		}
+
+		if err := storage.sync(context.Background()); err != nil && storage.onSyncError != nil {
+			storage.onSyncError(err)
+		}
+	}
+}
+
+// snapshot returns the keys and the leases of the storage
+func (storage *TieredStorage) snapshot() ([]string, []*lease) {
+	storage.leaseLock.RLock()
+	defer storage.leaseLock.RUnlock()
+
+	keys := make([]string, 0, len(storage.leases))
+	leases := make([]*lease, 0, len(storage.leases))
+	for key, l := range storage.leases {
+		keys = append(keys, key)
+		leases = append(leases, l)
+	}
+	return keys, leases
+}
+
+// sync pushes the tokens taken locally with ModeEventual and removes expired leases.
+// Pending tokens of expired leases are pushed only if the remote storage does not report
+// reset, as the remote bucket is refilled otherwise. Returns the first error, the other
+// keys are still pushed.
+func (storage *TieredStorage) sync(ctx context.Context) error {
+	now := storage.now()
+	keys, leases := storage.snapshot()
+
+	var firstErr error
+	for i, l := range leases {
+		l.lock.Lock()
+		expired := l.expires <= now
+		push := l.pending > 0 && (!expired || l.reset == 0)
+		drop := expired && !push && l.renewing == nil && !l.dropped
+		if drop {
+			l.dropped = true
+		}
+		l.lock.Unlock()
+
+		if drop {
+			storage.forget(keys[i], l)
+		}
+		if push {
+			if err := storage.push(ctx, keys[i], l); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// push takes the pending tokens of l from the remote storage and refreshes its remaining
+// tokens with the ones reported by it. If others took the tokens meanwhile, the remaining
+// ones are taken, so the remote storage is exhausted.
+func (storage *TieredStorage) push(ctx context.Context, key string, l *lease) error {
+	l.lock.Lock()
+	pending, expires := l.pending, l.expires
+	l.pending = 0
+	l.lock.Unlock()
+	if pending == 0 {
+		return nil
+	}
+
+	d, _, err := storage.takeRemote(ctx, key, pending)
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if err != nil {
+		// pushed again with the next sync unless the interval is over
+		if l.expires == expires {
+			l.pending += pending
+		}
+		return err
+	}
+
+	if l.expires != expires {
+		// the interval is over and the lease was renewed by a take, its state is newer
+		return nil
+	}
+	l.remaining = 0
+	if d.Remaining > l.pending {
+		l.remaining = d.Remaining - l.pending
+	}
+	return nil
+}
+
+// Get returns current limit and remaining tokens for key. Tokens leased by this instance
+// are counted as remaining, tokens taken locally with ModeEventual are counted as taken.
+func (storage *TieredStorage) Get(ctx context.Context, key string) (uint64, uint64, error) {
+	if atomic.LoadUint32(&storage.stopped) == 1 {
+		return 0, 0, rlstorage.ErrStopped
+	}
+
+	storage.leaseLock.RLock()
+	l, ok := storage.leases[key]
+	storage.leaseLock.RUnlock()
+	if !ok || storage.mode == ModeExact {
+		return storage.remote.Get(ctx, key)
+	}
+
+	l.lock.Lock()
+	expired := l.expires <= storage.now()
+	limit, remaining, tokens := l.limit, l.remaining, l.tokens
+	l.lock.Unlock()
+	if expired {
+		return storage.remote.Get(ctx, key)
+	}
+
+	if storage.mode == ModeLease {
+		limit, remaining, err := storage.remote.Get(ctx, key)
+		return limit, remaining + tokens, err
+	}
+	return limit, remaining, nil
+}
+
+// drop forgets the local state of key, so the next take learns it from the remote storage
+func (storage *TieredStorage) drop(key string) {
+	storage.leaseLock.RLock()
+	l, ok := storage.leases[key]
+	storage.leaseLock.RUnlock()
+	if !ok {
+		return
+	}
+
+	l.lock.Lock()
+	l.dropped = true
+	l.lock.Unlock()
+	storage.forget(key, l)
+}
+
+// Set setups the limit of key in the remote storage. Local tokens of the key are dropped.
+func (storage *TieredStorage) Set(ctx context.Context, key string, tokens uint64, interval time.Duration) error {
+	storage.drop(key)
+	return storage.remote.Set(ctx, key, tokens, interval)
+}
+
+// Burst adds tokens to the key in the remote storage. Local tokens of the key are dropped,
+// so the burst is seen by the next take.
+func (storage *TieredStorage) Burst(ctx context.Context, key string, tokens uint64) error {
+	storage.drop(key)
+	return storage.remote.Burst(ctx, key, tokens)
+}
+
+// Reset refills the key in the remote storage. Local tokens of the key are dropped.
+func (storage *TieredStorage) Reset(ctx context.Context, key string) error {
+	storage.drop(key)
+	return storage.remote.Reset(ctx, key)
+}
+
+// Delete removes the key from the remote storage. Local tokens of the key are dropped.
+func (storage *TieredStorage) Delete(ctx context.Context, key string) error {
+	storage.drop(key)
+	return storage.remote.Delete(ctx, key)
+}
+
+// Close returns the leased tokens not taken yet and pushes the tokens taken locally
+// to the remote storage, then closes it. Leases of the past intervals are not returned
+// as the remote buckets have been refilled since.
+func (storage *TieredStorage) Close(ctx context.Context) error {
+	if !atomic.CompareAndSwapUint32(&storage.stopped, 0, 1) {
+		return ErrStoppedFlag
+	}
+
+	close(storage.stopChan)
+	storage.done.Wait()
+
+	var firstErr error
+	if storage.mode == ModeEventual {
+		firstErr = storage.sync(ctx)
+	}
+
+	now := storage.now()
+	keys, leases := storage.snapshot()
+	for i, l := range leases {
+		l.lock.Lock()
+		tokens := l.tokens
+		if l.reset <= now {
+			// the interval is over or unknown, the returned tokens could exceed the limit
+			tokens = 0
+		}
+		l.tokens = 0
+		l.dropped = true
+		l.lock.Unlock()
+		storage.forget(keys[i], l)
+
+		if storage.mode == ModeLease && tokens > 0 {
+			if err := storage.remote.Burst(ctx, keys[i], tokens); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+
+	if err := storage.remote.Close(ctx); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
@@ -0,0 +1,376 @@
+package tieredstorage
+
+import (
+	"context"
+	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countingRemote counts the round trips to MemStorage. Close does not close it,
+// so its state could be checked after the tiered storage is closed.
+type countingRemote struct {
+	*memstorage.MemStorage
+	calls uint64
+}
+
+func (r *countingRemote) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	atomic.AddUint64(&r.calls, 1)
+	return r.MemStorage.Take(ctx, key)
+}
+
+func (r *countingRemote) TakeMany(ctx context.Context, reqs []rlstorage.TakeRequest) ([]*rlstorage.Decision, error) {
+	atomic.AddUint64(&r.calls, 1)
+	return r.MemStorage.TakeMany(ctx, reqs)
+}
+
+func (r *countingRemote) Close(ctx context.Context) error {
+	return nil
+}
+
+// noResetRemote does not report reset, as storages built over Take of those without it
+type noResetRemote struct {
+	*countingRemote
+}
+
+func (r noResetRemote) TakeMany(ctx context.Context, reqs []rlstorage.TakeRequest) ([]*rlstorage.Decision, error) {
+	decisions, err := r.countingRemote.TakeMany(ctx, reqs)
+	for _, d := range decisions {
+		d.ResetAt = time.Time{}
+	}
+	return decisions, err
+}
+
+// slowRemote blocks TakeMany until release is closed
+type slowRemote struct {
+	*countingRemote
+	started chan struct{}
+	release chan struct{}
+}
+
+func (r slowRemote) TakeMany(ctx context.Context, reqs []rlstorage.TakeRequest) ([]*rlstorage.Decision, error) {
+	r.started <- struct{}{}
+	<-r.release
+	return r.countingRemote.TakeMany(ctx, reqs)
+}
+
+func testRemote(tb testing.TB, tokens uint64) *countingRemote {
+	tb.Helper()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{Tokens: tokens, Interval: time.Hour})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			tb.Fatal(err)
+		}
+	})
+	return &countingRemote{MemStorage: storage}
+}
+
+// testStorage returns the storage closed with the test. Tests closing it themselves
+// call NewTieredStorage.
+func testStorage(t *testing.T, remote rlstorage.Storage, cfg *Config) *TieredStorage {
+	t.Helper()
+
+	storage, err := NewTieredStorage(remote, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	})
+	return storage
+}
+
+// takes takes n tokens of key and returns the number of successful takes
+func takes(tb testing.TB, storage rlstorage.Storage, key string, n int) int {
+	tb.Helper()
+
+	taken := 0
+	for i := 0; i < n; i++ {
+		_, _, _, ok, err := storage.Take(context.Background(), key)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		if ok {
+			taken++
+		}
+	}
+	return taken
+}
+
+func TestNewTieredStorage_Config(t *testing.T) {
+	t.Parallel()
+
+	remote := testRemote(t, 1)
+	single := struct{ rlstorage.Storage }{remote}
+	for _, c := range []struct {
+		name   string
+		remote rlstorage.Storage
+		cfg    *Config
+		err    error
+	}{
+		{name: "nil", remote: nil, err: ErrNilStorage},
+		{name: "mode", remote: remote, cfg: &Config{Mode: ModeEventual + 1}, err: ErrUnknownMode},
+		{name: "lease without batch", remote: single, cfg: &Config{Mode: ModeLease}, err: ErrNoBatchStorage},
+		{name: "exact without batch", remote: single, cfg: nil, err: nil},
+	} {
+		if _, err := NewTieredStorage(c.remote, c.cfg); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestTieredStorage_Exact(t *testing.T) {
+	t.Parallel()
+
+	remote := testRemote(t, 5)
+	storage := testStorage(t, remote, nil)
+
+	if got, want := takes(t, storage, "key", 7), 5; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+	if got, want := atomic.LoadUint64(&remote.calls), uint64(7); got != want {
+		t.Errorf("round trips: expected %d, got %d", want, got)
+	}
+}
+
+func TestTieredStorage_Lease(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := testRemote(t, 25)
+	storage, err := NewTieredStorage(remote, &Config{Mode: ModeLease, LeaseSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leases of 10, 10 and the remaining 5 (denied lease of 10 first)
+	if got, want := takes(t, storage, "key", 26), 25; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+	// the last take is denied by the remote storage after an empty lease of 0
+	if got, want := atomic.LoadUint64(&remote.calls), uint64(5); got != want {
+		t.Errorf("round trips: expected %d, got %d", want, got)
+	}
+
+	// leased tokens are not available to others
+	other := testStorage(t, remote, &Config{Mode: ModeLease, LeaseSize: 10})
+	if got, want := takes(t, storage, "returned", 1), 1; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+	if got, want := takes(t, other, "returned", 25), 15; got != want {
+		t.Errorf("taken by other: expected %d, got %d", want, got)
+	}
+
+	// leased tokens are reported as remaining by Get
+	if _, remaining, err := storage.Get(ctx, "returned"); err != nil || remaining != 9 {
+		t.Errorf("get: expected 9 remaining, got %d/%v", remaining, err)
+	}
+
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := remote.Get(ctx, "returned"); err != nil || remaining != 9 {
+		t.Errorf("returned lease: expected 9 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestTieredStorage_LeaseExpired(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := testRemote(t, 25)
+	storage, err := NewTieredStorage(remote, &Config{Mode: ModeLease, LeaseSize: 10, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := takes(t, storage, "key", 1), 1; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+
+	// the remote bucket is refilled after the interval, the lease is not used anymore
+	now := nanoNow() + uint64(time.Hour)
+	storage.now = func() uint64 { return now }
+	if got, want := takes(t, storage, "key", 1), 1; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+	if got, want := atomic.LoadUint64(&remote.calls), uint64(2); got != want {
+		t.Errorf("round trips: expected %d, got %d", want, got)
+	}
+
+	// expired leases are not returned
+	now += uint64(time.Hour)
+	if err := storage.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := remote.Get(ctx, "key"); err != nil || remaining != 5 {
+		t.Errorf("remote: expected 5 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestTieredStorage_LeaseNoReset(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := testRemote(t, 25)
+	storage := testStorage(t, noResetRemote{remote}, &Config{Mode: ModeLease, LeaseSize: 10, SyncInterval: time.Hour})
+
+	// the lease is used until SyncInterval passes
+	if got, want := takes(t, storage, "key", 10), 10; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+	if got, want := atomic.LoadUint64(&remote.calls), uint64(1); got != want {
+		t.Errorf("round trips: expected %d, got %d", want, got)
+	}
+	if _, remaining, err := remote.Get(ctx, "key"); err != nil || remaining != 15 {
+		t.Errorf("remote: expected 15 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestTieredStorage_SlowRemote(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := slowRemote{countingRemote: testRemote(t, 10), started: make(chan struct{}), release: make(chan struct{})}
+	storage := testStorage(t, remote, &Config{Mode: ModeLease, LeaseSize: 5, SyncInterval: time.Hour})
+
+	taken := make(chan error)
+	go func() {
+		_, _, _, _, err := storage.Take(ctx, "key")
+		taken <- err
+	}()
+	<-remote.started
+
+	// the lease being renewed does not block the others
+	if err := storage.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := storage.Get(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, _, _, _, err := storage.Take(canceled, "key"); err != context.Canceled {
+		t.Errorf("waiting take: expected %v, got %v", context.Canceled, err)
+	}
+
+	close(remote.release)
+	if err := <-taken; err != nil {
+		t.Fatal(err)
+	}
+	if got, want := takes(t, storage, "key", 4), 4; got != want {
+		t.Errorf("taken from the lease: expected %d, got %d", want, got)
+	}
+	if got, want := atomic.LoadUint64(&remote.calls), uint64(1); got != want {
+		t.Errorf("round trips: expected %d, got %d", want, got)
+	}
+}
+
+func TestTieredStorage_Eventual(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := testRemote(t, 10)
+	first := testStorage(t, remote, &Config{Mode: ModeEventual, SyncInterval: time.Hour})
+	second, err := NewTieredStorage(remote, &Config{Mode: ModeEventual, SyncInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the first takes learn the state remotely
+	if got, want := takes(t, first, "key", 1)+takes(t, second, "key", 1), 2; got != want {
+		t.Errorf("taken: expected %d, got %d", want, got)
+	}
+
+	// first believes 9 tokens are left and takes them locally
+	if got, want := takes(t, first, "key", 10), 9; got != want {
+		t.Errorf("taken locally: expected %d, got %d", want, got)
+	}
+	if got, want := atomic.LoadUint64(&remote.calls), uint64(2); got != want {
+		t.Errorf("round trips: expected %d, got %d", want, got)
+	}
+
+	// only 8 tokens were left, the remote storage is exhausted by the push
+	if err := first.sync(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := remote.Get(ctx, "key"); err != nil || remaining != 0 {
+		t.Errorf("remote: expected 0 remaining, got %d/%v", remaining, err)
+	}
+
+	// second pushes its takes on close
+	if got, want := takes(t, second, "key", 3), 3; got != want {
+		t.Errorf("taken by second: expected %d, got %d", want, got)
+	}
+	if err := second.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if _, remaining, err := first.Get(ctx, "key"); err != nil || remaining != 0 {
+		t.Errorf("first: expected 0 remaining, got %d/%v", remaining, err)
+	}
+}
+
+func TestTieredStorage_Admin(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	remote := testRemote(t, 10)
+	storage := testStorage(t, remote, &Config{Mode: ModeLease, LeaseSize: 5})
+	takes(t, storage, "key", 1)
+
+	// local tokens are dropped, so the new limit is seen by the next take
+	if err := storage.Set(ctx, "key", 2, time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := takes(t, storage, "key", 3), 2; got != want {
+		t.Errorf("taken after set: expected %d, got %d", want, got)
+	}
+
+	if err := storage.Reset(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := takes(t, storage, "key", 3), 2; got != want {
+		t.Errorf("taken after reset: expected %d, got %d", want, got)
+	}
+
+	if err := storage.Delete(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if limit, _, err := storage.Get(ctx, "key"); err != nil || limit != 0 {
+		t.Errorf("get after delete: expected no key, got limit %d/%v", limit, err)
+	}
+}
+
+func BenchmarkTieredStorage_Take(b *testing.B) {
+	for _, c := range []struct {
+		name string
+		mode Mode
+	}{{"exact", ModeExact}, {"lease", ModeLease}, {"eventual", ModeEventual}} {
+		b.Run(c.name, func(b *testing.B) {
+			storage, err := NewTieredStorage(testRemote(b, 1<<40), &Config{Mode: c.mode, LeaseSize: 100})
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() {
+				if err := storage.Close(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			})
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, _, _, _, err := storage.Take(context.Background(), "key"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
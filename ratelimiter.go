@@ -1,6 +1,7 @@
 package go_rate_limiter
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
@@ -10,9 +11,10 @@ import (
 )
 
 var (
-	ErrNoHeaderFound = fmt.Errorf("no specified header found")
-	ErrNilStorage    = fmt.Errorf("storage is nil")
-	ErrNilKeyFunc    = fmt.Errorf("keyfunc is nil")
+	ErrNoHeaderFound  = fmt.Errorf("no specified header found")
+	ErrNilStorage     = fmt.Errorf("storage is nil")
+	ErrNilKeyFunc     = fmt.Errorf("keyfunc is nil")
+	ErrNoBatchStorage = fmt.Errorf("storage does not support taking many keys at once")
 )
 
 const (
@@ -57,13 +59,49 @@ func HeadersKeyFunc(headers ...string) KeyFunc {
 	}
 }
 
+// StaticKeyFunc returns the same key for every request. It could be used for global limits.
+func StaticKeyFunc(key string) KeyFunc {
+	return func(r *http.Request) (string, error) {
+		return key, nil
+	}
+}
+
 // LimiterMiddleware is a mux that implements rate limiting and can wrap other middleware.
 type LimiterMiddleware struct {
-	storage rlstorage.Storage
-	keyFunc KeyFunc
+	storage    rlstorage.DecisionStorage
+	batch      rlstorage.BatchStorage
+	keyFunc    KeyFunc
+	parentKeys []KeyFunc
+
+	policy  string
+	metrics *Metrics
+	tracer  rlstorage.Tracer
+	events  EventSink
+}
+
+// MiddlewareConfig is used to NewLimiterMiddlewareWithConfig. It setups optional LimiterMiddleware features.
+type MiddlewareConfig struct {
+	// Policy is the name of the limit used to label metrics. Default is "default".
+	Policy string
+	// Metrics collects decisions of the middleware if set.
+	Metrics *Metrics
+	// Tracer starts a span per decision. The span is passed to the storage in the request context.
+	Tracer rlstorage.Tracer
+	// Events receives a record of every decision if set. Wrap it with NewSampledSink
+	// to reduce the volume of allowed decisions.
+	Events EventSink
+	// ParentKeys are the keys of the broader limits checked together with the key of KeyFunc,
+	// e.g. per-org and global (see StaticKeyFunc) limits on top of the per-user one. A token is taken
+	// from all of them or from none in a single storage call, so the storage should implement
+	// rlstorage.BatchStorage. The headers report the most restrictive limit.
+	ParentKeys []KeyFunc
 }
 
 func NewLimiterMiddleware(s rlstorage.Storage, f KeyFunc) (*LimiterMiddleware, error) {
+	return NewLimiterMiddlewareWithConfig(s, f, nil)
+}
+
+func NewLimiterMiddlewareWithConfig(s rlstorage.Storage, f KeyFunc, cfg *MiddlewareConfig) (*LimiterMiddleware, error) {
 	if s == nil {
 		return nil, ErrNilStorage
 	}
@@ -72,39 +110,155 @@ func NewLimiterMiddleware(s rlstorage.Storage, f KeyFunc) (*LimiterMiddleware, e
 		return nil, ErrNilKeyFunc
 	}
 
+	if cfg == nil {
+		cfg = new(MiddlewareConfig)
+	}
+
+	policy := "default"
+	if cfg.Policy != "" {
+		policy = cfg.Policy
+	}
+
+	var tracer rlstorage.Tracer = rlstorage.NopTracer{}
+	if cfg.Tracer != nil {
+		tracer = cfg.Tracer
+	}
+
+	var batch rlstorage.BatchStorage
+	if len(cfg.ParentKeys) > 0 {
+		var ok bool
+		if batch, ok = s.(rlstorage.BatchStorage); !ok {
+			return nil, ErrNoBatchStorage
+		}
+
+		for _, parent := range cfg.ParentKeys {
+			if parent == nil {
+				return nil, ErrNilKeyFunc
+			}
+		}
+	}
+
 	return &LimiterMiddleware{
-		storage: s,
-		keyFunc: f,
+		storage:    rlstorage.AsDecisionStorage(s),
+		batch:      batch,
+		keyFunc:    f,
+		parentKeys: cfg.ParentKeys,
+		policy:     policy,
+		metrics:    cfg.Metrics,
+		tracer:     tracer,
+		events:     cfg.Events,
 	}, nil
 }
 
+// take takes a token by key and by the parent keys of r. It returns the most restrictive
+// decision with its key: the first one without enough tokens or the one with the fewest remaining.
+func (lm *LimiterMiddleware) take(ctx context.Context, r *http.Request, key string) (string, *rlstorage.Decision, error) {
+	if lm.batch == nil {
+		decision, err := lm.storage.TakeDecision(ctx, key)
+		return key, decision, err
+	}
+
+	reqs := make([]rlstorage.TakeRequest, 0, 1+len(lm.parentKeys))
+	reqs = append(reqs, rlstorage.TakeRequest{Key: key, Cost: 1})
+	for _, parent := range lm.parentKeys {
+		parentKey, err := parent(r)
+		if err != nil {
+			return key, nil, err
+		}
+		reqs = append(reqs, rlstorage.TakeRequest{Key: parentKey, Cost: 1})
+	}
+
+	decisions, err := lm.batch.TakeMany(ctx, reqs)
+	if err != nil {
+		return key, nil, err
+	}
+
+	chosen := 0
+	for i, decision := range decisions {
+		if !decision.Allowed && decision.Remaining < decision.Cost {
+			chosen = i
+			break
+		}
+		if decision.Remaining < decisions[chosen].Remaining {
+			chosen = i
+		}
+	}
+	return reqs[chosen].Key, decisions[chosen], nil
+}
+
+// observe records the outcome of a single decision
+func (lm *LimiterMiddleware) observe(ctx context.Context, span rlstorage.Span, event *Event, outcome string, err error) {
+	event.Outcome = outcome
+	if err != nil {
+		event.Error = err.Error()
+		span.RecordError(err)
+	}
+
+	span.SetAttribute(AttributeOutcome, outcome)
+	span.End()
+
+	if lm.metrics != nil {
+		lm.metrics.ObserveDecision(lm.policy, outcome)
+	}
+
+	if lm.events != nil {
+		lm.events.Record(ctx, event)
+	}
+}
+
 func (lm *LimiterMiddleware) Handle(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := r.Context()
+		ctx, span := lm.tracer.Start(r.Context(), SpanDecision)
+		span.SetAttribute(AttributePolicy, lm.policy)
+		span.SetAttribute(AttributeCost, uint64(1))
+
+		event := &Event{
+			Time:   time.Now(),
+			Policy: lm.policy,
+			Cost:   1,
+			Path:   r.URL.Path,
+			Method: r.Method,
+		}
+
 		key, err := lm.keyFunc(r)
 		if err != nil {
+			lm.observe(ctx, span, event, OutcomeError, err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
-
-		limit, remaining, reset, ok, err := lm.storage.Take(ctx, key)
+		key, decision, err := lm.take(ctx, r, key)
+		span.SetAttribute(AttributeKeyHash, hashKey(key))
+		event.Key = key
 		if err != nil {
+			lm.observe(ctx, span, event, OutcomeError, err)
 			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 			return
 		}
+		decision.Policy = lm.policy
+
+		span.SetAttribute(AttributeLimit, decision.Limit)
+		span.SetAttribute(AttributeRemaining, decision.Remaining)
+		resetAt := decision.ResetAt
+		if resetAt.IsZero() {
+			// the storage reported no reset time, the headers keep reporting the epoch for it
+			resetAt = time.Unix(0, 0)
+		}
+		event.Limit, event.Remaining, event.Reset = decision.Limit, decision.Remaining, resetAt.UTC()
 
-		resetFormatted := time.Unix(0, int64(reset)).UTC().Format(time.RFC822)
+		resetFormatted := event.Reset.Format(time.RFC822)
 
-		w.Header().Set(HeaderRateLimitLimit, strconv.FormatUint(limit, 10))
-		w.Header().Set(HeaderRateLimitRemaining, strconv.FormatUint(remaining, 10))
+		w.Header().Set(HeaderRateLimitLimit, strconv.FormatUint(decision.Limit, 10))
+		w.Header().Set(HeaderRateLimitRemaining, strconv.FormatUint(decision.Remaining, 10))
 		w.Header().Set(HeaderRateLimitReset, resetFormatted)
 
-		if !ok {
+		if !decision.Allowed {
+			lm.observe(ctx, span, event, OutcomeLimited, nil)
 			w.Header().Set(HeaderRetryAfter, resetFormatted)
 			http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
 			return
 		}
 
+		lm.observe(ctx, span, event, OutcomeAllowed, nil)
 		next.ServeHTTP(w, r)
 	})
 }
@@ -1,6 +1,7 @@
 package go_rate_limiter
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
 )
 
 func TestNewLimiterMiddleware(t *testing.T) {
@@ -34,6 +36,7 @@ func TestNewLimiterMiddleware(t *testing.T) {
 	}
 
 	for _, c := range cases {
+		c := c
 		t.Run(c.name, func(t *testing.T) {
 			t.Parallel()
 			storage, err := memstorage.NewMemStorage(&memstorage.Config{
@@ -123,3 +126,85 @@ func TestNewLimiterMiddleware(t *testing.T) {
 		})
 	}
 }
+
+func TestLimiterMiddleware_ParentKeys(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{
+		Tokens:   3,
+		Interval: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	middleware, err := NewLimiterMiddlewareWithConfig(storage, HeadersKeyFunc("X-User"), &MiddlewareConfig{
+		ParentKeys: []KeyFunc{StaticKeyFunc("global")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(user string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodGet, "/", nil)
+		request.Header.Set("X-User", user)
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	// users share the global limit
+	for _, user := range []string{"a", "a", "b"} {
+		if got, want := serve(user).Code, http.StatusOK; got != want {
+			t.Fatalf("status: expected %d, got %d", want, got)
+		}
+	}
+	recorder := serve("c")
+	if got, want := recorder.Code, http.StatusTooManyRequests; got != want {
+		t.Fatalf("status: expected %d, got %d", want, got)
+	}
+	if got, want := recorder.Header().Get(HeaderRateLimitRemaining), "0"; got != want {
+		t.Errorf("remaining: expected %s, got %s", want, got)
+	}
+
+	// nothing was taken from the user when the global limit denied the request
+	if _, remaining, err := storage.Get(ctx, "c"); err != nil || remaining != 3 {
+		t.Errorf("user remaining: expected 3, got %d (%v)", remaining, err)
+	}
+
+	if _, err := NewLimiterMiddlewareWithConfig(&struct{ rlstorage.Storage }{storage}, IPKeyFunc(), &MiddlewareConfig{
+		ParentKeys: []KeyFunc{StaticKeyFunc("global")},
+	}); err != ErrNoBatchStorage {
+		t.Errorf("expected %v, got %v", ErrNoBatchStorage, err)
+	}
+}
+
+func TestLimiterMiddleware_NoReset(t *testing.T) {
+	t.Parallel()
+
+	middleware, err := NewLimiterMiddleware(new(resetlessStorage), IPKeyFunc())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})).
+		ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	if got, want := recorder.Code, http.StatusTooManyRequests; got != want {
+		t.Errorf("status: expected %d, got %d", want, got)
+	}
+	epoch := time.Unix(0, 0).UTC().Format(time.RFC822)
+	for _, header := range []string{HeaderRateLimitReset, HeaderRetryAfter} {
+		if got := recorder.Header().Get(header); got != epoch {
+			t.Errorf("%s: expected %q, got %q", header, epoch, got)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	rlstorage "pkg/rl-storage"
+	"time"
+)
+
+var (
+	ErrMessageDropped = fmt.Errorf("message dropped by rate limit")
+)
+
+// ViolationAction is the action StreamLimiter takes when a message exceeds the limit.
+type ViolationAction int
+
+const (
+	// ViolationDrop silently discards the message.
+	ViolationDrop ViolationAction = iota
+	// ViolationDelay holds the message until the bucket resets.
+	ViolationDelay
+	// ViolationClose asks the caller to close the stream with StreamConfig.CloseCode.
+	ViolationClose
+)
+
+// DefaultCloseCode is the WebSocket "policy violation" close code.
+const DefaultCloseCode = 1008
+
+// CloseError is returned by StreamLimiter when the stream should be closed.
+// Code is meant to be passed to the WebSocket close frame (or mapped to an HTTP status for SSE).
+type CloseError struct {
+	Code int
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("stream closed by rate limit with code %d", e.Code)
+}
+
+// StreamConfig is used to NewStreamLimiter. It setups the StreamLimiter.
+type StreamConfig struct {
+	// Namespace is prepended to every key so stream messages do not share buckets
+	// with the requests limited by LimiterMiddleware. Default is "stream:".
+	Namespace string
+	// Action is taken when a message exceeds the limit. Default is ViolationDrop.
+	Action ViolationAction
+	// CloseCode is reported in CloseError for ViolationClose. Default is DefaultCloseCode.
+	CloseCode int
+	// MaxDelay is the longest time ViolationDelay would hold a single message.
+	// If the bucket resets later than that, the message is dropped. Zero means no limit.
+	MaxDelay time.Duration
+	// MinDelay is the shortest time ViolationDelay waits before the next take. It is used
+	// when the storage does not report the reset time or it has already passed, so Wait
+	// does not spin on the storage. Default is 10 milliseconds.
+	MinDelay time.Duration
+}
+
+// StreamLimiter limits messages of long-lived connections such as WebSocket or SSE.
+// Every message takes one token from the storage. Key could be the same key that is used
+// by LimiterMiddleware (per-key limit) or any per-connection id (per-connection limit).
+type StreamLimiter struct {
+	storage   rlstorage.DecisionStorage
+	namespace string
+	action    ViolationAction
+	closeCode int
+	maxDelay  time.Duration
+	minDelay  time.Duration
+}
+
+func NewStreamLimiter(s rlstorage.Storage, cfg *StreamConfig) (*StreamLimiter, error) {
+	if s == nil {
+		return nil, ErrNilStorage
+	}
+
+	if cfg == nil {
+		cfg = new(StreamConfig)
+	}
+
+	namespace := "stream:"
+	if cfg.Namespace != "" {
+		namespace = cfg.Namespace
+	}
+
+	closeCode := DefaultCloseCode
+	if cfg.CloseCode != 0 {
+		closeCode = cfg.CloseCode
+	}
+
+	minDelay := 10 * time.Millisecond
+	if cfg.MinDelay > 0 {
+		minDelay = cfg.MinDelay
+	}
+
+	return &StreamLimiter{
+		storage:   rlstorage.AsDecisionStorage(s),
+		namespace: namespace,
+		action:    cfg.Action,
+		closeCode: closeCode,
+		maxDelay:  cfg.MaxDelay,
+		minDelay:  minDelay,
+	}, nil
+}
+
+// Wait takes a token for a single message of key. It returns nil if the message could be
+// processed, ErrMessageDropped if it should be discarded, *CloseError if the stream should
+// be closed or any storage and context error.
+func (sl *StreamLimiter) Wait(ctx context.Context, key string) error {
+	key = sl.namespace + key
+	for {
+		decision, err := sl.storage.TakeDecision(ctx, key)
+		if err != nil {
+			return err
+		}
+		if decision.Allowed {
+			return nil
+		}
+
+		switch sl.action {
+		case ViolationClose:
+			return &CloseError{Code: sl.closeCode}
+		case ViolationDelay:
+			if sl.maxDelay > 0 && decision.RetryAfter > sl.maxDelay {
+				return ErrMessageDropped
+			}
+
+			delay := decision.RetryAfter
+			if delay < sl.minDelay {
+				delay = sl.minDelay
+			}
+
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return ctx.Err()
+			case <-timer.C:
+			}
+		default:
+			return ErrMessageDropped
+		}
+	}
+}
+
+// Reader wraps r so every Read call is treated as a single message of key.
+// Dropped messages are discarded and the next one is read instead.
+func (sl *StreamLimiter) Reader(ctx context.Context, key string, r io.Reader) io.Reader {
+	return &streamReader{limiter: sl, ctx: ctx, key: key, reader: r}
+}
+
+// Writer wraps w so every Write call is treated as a single message of key.
+// Dropped messages are reported as written.
+func (sl *StreamLimiter) Writer(ctx context.Context, key string, w io.Writer) io.Writer {
+	return &streamWriter{limiter: sl, ctx: ctx, key: key, writer: w}
+}
+
+type streamReader struct {
+	limiter *StreamLimiter
+	ctx     context.Context
+	key     string
+	reader  io.Reader
+}
+
+func (sr *streamReader) Read(p []byte) (int, error) {
+	for {
+		n, err := sr.reader.Read(p)
+		if n == 0 {
+			return n, err
+		}
+
+		switch werr := sr.limiter.Wait(sr.ctx, sr.key); werr {
+		case nil:
+			return n, err
+		case ErrMessageDropped:
+			if err != nil {
+				return 0, err
+			}
+		default:
+			return 0, werr
+		}
+	}
+}
+
+type streamWriter struct {
+	limiter *StreamLimiter
+	ctx     context.Context
+	key     string
+	writer  io.Writer
+}
+
+func (sw *streamWriter) Write(p []byte) (int, error) {
+	switch err := sw.limiter.Wait(sw.ctx, sw.key); err {
+	case nil:
+		return sw.writer.Write(p)
+	case ErrMessageDropped:
+		return len(p), nil
+	default:
+		return 0, err
+	}
+}
@@ -0,0 +1,177 @@
+package go_rate_limiter
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"pkg/memstorage"
+	rlstorage "pkg/rl-storage"
+)
+
+func TestStreamLimiter_Writer(t *testing.T) {
+	t.Parallel()
+
+	type case_ struct {
+		name     string
+		action   ViolationAction
+		written  string
+		err      error
+		minDelay time.Duration
+	}
+
+	cases := []case_{
+		{
+			name:    "drop",
+			action:  ViolationDrop,
+			written: "ab",
+		},
+		{
+			name:    "close",
+			action:  ViolationClose,
+			written: "ab",
+			err:     &CloseError{Code: DefaultCloseCode},
+		},
+		{
+			name:     "delay",
+			action:   ViolationDelay,
+			written:  "abc",
+			minDelay: 50 * time.Millisecond,
+		},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			ctx := context.Background()
+			storage, err := memstorage.NewMemStorage(&memstorage.Config{
+				Tokens:   2,
+				Interval: 200 * time.Millisecond,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				if err := storage.Close(ctx); err != nil {
+					t.Fatal(err)
+				}
+			})
+
+			limiter, err := NewStreamLimiter(storage, &StreamConfig{Action: c.action})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var buf bytes.Buffer
+			writer := limiter.Writer(ctx, "conn", &buf)
+
+			start := time.Now()
+			var lastErr error
+			for _, message := range []string{"a", "b", "c"} {
+				if _, err := writer.Write([]byte(message)); err != nil {
+					lastErr = err
+				}
+			}
+
+			if got, want := buf.String(), c.written; got != want {
+				t.Errorf("written: expected %q, got %q", want, got)
+			}
+			if c.err != nil {
+				var closeErr *CloseError
+				if !errors.As(lastErr, &closeErr) || closeErr.Code != DefaultCloseCode {
+					t.Errorf("err: expected %v, got %v", c.err, lastErr)
+				}
+			} else if lastErr != nil {
+				t.Errorf("err: expected nil, got %v", lastErr)
+			}
+			if got, want := time.Since(start), c.minDelay; got < want {
+				t.Errorf("delay: expected at least %v, got %v", want, got)
+			}
+
+			// stream keys should not share buckets with regular ones
+			_, _, _, ok, err := storage.Take(ctx, "conn")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !ok {
+				t.Errorf("expected namespaced stream bucket")
+			}
+		})
+	}
+}
+
+func TestStreamLimiter_Reader(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{
+		Tokens:   1,
+		Interval: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	limiter, err := NewStreamLimiter(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reader := limiter.Reader(ctx, "conn", strings.NewReader("abc"))
+	buf := make([]byte, 1)
+
+	n, err := reader.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(buf[:n]), "a"; got != want {
+		t.Errorf("read: expected %q, got %q", want, got)
+	}
+
+	// every next message is dropped until the end of the stream
+	if n, err := reader.Read(buf); n != 0 || err == nil {
+		t.Errorf("read: expected eof, got %d bytes and %v", n, err)
+	}
+}
+
+// resetlessStorage denies every take without reporting the reset time
+type resetlessStorage struct {
+	rlstorage.Storage
+	takes uint64
+}
+
+func (s *resetlessStorage) Take(ctx context.Context, key string) (uint64, uint64, uint64, bool, error) {
+	atomic.AddUint64(&s.takes, 1)
+	return 1, 0, 0, false, nil
+}
+
+func TestStreamLimiter_MinDelay(t *testing.T) {
+	t.Parallel()
+
+	storage := new(resetlessStorage)
+	limiter, err := NewStreamLimiter(storage, &StreamConfig{Action: ViolationDelay, MinDelay: 20 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := limiter.Wait(ctx, "conn"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected %v, got %v", context.DeadlineExceeded, err)
+	}
+
+	// a take per MinDelay, not a busy loop
+	if takes := atomic.LoadUint64(&storage.takes); takes > 6 {
+		t.Errorf("expected 6 takes at most, got %d", takes)
+	}
+}
@@ -0,0 +1,24 @@
+package go_rate_limiter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+const (
+	// SpanDecision is the name of the span started by LimiterMiddleware per request.
+	SpanDecision = "ratelimiter.decision"
+
+	AttributePolicy    = "ratelimiter.policy"
+	AttributeKeyHash   = "ratelimiter.key_hash"
+	AttributeCost      = "ratelimiter.cost"
+	AttributeLimit     = "ratelimiter.limit"
+	AttributeRemaining = "ratelimiter.remaining"
+	AttributeOutcome   = "ratelimiter.outcome"
+)
+
+// hashKey returns short hex sha256 of key, so spans never carry raw keys (IPs, tokens...)
+func hashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:8])
+}
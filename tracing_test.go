@@ -0,0 +1,93 @@
+package go_rate_limiter
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	rlstorage "pkg/rl-storage"
+	"sync"
+	"testing"
+	"time"
+
+	"pkg/memstorage"
+)
+
+type testSpan struct {
+	name       string
+	attributes map[string]interface{}
+	err        error
+	ended      bool
+}
+
+func (s *testSpan) SetAttribute(key string, value interface{}) { s.attributes[key] = value }
+func (s *testSpan) RecordError(err error)                      { s.err = err }
+func (s *testSpan) End()                                       { s.ended = true }
+
+type testTracer struct {
+	lock  sync.Mutex
+	spans []*testSpan
+}
+
+func (t *testTracer) Start(ctx context.Context, name string) (context.Context, rlstorage.Span) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	span := &testSpan{name: name, attributes: make(map[string]interface{})}
+	t.spans = append(t.spans, span)
+	return ctx, span
+}
+
+func TestLimiterMiddleware_Tracer(t *testing.T) {
+	t.Parallel()
+	ctx := context.Background()
+
+	storage, err := memstorage.NewMemStorage(&memstorage.Config{
+		Tokens:   1,
+		Interval: 1 * time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := storage.Close(ctx); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	tracer := new(testTracer)
+	middleware, err := NewLimiterMiddlewareWithConfig(storage, IPKeyFunc(), &MiddlewareConfig{Tracer: tracer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := middleware.Handle(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for i := 0; i < 2; i++ {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	if got, want := len(tracer.spans), 2; got != want {
+		t.Fatalf("spans: expected %d, got %d", want, got)
+	}
+
+	for i, outcome := range []string{OutcomeAllowed, OutcomeLimited} {
+		span := tracer.spans[i]
+		if got, want := span.name, SpanDecision; got != want {
+			t.Errorf("name: expected %q, got %q", want, got)
+		}
+		if !span.ended {
+			t.Errorf("expected span to be ended")
+		}
+		if got, want := span.attributes[AttributeOutcome], outcome; got != want {
+			t.Errorf("outcome: expected %v, got %v", want, got)
+		}
+		if got, want := span.attributes[AttributeRemaining], uint64(0); got != want {
+			t.Errorf("remaining: expected %v, got %v", want, got)
+		}
+		if got, want := span.attributes[AttributeKeyHash], hashKey("192.0.2.1"); got != want {
+			t.Errorf("key hash: expected %v, got %v", want, got)
+		}
+		if got, want := span.attributes[AttributeCost], uint64(1); got != want {
+			t.Errorf("cost: expected %v, got %v", want, got)
+		}
+	}
+}